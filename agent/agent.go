@@ -0,0 +1,214 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package agent is a stand-in for the guest agent in rootfs/guest/daemon.py.
+// It serves the same HTTP API and implements the functions that need no
+// Redis, so invocations can be tested without a guest image.
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HTTPPort is the TCP port the agent listens on in the guest.
+	HTTPPort = 5000
+	// VsockPort is the guest port the agent listens on for vsock connections.
+	VsockPort = 5000
+)
+
+// Agent is the state of one guest agent.
+type Agent struct {
+	sync.Mutex
+	env map[string]string
+}
+
+func New() *Agent {
+	return &Agent{env: map[string]string{}}
+}
+
+// Handler returns the HTTP API of a new agent.
+func Handler() http.Handler {
+	return New().Handler()
+}
+
+// Handler returns the HTTP API of the agent.
+func (a *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, World!")
+	})
+	mux.HandleFunc("/invoke", invoke)
+	mux.HandleFunc("/env", a.setEnv)
+	mux.HandleFunc("/drop_caches", dropCaches)
+	mux.HandleFunc("/dmesg", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "")
+	})
+	mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "")
+	})
+	return mux
+}
+
+// setEnv stores the environment injected by the daemon.
+func (a *Agent) setEnv(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	env := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.Lock()
+	a.env = env
+	a.Unlock()
+	fmt.Fprint(w, "OK")
+}
+
+// Env returns the environment last injected by the daemon.
+func (a *Agent) Env() map[string]string {
+	a.Lock()
+	defer a.Unlock()
+	ret := make(map[string]string, len(a.env))
+	for k, v := range a.env {
+		ret[k] = v
+	}
+	return ret
+}
+
+// dropCaches stands in for writing to /proc/sys/vm/drop_caches in the guest.
+// The agent shares the kernel of the host, so nothing is dropped.
+func dropCaches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := strconv.Atoi(r.URL.Query().Get("mode")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+func invoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	args := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		log.Println("agent: decoding args failed:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	read, processed, err := function(r.URL.Query().Get("function"), args)
+	if err != nil {
+		log.Println("agent:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	finish := time.Now()
+	fmt.Fprintf(w, "read %f\nprocess %f\nwrite %f", read.Sub(start).Seconds(), processed.Sub(read).Seconds(), finish.Sub(processed).Seconds())
+}
+
+// function runs funcName and returns when it finished reading its input and
+// when it finished processing, like the handlers of daemon.py.
+func function(funcName string, args map[string]interface{}) (time.Time, time.Time, error) {
+	switch funcName {
+	case "hello":
+		ts := time.Now()
+		return ts, ts, nil
+	case "allocate":
+		ts1 := time.Now()
+		size, err := intArg(args, "size")
+		if err != nil {
+			return ts1, ts1, err
+		}
+		l := make([]byte, size)
+		for i := range l {
+			l[i] = 1
+		}
+		return ts1, time.Now(), nil
+	}
+	return time.Time{}, time.Time{}, errors.New("unknown function")
+}
+
+func intArg(args map[string]interface{}, name string) (int, error) {
+	switch v := args[name].(type) {
+	case float64:
+		return int(v), nil
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, fmt.Errorf("argument %v missing", name)
+}
+
+// vsockListener accepts connections on the host side unix socket of a
+// firecracker vsock device and completes the "CONNECT <port>" handshake.
+type vsockListener struct {
+	net.Listener
+	port int
+}
+
+// ListenVsock listens on the unix socket udsPath the way firecracker forwards
+// host-initiated vsock connections to a guest listening on port.
+func ListenVsock(udsPath string, port int) (net.Listener, error) {
+	l, err := net.Listen("unix", udsPath)
+	if err != nil {
+		return nil, err
+	}
+	return &vsockListener{Listener: l, port: port}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// the peer waits for the reply before sending, so nothing is left in the buffer
+		line, err := bufio.NewReaderSize(conn, 16).ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != "CONNECT "+strconv.Itoa(l.port) {
+			log.Println("agent: bad vsock handshake:", strings.TrimSpace(line), err)
+			conn.Close()
+			continue
+		}
+		if _, err := fmt.Fprintf(conn, "OK %d\n", 1<<30); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
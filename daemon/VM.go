@@ -33,7 +33,7 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -72,11 +72,22 @@ type Network struct {
 	uniqueAddr  string
 }
 
+// networkMeta is the on-disk form of a Network.
+type networkMeta struct {
+	Namespace   string `json:"namespace"`
+	HostDevName string `json:"host_dev_name"`
+	IfaceId     string `json:"iface_id"`
+	GuestMac    string `json:"guest_mac"`
+	GuestAddr   string `json:"guest_addr"`
+	UniqueAddr  string `json:"unique_addr"`
+}
+
 type VmConfig struct {
 	BootSource    BootSource    `json:"boot-source"`
 	Drives        []Drive       `json:"drives"`
 	MachineConfig MachineConfig `json:"machine-config"`
 	Networks      []Network     `json:"network-interfaces"`
+	Vsock         *Vsock        `json:"vsock,omitempty"`
 }
 
 type VM struct {
@@ -90,9 +101,31 @@ type VM struct {
 	VmPath      string    `json:"vmPath"`
 	MincoreSize int       `json:"mincoreSize"`
 	ReapId      string    `json:"reapId"`
-	process     *os.Process
+	StartTime   time.Time `json:"startTime"`
+	LastUsed    time.Time `json:"lastUsed"`
+	process     VMMProcess
 	httpc       *http.Client
 	Snapshot    *Snapshot
+	diffEnabled bool      // dirty pages are tracked
+	diffBase    *Snapshot // dirty pages are tracked since, nil until a cold-started VM is snapshotted
+}
+
+// diffParent returns the snapshot a diff snapshot of the VM is based on, and
+// whether the VM tracks dirty pages at all.
+func (vm *VM) diffParent() (*Snapshot, bool) {
+	vm.Lock()
+	defer vm.Unlock()
+	return vm.diffBase, vm.diffEnabled
+}
+
+// setDiffParent bases later diff snapshots of the VM on snap, as taking a
+// snapshot resets the dirty pages.
+func (vm *VM) setDiffParent(snap *Snapshot) {
+	vm.Lock()
+	defer vm.Unlock()
+	if vm.diffEnabled {
+		vm.diffBase = snap
+	}
 }
 
 func (vm *VM) Dial() error {
@@ -132,19 +165,47 @@ connected:
 	return nil
 }
 
+// Model converts the VM to its API representation.
+func (vm *VM) Model() *models.VM {
+	vmId := vm.VmId
+	ret := &models.VM{
+		VMID:     &vmId,
+		State:    vm.State,
+		VMConf:   vm.VmConf,
+		VMPath:   vm.VmPath,
+		Function: vm.Function,
+		ReapID:   vm.ReapId,
+		Uptime:   time.Since(vm.StartTime).Seconds(),
+	}
+	if vm.Snapshot != nil {
+		ret.SsID = vm.Snapshot.SnapshotId
+	}
+	if vm.VMNetwork != nil {
+		ret.Namespace = vm.VMNetwork.namespace
+	}
+	if vm.process != nil && vm.process.Pid() != 0 {
+		ret.Pid = int64(vm.process.Pid())
+	}
+	return ret
+}
+
 type VMController struct {
 	sync.Mutex
-	config   *Config
-	BasePath string              `json:"basePath"`
-	Machines map[string]*VM      `json:"machines"`
-	Networks map[string]*Network `json:"netInterfaces"`
-	VMMPool  map[string]*VM      `json:"vmmPool"`
+	config    *Config
+	launcher  Launcher
+	transport Transport
+	BasePath  string              `json:"basePath"`
+	Machines  map[string]*VM      `json:"machines"`
+	Networks  map[string]*Network `json:"netInterfaces"`
+	VMMPool   map[string]*VM      `json:"vmmPool"`
 }
 
 func NewVMController(config *Config) *VMController {
 	vc := new(VMController)
 	vc.Mutex = sync.Mutex{}
 	vc.config = config
+	vc.launcher = newLauncher(config)
+	vc.transport = newTransport(config)
 	vc.BasePath = config.BasePath
 	vc.Machines = make(map[string]*VM)
 	vc.Networks = make(map[string]*Network)
@@ -161,13 +222,115 @@ func NewVMController(config *Config) *VMController {
 
 func (vc *VMController) AddNetwork(req *http.Request, namespace, hostDevName, ifaceId, guestMac, guestAddr, uniqueAddr string) error {
 	// TODO: verify
+	vc.Lock()
+	defer vc.Unlock()
 	vc.Networks[namespace] = &Network{namespace: namespace, HostDevName: hostDevName, IfaceId: ifaceId, GuestMac: guestMac, guestAddr: guestAddr, uniqueAddr: uniqueAddr}
+	if err := vc.saveNetworks(); err != nil {
+		log.Println("saving networks failed:", err)
+	}
 	return nil
 }
 
-func (vc *VMController) StartVM(ctx *context.Context, function, kernel, image, namespace string, vcpu, memSize int) (string, error) {
-	_, span := trace.StartSpan(*ctx, "startVM_setup")
+// network returns the network interface added for namespace.
+func (vc *VMController) network(namespace string) (*Network, bool) {
+	vc.Lock()
+	defer vc.Unlock()
 	netIface, ok := vc.Networks[namespace]
+	return netIface, ok
+}
+
+func (vc *VMController) networksPath() string {
+	return vc.BasePath + "/networks.json"
+}
+
+// saveNetworks persists the network interfaces. Callers must hold vc's lock.
+func (vc *VMController) saveNetworks() error {
+	metas := make([]networkMeta, 0, len(vc.Networks))
+	for _, n := range vc.Networks {
+		metas = append(metas, networkMeta{
+			Namespace:   n.namespace,
+			HostDevName: n.HostDevName,
+			IfaceId:     n.IfaceId,
+			GuestMac:    n.GuestMac,
+			GuestAddr:   n.guestAddr,
+			UniqueAddr:  n.uniqueAddr,
+		})
+	}
+	data, err := json.Marshal(metas)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vc.BasePath, 0755); err != nil {
+		return err
+	}
+	return WriteFileAtomic(vc.networksPath(), data, 0644)
+}
+
+// LoadNetworks restores the network interfaces added by a previous run of the daemon.
+func (vc *VMController) LoadNetworks() error {
+	data, err := ioutil.ReadFile(vc.networksPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var metas []networkMeta
+	if err := json.Unmarshal(data, &metas); err != nil {
+		return err
+	}
+	vc.Lock()
+	defer vc.Unlock()
+	for _, m := range metas {
+		vc.Networks[m.Namespace] = &Network{namespace: m.Namespace, HostDevName: m.HostDevName, IfaceId: m.IfaceId, GuestMac: m.GuestMac, guestAddr: m.GuestAddr, uniqueAddr: m.UniqueAddr}
+	}
+	log.Println("loaded", len(metas), "networks")
+	return nil
+}
+
+// ListVMs returns the VMs and pooled VMMs, optionally filtered by function and
+// namespace. Empty filters match everything.
+func (vc *VMController) ListVMs(function, namespace string) []*models.VM {
+	vc.Lock()
+	defer vc.Unlock()
+	ret := []*models.VM{}
+	for _, vm := range vc.Machines {
+		if function != "" && vm.Function != function {
+			continue
+		}
+		if namespace != "" && (vm.VMNetwork == nil || vm.VMNetwork.namespace != namespace) {
+			continue
+		}
+		model := vm.Model()
+		if _, ok := vc.VMMPool[vm.VmId]; ok {
+			model.State = "pooled"
+		}
+		ret = append(ret, model)
+	}
+	sort.Slice(ret, func(i, j int) bool { return *ret[i].VMID < *ret[j].VMID })
+	return ret
+}
+
+// GetVM returns a single VM or pooled VMM.
+func (vc *VMController) GetVM(vmID string) (*models.VM, error) {
+	vc.Lock()
+	defer vc.Unlock()
+	vm, ok := vc.Machines[vmID]
+	if !ok {
+		log.Println("vmID", vmID, "not exists")
+		return nil, fmt.Errorf("vmID %v not exists", vmID)
+	}
+	model := vm.Model()
+	if _, ok := vc.VMMPool[vm.VmId]; ok {
+		model.State = "pooled"
+	}
+	return model, nil
+}
+
+// StartVM boots a VM of function. With trackDirtyPages the VM can take diff
+// snapshots after its first full snapshot.
+func (vc *VMController) StartVM(ctx *context.Context, function, kernel, image, namespace string, vcpu, memSize int, trackDirtyPages bool) (string, error) {
+	_, span := trace.StartSpan(*ctx, "startVM_setup")
+	netIface, ok := vc.network(namespace)
 	if !ok {
 		return "", fmt.Errorf("network %s not found", namespace)
 	}
@@ -186,9 +349,10 @@ func (vc *VMController) StartVM(ctx *context.Context, function, kernel, image, n
 			VcpuCount:       vcpu,
 			MemSizeMib:      memSize,
 			HtEnabled:       false,
-			TrackDirtyPages: false,
+			TrackDirtyPages: trackDirtyPages,
 		},
 		Networks: []Network{*netIface},
+		Vsock:    vc.transport.Device(),
 	}
 
 	id := RandStringRunes(8)
@@ -210,42 +374,23 @@ func (vc *VMController) StartVM(ctx *context.Context, function, kernel, image, n
 		return "", err
 	}
 
-	ip := "/bin/ip"
-	firecracker := fnManager.config.Executables["vanilla"]
-
 	apiSock := vmPath + "/firecracker.sock"
-	outFile, err := os.Create(vmPath + "/stdout")
-	if err != nil {
-		log.Println(err)
-		return "", err
-	}
-	errFile, err := os.Create(vmPath + "/stderr")
-	if err != nil {
-		log.Println(err)
-		return "", err
+	spec := &LaunchSpec{
+		Namespace:  netIface.namespace,
+		Executable: fnManager.config.Executables["vanilla"],
+		ApiSock:    apiSock,
+		VmPath:     vmPath,
+		Args:       []string{"--config-file", configFile},
+		Config:     conf,
 	}
 	span.End()
 
-	cmd := &exec.Cmd{
-		Path: ip,
-		Args: []string{
-			ip,
-			"netns",
-			"exec",
-			netIface.namespace,
-			firecracker,
-			"--api-sock", apiSock,
-			"--config-file", configFile,
-		},
-		Stdout: outFile,
-		Stderr: errFile,
-	}
-
-	log.Println("running vm", id, " with command:", *cmd)
+	log.Println("running vm", id, "with spec:", *spec)
 
 	_, span = trace.StartSpan(*ctx, "firecracker_start_vm")
 	defer span.End()
-	if err := cmd.Start(); err != nil {
+	process, err := vc.launcher.Launch(*ctx, spec)
+	if err != nil {
 		log.Println(err)
 		return "", err
 	}
@@ -253,14 +398,16 @@ func (vc *VMController) StartVM(ctx *context.Context, function, kernel, image, n
 	log.Println("vmID:", id, "Started")
 
 	newVM := &VM{
-		VmId:      id,
-		Function:  function,
-		State:     "uninitialized",
-		Socket:    apiSock,
-		VMNetwork: netIface,
-		VmConf:    conf,
-		VmPath:    vmPath,
-		process:   cmd.Process,
+		VmId:        id,
+		Function:    function,
+		State:       vmStateRunning,
+		Socket:      apiSock,
+		VMNetwork:   netIface,
+		VmConf:      conf,
+		VmPath:      vmPath,
+		StartTime:   time.Now(),
+		process:     process,
+		diffEnabled: trackDirtyPages,
 	}
 
 	vc.Lock()
@@ -268,7 +415,7 @@ func (vc *VMController) StartVM(ctx *context.Context, function, kernel, image, n
 	vc.Unlock()
 
 	go func(vm *VM) {
-		if err := cmd.Wait(); err != nil {
+		if err := vm.process.Wait(); err != nil {
 			log.Println(err)
 		}
 		log.Println("vmID:", vm.VmId, "Stopped")
@@ -276,35 +423,110 @@ func (vc *VMController) StartVM(ctx *context.Context, function, kernel, image, n
 		delete(vc.Machines, vm.VmId)
 		vc.Unlock()
 	}(newVM)
+
+	if err := vc.injectEnv(*ctx, newVM, function); err != nil {
+		vc.StopVM(nil, id)
+		return "", err
+	}
 	return id, nil
 }
 
 func (vc *VMController) StopVM(req *http.Request, vmID string) error {
 	vc.Lock()
 	vm, ok := vc.Machines[vmID]
+	var snapshot *Snapshot
+	if ok {
+		snapshot = vm.Snapshot
+	}
 	vc.Unlock()
 	if ok {
-		if vm.ReapId != "" {
+		var reapErr error
+		if reapId := vc.reapIdOf(vmID); reapId != "" {
 			log.Println("Deactivating Reap...")
-			records, err := reap.Deactivate(vm.ReapId)
+			records, err := reap.Deactivate(reapId)
 			if err != nil {
+				// the VM is stopped anyway, a failed REAP instance cannot serve it
 				log.Println("Deactivate Reap:", err)
-				return err
+				reapErr = err
+			} else {
+				snapshot.Lock()
+				snapshot.records = make([]uint64, len(records))
+				copy(snapshot.records, records)
+				snapshot.Unlock()
+				snapshot.save()
 			}
-			vm.Snapshot.records = make([]uint64, len(records))
-			copy(vm.Snapshot.records, records)
 		}
 		if err := vm.process.Signal(syscall.SIGTERM); err != nil {
 			log.Println("Error calling Signal:", err)
 			log.Println("Not critical if 'process already finished' because userpagefault already deactivated")
 		}
-		return nil
+		return reapErr
 	} else {
 		log.Println("vmID", vmID, "not exists")
 		return errors.New("vmID not exists")
 	}
 }
 
+// lookup returns the VM vmID.
+func (vc *VMController) lookup(vmID string) (*VM, bool) {
+	vc.Lock()
+	defer vc.Unlock()
+	vm, ok := vc.Machines[vmID]
+	return vm, ok
+}
+
+// setReapId records the REAP instance serving the memory of vmID.
+func (vc *VMController) setReapId(vmID, reapId string) {
+	vc.Lock()
+	defer vc.Unlock()
+	if vm, ok := vc.Machines[vmID]; ok {
+		vm.ReapId = reapId
+	}
+}
+
+// reapIdOf returns the REAP instance serving the memory of vmID, if any.
+func (vc *VMController) reapIdOf(vmID string) string {
+	vc.Lock()
+	defer vc.Unlock()
+	if vm, ok := vc.Machines[vmID]; ok {
+		return vm.ReapId
+	}
+	return ""
+}
+
+// killReapVM kills the VM served by a failed REAP instance. Its invocations
+// fail, other VMs are not affected.
+func (vc *VMController) killReapVM(reapId string, reapErr error) {
+	vc.Lock()
+	var victim *VM
+	for _, vm := range vc.Machines {
+		if vm.ReapId == reapId {
+			victim = vm
+			break
+		}
+	}
+	vc.Unlock()
+	if victim == nil {
+		return
+	}
+	log.Println("REAP instance", reapId, "failed:", reapErr, "- killing vm", victim.VmId)
+	if err := victim.process.Signal(syscall.SIGKILL); err != nil {
+		log.Println("killing", victim.VmId, "failed:", err)
+	}
+}
+
+// WaitStopped waits until the VMM process of vmID has exited.
+func (vc *VMController) WaitStopped(vmID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, ok := vc.lookup(vmID); !ok {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("vm %v did not stop within %v", vmID, timeout)
+}
+
 func (vc *VMController) TakeSnapshot(r *http.Request, vmID string, snap *Snapshot) error {
 	vc.Lock()
 	vm, ok := vc.Machines[vmID]
@@ -355,6 +577,9 @@ func (vc *VMController) TakeSnapshot(r *http.Request, vmID string, snap *Snapsho
 		MemFilePath:  snap.MemFilePath,
 		Version:      snap.Version,
 	}
+	if snap.DiffFilePath != "" {
+		params.MemFilePath = snap.DiffFilePath
+	}
 	dataBytes, err := json.Marshal(params)
 	if err != nil {
 		log.Println(err)
@@ -433,7 +658,7 @@ func (vc *VMController) LoadSnapshot(r *http.Request, snapshot *Snapshot, invoc
 		err  error
 	)
 
-	if snapshot.mincoreLayers != nil {
+	if layers, _ := snapshot.layers(); layers != nil {
 		go func() {
 			if invoc.UseWsFile {
 				if true {
@@ -464,6 +689,7 @@ func (vc *VMController) LoadSnapshot(r *http.Request, snapshot *Snapshot, invoc
 
 	if vmId == "" {
 		_, span := trace.StartSpan(r.Context(), "start_vmm")
+		span.AddAttributes(spanAttributes(snapshot.Function, "", snapshot.SnapshotId, restoreMode(invoc))...)
 		var fcExecutable string
 		if invoc.EnableReap {
 			fcExecutable = vc.config.Executables["uffd"]
@@ -476,13 +702,15 @@ func (vc *VMController) LoadSnapshot(r *http.Request, snapshot *Snapshot, invoc
 		}
 		span.End()
 	}
+	vc.Lock()
 	vm.Function = snapshot.Function
+	vc.Unlock()
 
 	_, span := trace.StartSpan(r.Context(), "vm_dial")
 	vm.Dial()
 	span.End()
 
-	log.Println("VM pid:", vm.process.Pid)
+	log.Println("VM pid:", vm.process.Pid())
 	// time.Sleep(20 * time.Second)
 	return vc.loadSnapshot(r.Context(), vm, snapshot, invoc, reapId)
 
@@ -536,7 +764,7 @@ func (vc *VMController) loadSnapshot(ctx context.Context, vm *VM, snapshot *Snap
 			Fadvise              string      `json:"fadvise"`
 		}{
 			SnapshotPath:        snapshot.SnapshotPath,
-			EnableDiffSnapshots: false,
+			EnableDiffSnapshots: invoc.EnableDiffSnapshots,
 			OverlayRegions:      map[int]int{},
 			WsRegions:           [][]int{},
 			LoadWsFile:          invoc.VmmLoadWs,
@@ -548,6 +776,7 @@ func (vc *VMController) loadSnapshot(ctx context.Context, vm *VM, snapshot *Snap
 		if invoc.UseMemFile {
 			params.MemFilePath = snapshot.MemFilePath
 		}
+		snapshot.Lock()
 		if invoc.OverlayRegions {
 			params.OverlayFilePath = snapshot.MemFilePath
 			params.OverlayRegions = snapshot.overlayRegions
@@ -556,6 +785,7 @@ func (vc *VMController) loadSnapshot(ctx context.Context, vm *VM, snapshot *Snap
 			params.WsFilePath = snapshot.WsFile
 			params.WsRegions = snapshot.wsRegions
 		}
+		snapshot.Unlock()
 
 		dataBytes, err = json.Marshal(params)
 		if err != nil {
@@ -568,6 +798,7 @@ func (vc *VMController) loadSnapshot(ctx context.Context, vm *VM, snapshot *Snap
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	_, span = trace.StartSpan(ctx, "request_load_snapshot")
+	span.AddAttributes(spanAttributes(snapshot.Function, vm.VmId, snapshot.SnapshotId, restoreMode(invoc))...)
 	var resp *http.Response
 	resp, err = vm.httpc.Do(req)
 	if err != nil {
@@ -606,7 +837,19 @@ func (vc *VMController) loadSnapshot(ctx context.Context, vm *VM, snapshot *Snap
 		log.Println("resuming", vm.VmId, "response:", resp)
 		return "", errors.New("resuming failed")
 	}
+	vc.Lock()
 	vm.Snapshot = snapshot
+	vm.State = vmStateRunning
+	vc.Unlock()
+	if invoc.EnableDiffSnapshots {
+		vm.Lock()
+		vm.diffEnabled = true
+		vm.diffBase = snapshot
+		vm.Unlock()
+	}
+	if err := vc.injectEnv(ctx, vm, snapshot.Function); err != nil {
+		return "", err
+	}
 	return vm.VmId, nil
 }
 
@@ -623,22 +866,12 @@ func (vc *VMController) startVMM(ctx context.Context, fcExecutable, namespace st
 	// 	log.Println(err)
 	// 	return nil, err
 	// }
-	netIface, ok := vc.Networks[namespace]
+	netIface, ok := vc.network(namespace)
 	if !ok {
 		return nil, fmt.Errorf("network %s not found", namespace)
 	}
 
 	apiSock := vmPath + "/firecracker.sock"
-	outFile, err := os.Create(vmPath + "/stdout")
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	errFile, err := os.Create(vmPath + "/stderr")
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
 	logFile, err := os.Create(vmPath + "/log")
 	if err != nil {
 		log.Println(err)
@@ -646,27 +879,22 @@ func (vc *VMController) startVMM(ctx context.Context, fcExecutable, namespace st
 	}
 	logFile.Close()
 
-	ip := "/bin/ip"
-	cmd := &exec.Cmd{
-		Path: ip,
+	spec := &LaunchSpec{
+		Namespace:  netIface.namespace,
+		Executable: fcExecutable,
+		ApiSock:    apiSock,
+		VmPath:     vmPath,
 		Args: []string{
-			ip,
-			"netns",
-			"exec",
-			netIface.namespace,
-			fcExecutable,
-			"--api-sock", apiSock,
 			"--level", vc.config.LogLevel,
 			"--log-path", vmPath + "/log",
 		},
-		Stdout: outFile,
-		Stderr: errFile,
 	}
 
-	log.Println("starting vmm: ", cmd)
+	log.Println("starting vmm: ", *spec)
 	_, span := trace.StartSpan(ctx, "start firecracker")
-	if err := cmd.Start(); err != nil {
-		log.Println("running", cmd, "failed")
+	process, err := vc.launcher.Launch(ctx, spec)
+	if err != nil {
+		log.Println("running", *spec, "failed")
 		log.Println(err)
 		return nil, err
 	}
@@ -682,7 +910,8 @@ func (vc *VMController) startVMM(ctx context.Context, fcExecutable, namespace st
 		VMNetwork: netIface,
 		VmConf:    nil,
 		VmPath:    vmPath,
-		process:   cmd.Process,
+		StartTime: time.Now(),
+		process:   process,
 	}
 
 	vc.Lock()
@@ -690,7 +919,7 @@ func (vc *VMController) startVMM(ctx context.Context, fcExecutable, namespace st
 	vc.Unlock()
 
 	go func(vm *VM) {
-		if err := cmd.Wait(); err != nil {
+		if err := vm.process.Wait(); err != nil {
 			log.Println(err)
 		}
 		log.Println("vmID:", vm.VmId, "Stopped")
@@ -712,8 +941,8 @@ func (vc *VMController) InvokeFunction(r *http.Request, vmID string, function st
 		return "", errors.New("vmID not exists")
 	}
 
-	client := &http.Client{}
-	url := fmt.Sprintf("%s://%s/invoke?function=%s&redishost=%s&redispasswd=%s", "http", vm.VMNetwork.uniqueAddr+":5000", function, vc.config.RedisHost, vc.config.RedisPasswd)
+	client, base := vc.transport.Client(vm)
+	url := fmt.Sprintf("%s/invoke?function=%s", base, function)
 	log.Println("requesting ", url, " with params: ", params)
 	newReq, err := http.NewRequest("POST", url, bytes.NewReader([]byte(params)))
 	newReq.Header.Set("Content-Type", "application/json; charset=utf-8")
@@ -743,8 +972,8 @@ func (vc *VMController) InvokeFunction(r *http.Request, vmID string, function st
 }
 
 func (vm *VM) getDmesg(context context.Context) ([]byte, error) {
-	client := &http.Client{}
-	url := fmt.Sprintf("%s://%s/%s", "http", vm.VMNetwork.uniqueAddr+":5000", "dmesg")
+	client, base := vmController.transport.Client(vm)
+	url := fmt.Sprintf("%s/%s", base, "dmesg")
 	newReq, err := http.NewRequest("GET", url, bytes.NewReader([]byte{}))
 	if err != nil {
 		log.Println(err)
@@ -770,3 +999,73 @@ func (vm *VM) getDmesg(context context.Context) ([]byte, error) {
 	log.Println("dmesg invoked for ", vm.VmId)
 	return dmesgResp, nil
 }
+
+// DropGuestCaches writes mode to /proc/sys/vm/drop_caches in the guest of vmID.
+func (vc *VMController) DropGuestCaches(ctx context.Context, vmID string, mode int) error {
+	vm, ok := vc.lookup(vmID)
+	if !ok {
+		log.Println("vmID ", vmID, " not exists")
+		return errors.New("vmID not exists")
+	}
+	client, base := vc.transport.Client(vm)
+	url := fmt.Sprintf("%s/drop_caches?mode=%d", base, mode)
+	newReq, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	_, span := trace.StartSpan(ctx, "invoke_drop_caches")
+	resp, err := client.Do(newReq)
+	span.End()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("dropping caches response:", resp)
+		return fmt.Errorf("dropping caches failed for vm %v: %v", vmID, resp.StatusCode)
+	}
+	return nil
+}
+
+// snapshotVersion returns the snapshot version to take snapshots of vmID
+// with: the configured one, or else the version of its VMM.
+func (vc *VMController) snapshotVersion(ctx context.Context, vmID string) (string, error) {
+	if vc.config.SnapshotVersion != "" {
+		return vc.config.SnapshotVersion, nil
+	}
+	vm, ok := vc.lookup(vmID)
+	if !ok {
+		log.Println("vmID ", vmID, " not exists")
+		return "", errors.New("vmID not exists")
+	}
+	if err := vm.Dial(); err != nil {
+		log.Println(err)
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost/version", nil)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	req.Header.Add("Accept", "application/json")
+	resp, err := vm.httpc.Do(req)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("getting VMM version response:", resp)
+		return "", errors.New("getting VMM version failed, set snapshot_version in the config")
+	}
+	var body struct {
+		FirecrackerVersion string `json:"firecracker_version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.FirecrackerVersion == "" {
+		log.Println("decoding VMM version failed:", err)
+		return "", errors.New("unknown VMM version, set snapshot_version in the config")
+	}
+	return body.FirecrackerVersion, nil
+}
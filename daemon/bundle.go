@@ -0,0 +1,356 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ucsdsysnet/faasnap/models"
+)
+
+// A snapshot bundle is a tar archive that starts with the manifest, followed
+// by the files of the snapshot:
+//
+//	manifest.json     the manifest
+//	snapshot          the VMM state file
+//	mem               the data extents of the mem file back to back
+//	ws                the ws file, if any
+//	reap/working_set  the REAP working set and trace, if recorded
+//	reap/trace
+//
+// Diff snapshots are exported merged, as full snapshots.
+const (
+	bundleVersion  = 1
+	bundleManifest = "manifest.json"
+	bundleSnapshot = "snapshot"
+	bundleMem      = "mem"
+	bundleWs       = "ws"
+	bundleReapWs   = "reap/working_set"
+	bundleTrace    = "reap/trace"
+)
+
+// manifest describes the snapshot in a bundle, with the state that is kept
+// in memory and the extents the mem file is rebuilt from.
+type manifest struct {
+	Version    int          `json:"version"`
+	PageSize   int          `json:"pageSize"`
+	Snapshot   snapshotMeta `json:"snapshot"`
+	MemExtents [][]int64    `json:"memExtents"` // [[offset, length]...]
+}
+
+// bundleFile is a file of the snapshot written to a bundle.
+type bundleFile struct {
+	name string
+	path string
+}
+
+// ExportSnapshot prepares a bundle of a snapshot. The returned function
+// writes it.
+func (sm *SnapshotManager) ExportSnapshot(ssID string) (func(io.Writer) error, error) {
+	snapshot, ok := sm.Lookup(ssID)
+	if !ok {
+		log.Println("snapshot", ssID, "not exists")
+		return nil, errors.New("snapshot not exists")
+	}
+	if err := sm.MergeLayers(snapshot); err != nil {
+		return nil, err
+	}
+	if err := sm.verifyBeforeUse(snapshot); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(snapshot.MemFilePath)
+	if err != nil {
+		log.Println("open", snapshot.MemFilePath, "failed", err)
+		return nil, err
+	}
+	extents := [][]int64{}
+	memSize := int64(0)
+	err = FileExtents(f, func(offset, length int64) error {
+		extents = append(extents, []int64{offset, length})
+		memSize += length
+		return nil
+	})
+	f.Close()
+	if err != nil {
+		log.Println("reading extents of", snapshot.MemFilePath, "failed:", err)
+		return nil, err
+	}
+
+	snapshot.Lock()
+	data, err := json.Marshal(&manifest{
+		Version:    bundleVersion,
+		PageSize:   os.Getpagesize(),
+		Snapshot:   *snapshot.meta(),
+		MemExtents: extents,
+	})
+	files := []bundleFile{{bundleSnapshot, snapshot.SnapshotPath}}
+	if snapshot.WsFile != "" {
+		files = append(files, bundleFile{bundleWs, snapshot.WsFile})
+	}
+	snapshot.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	reapWs, trace := snapshot.SnapshotBase+"/working_set", snapshot.SnapshotBase+"/trace"
+	if _, err := os.Stat(trace); err == nil {
+		files = append(files, bundleFile{bundleReapWs, reapWs}, bundleFile{bundleTrace, trace})
+	}
+
+	return func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		now := time.Now()
+		if err := tw.WriteHeader(&tar.Header{Name: bundleManifest, Mode: 0644, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := writeBundleFile(tw, file.name, file.path); err != nil {
+				return err
+			}
+		}
+
+		mem, err := os.Open(snapshot.MemFilePath)
+		if err != nil {
+			return err
+		}
+		defer mem.Close()
+		if err := tw.WriteHeader(&tar.Header{Name: bundleMem, Mode: 0644, Size: memSize, ModTime: now}); err != nil {
+			return err
+		}
+		for _, extent := range extents {
+			if _, err := io.Copy(tw, io.NewSectionReader(mem, extent[0], extent[1])); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		log.Println("exported snapshot", ssID, "with", memSize, "bytes of memory")
+		return nil
+	}, nil
+}
+
+func writeBundleFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// ImportSnapshot registers the snapshot in a bundle, with its files under
+// BasePath. The snapshot gets a new id, the id in the bundle is not trusted.
+func (sm *SnapshotManager) ImportSnapshot(r io.Reader) (*models.Snapshot, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle: %v", err)
+	}
+	if hdr.Name != bundleManifest {
+		return nil, fmt.Errorf("bundle starts with %v instead of the manifest", hdr.Name)
+	}
+	m := manifest{Snapshot: snapshotMeta{Snapshot: &Snapshot{}}}
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("reading manifest: %v", err)
+	}
+	if m.Version != bundleVersion || m.PageSize != os.Getpagesize() {
+		return nil, fmt.Errorf("unsupported bundle version %v with page size %v", m.Version, m.PageSize)
+	}
+
+	snapshot := m.Snapshot.snapshot()
+	ssID := "ss_" + RandStringRunes(8)
+	base := sm.config.BasePath + "/" + ssID
+	snapshot.SnapshotId = ssID
+	snapshot.SnapshotBase = base
+	snapshot.SnapshotPath = base + "/snapshot"
+	snapshot.MemFilePath = base + "/memfile"
+	snapshot.Parent = ""
+	snapshot.DiffFilePath = ""
+	snapshot.SnapshotType = SnapshotFull
+	snapshot.Deduped = false
+	snapshot.Compressed = false
+	if snapshot.WsFile != "" {
+		snapshot.WsFile = base + "/wsfile"
+	}
+	delete(snapshot.Checksums, fileDiff)
+	delete(snapshot.Checksums, fileCompressed)
+
+	if err := os.MkdirAll(base, 0755); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err := importBundleFiles(tr, snapshot, m.MemExtents); err != nil {
+		log.Println("importing", ssID, "failed:", err)
+		os.RemoveAll(base)
+		return nil, err
+	}
+	if err := snapshot.adoptChecksums(); err != nil {
+		log.Println("importing", ssID, "failed:", err)
+		os.RemoveAll(base)
+		return nil, err
+	}
+	fnManager.Lock()
+	if _, ok := fnManager.Functions[snapshot.Function]; !ok {
+		log.Println("imported snapshot", ssID, "of unknown function", snapshot.Function)
+	}
+	fnManager.Unlock()
+
+	sm.Lock()
+	if _, ok := sm.Snapshots[ssID]; ok {
+		sm.Unlock()
+		os.RemoveAll(base)
+		return nil, fmt.Errorf("snapshot %v imported concurrently", ssID)
+	}
+	sm.Snapshots[ssID] = snapshot
+	sm.Unlock()
+	if err := snapshot.save(); err != nil {
+		return nil, err
+	}
+	log.Println("imported snapshot", ssID)
+	return snapshot.Model(), nil
+}
+
+// importBundleFiles writes the files following the manifest to the paths of
+// snapshot.
+func importBundleFiles(tr *tar.Reader, snapshot *Snapshot, extents [][]int64) error {
+	seen := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading bundle: %v", err)
+		}
+		var path string
+		switch hdr.Name {
+		case bundleSnapshot:
+			path = snapshot.SnapshotPath
+		case bundleWs:
+			path = snapshot.WsFile
+		case bundleReapWs:
+			path = snapshot.SnapshotBase + "/working_set"
+		case bundleTrace:
+			path = snapshot.SnapshotBase + "/trace"
+		case bundleMem:
+			if err := writeExtents(tr, snapshot.MemFilePath, int64(snapshot.Size), extents); err != nil {
+				return err
+			}
+			seen[hdr.Name] = true
+			continue
+		}
+		if path == "" {
+			return fmt.Errorf("unexpected bundle entry %v", hdr.Name)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		seen[hdr.Name] = true
+	}
+	for _, name := range []string{bundleSnapshot, bundleMem} {
+		if !seen[name] {
+			return fmt.Errorf("bundle has no %v entry", name)
+		}
+	}
+	if snapshot.WsFile != "" && !seen[bundleWs] {
+		return fmt.Errorf("bundle has no %v entry", bundleWs)
+	}
+	return nil
+}
+
+// writeExtents rebuilds a sparse file of size bytes from its data extents.
+func writeExtents(r io.Reader, path string, size int64, extents [][]int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	for _, extent := range extents {
+		if len(extent) != 2 || extent[0] < 0 || extent[0]+extent[1] > size {
+			return fmt.Errorf("mem extent %v out of range", extent)
+		}
+		if _, err := f.Seek(extent[0], io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(f, r, extent[1]); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// adoptChecksums checks imported files against the checksums they were
+// exported with and indexes the pages of the mem file. Checksums are recorded
+// for bundles of snapshots that have none.
+func (snapshot *Snapshot) adoptChecksums() error {
+	snapshot.Lock()
+	checksums := snapshot.Checksums
+	snapshot.Unlock()
+	if len(checksums) == 0 {
+		return snapshot.recordChecksums(fileSnapshot, fileMem, fileWs)
+	}
+	for file, sum := range checksums {
+		path := snapshot.filePath(file)
+		got, index, err := hashFile(path, file == fileMem)
+		if err != nil {
+			return err
+		}
+		if got != sum {
+			return fmt.Errorf("%v file of the bundle does not match its checksum", file)
+		}
+		if file == fileMem {
+			if err := writePageIndex(snapshot.pageIndexPath(), index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// retagBundle copies a bundle with the snapshot id of its manifest replaced.
+func retagBundle(t *testing.T, bundle []byte, ssID string) []byte {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(bundle))
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == bundleManifest {
+			m := manifest{Snapshot: snapshotMeta{Snapshot: &Snapshot{}}}
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			m.Snapshot.SnapshotId = ssID
+			if data, err = json.Marshal(&m); err != nil {
+				t.Fatal(err)
+			}
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestImportSnapshotFreshID(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+	write, err := ssManager.ExportSnapshot(ssID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle bytes.Buffer
+	if err := write(&bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	escaped := "../escaped"
+	for _, id := range []string{ssID, escaped} {
+		imported, err := ssManager.ImportSnapshot(bytes.NewReader(retagBundle(t, bundle.Bytes(), id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported.SsID == id {
+			t.Fatalf("import kept the bundle's id %v", id)
+		}
+		ssManager.Lock()
+		snapshot := ssManager.Snapshots[imported.SsID]
+		ssManager.Unlock()
+		if filepath.Dir(snapshot.SnapshotBase) != config.BasePath {
+			t.Fatalf("snapshot imported to %v, outside %v", snapshot.SnapshotBase, config.BasePath)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.BasePath, escaped)); !os.IsNotExist(err) {
+		t.Fatalf("import wrote to %v: %v", escaped, err)
+	}
+}
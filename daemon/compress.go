@@ -0,0 +1,157 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"compress/flate"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/ucsdsysnet/faasnap/reap"
+)
+
+// CompressionConfig sets how snapshot mem files are compressed.
+type CompressionConfig struct {
+	BlockSize int `json:"block_size"` // bytes, a multiple of the page size; 64 KiB if unset
+	Level     int `json:"level"`      // deflate level from 1 to 9; 6 if unset
+}
+
+const defaultCompressionBlock = 64 << 10
+
+// compressedPath returns the path of the compressed mem file of the snapshot.
+func (snapshot *Snapshot) compressedPath() string {
+	return snapshot.MemFilePath + ".z"
+}
+
+// compressed reports whether the mem file of the snapshot is compressed.
+func (snapshot *Snapshot) compressed() bool {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	return snapshot.Compressed
+}
+
+// hotBlocks returns the blocks of the mem file holding working set pages,
+// either in the ws file or recorded by REAP.
+func (snapshot *Snapshot) hotBlocks(blockSize int) map[int64]bool {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	pagesize := int64(os.Getpagesize())
+	hot := map[int64]bool{}
+	for _, region := range snapshot.wsRegions {
+		for page := int64(region[0]); page < int64(region[0]+region[1]); page++ {
+			hot[page*pagesize/int64(blockSize)] = true
+		}
+	}
+	for _, offset := range snapshot.records {
+		hot[int64(offset)/int64(blockSize)] = true
+	}
+	return hot
+}
+
+// CompressSnapshot replaces the mem file of a snapshot with a compressed one.
+// Blocks with working set pages are kept uncompressed. The mem file is
+// rebuilt when it is needed, and removed again by compressing the snapshot
+// once more.
+func (sm *SnapshotManager) CompressSnapshot(ssID string) error {
+	snapshot, ok := sm.Lookup(ssID)
+	if !ok {
+		log.Println("snapshot", ssID, "not exists")
+		return errors.New("snapshot not exists")
+	}
+	if snapshot.deduped() {
+		log.Println("snapshot", ssID, "is deduplicated")
+		return errors.New("snapshot is deduplicated")
+	}
+	if err := sm.MergeLayers(snapshot); err != nil {
+		return err
+	}
+	snapshot.merging.Lock()
+	defer snapshot.merging.Unlock()
+
+	if !snapshot.compressed() {
+		if err := sm.verifyBeforeUse(snapshot); err != nil {
+			return err
+		}
+		blockSize, level := sm.config.Compression.BlockSize, sm.config.Compression.Level
+		if blockSize == 0 {
+			blockSize = defaultCompressionBlock
+		}
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		hot := snapshot.hotBlocks(blockSize)
+		size, err := reap.CompressMemory(snapshot.MemFilePath, snapshot.compressedPath(), blockSize, level, func(block int64) bool {
+			return hot[block]
+		})
+		if err != nil {
+			log.Println("compressing", snapshot.MemFilePath, "failed:", err)
+			return err
+		}
+		snapshot.Lock()
+		snapshot.Compressed = true
+		snapshot.Unlock()
+		if err := snapshot.recordChecksums(fileCompressed); err != nil {
+			return err
+		}
+		if err := snapshot.save(); err != nil {
+			return err
+		}
+		log.Printf("compressed snapshot %v to %d of %d bytes, %d blocks kept raw\n", ssID, size, snapshot.Size, len(hot))
+	}
+
+	sm.Lock()
+	shared := false
+	for _, other := range sm.Snapshots {
+		if other != snapshot && other.MemFilePath == snapshot.MemFilePath {
+			shared = true
+		}
+	}
+	sm.Unlock()
+	if shared {
+		log.Println("keeping", snapshot.MemFilePath, "shared with other snapshots")
+		return nil
+	}
+	if err := os.Remove(snapshot.MemFilePath); err != nil && !os.IsNotExist(err) {
+		log.Println("removing", snapshot.MemFilePath, "failed:", err)
+		return err
+	}
+	return nil
+}
+
+// decompress rebuilds the mem file of a compressed snapshot. Callers must
+// hold the merging lock of snapshot.
+func (sm *SnapshotManager) decompress(snapshot *Snapshot) error {
+	tmp := snapshot.MemFilePath + ".tmp"
+	if err := reap.DecompressMemory(snapshot.compressedPath(), tmp); err != nil {
+		log.Println("decompressing", snapshot.compressedPath(), "failed:", err)
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, snapshot.MemFilePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Println("decompressed the mem file of snapshot", snapshot.SnapshotId)
+	return nil
+}
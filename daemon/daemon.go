@@ -28,6 +28,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -47,13 +48,25 @@ import (
 )
 
 type Config struct {
-	LogLevel    string            `json:"log_level"`
-	BasePath    string            `json:"base_path"`
-	Images      map[string]string `json:"images"`
-	Kernels     map[string]string `json:"kernels"`
-	Executables map[string]string `json:"executables"`
-	RedisHost   string            `json:"redis_host"`
-	RedisPasswd string            `json:"redis_passwd"`
+	LogLevel    string                `json:"log_level"`
+	BasePath    string                `json:"base_path"`
+	Images      map[string]string     `json:"images"`
+	Kernels     map[string]string     `json:"kernels"`
+	Executables map[string]string     `json:"executables"`
+	RedisHost   string                `json:"redis_host"`
+	RedisPasswd Secret                `json:"redis_passwd"`
+	Secrets     Secrets               `json:"secrets"` // injected into all guests
+	WarmPool    WarmPoolConfig        `json:"warm_pool"`
+	Launcher    string                `json:"launcher"`  // "firecracker" (default) or "fake"
+	Transport   string                `json:"transport"` // "http" (default) or "vsock"
+	Reap        reap.MemoryManagerCfg `json:"reap"`
+	Tracing     TracingConfig         `json:"tracing"`
+	Verify      VerifyConfig          `json:"verify"`
+	PageStore   string                `json:"page_store"` // directory of the page store, BasePath/pagestore if unset
+	Compression CompressionConfig     `json:"compression"`
+	// firecracker snapshot version of the snapshots taken by policies; the
+	// version of the VMM if unset
+	SnapshotVersion string `json:"snapshot_version"`
 }
 
 type DaemonState struct {
@@ -123,13 +136,28 @@ func Setup(s *http.Server, scheme, addr string) *DaemonState {
 	vmController = NewVMController(&config)
 	ssManager = NewSnapshotManager(&config)
 
+	cleanupOrphans(config.BasePath)
+	if err := fnManager.LoadFunctions(); err != nil {
+		log.Println("loading functions failed:", err)
+	}
+	if err := vmController.LoadNetworks(); err != nil {
+		log.Println("loading networks failed:", err)
+	}
+	if err := ssManager.LoadSnapshots(); err != nil {
+		log.Println("loading snapshots failed:", err)
+	}
+	vmController.StartIdleReaper()
+
 	state := &DaemonState{
 		FnManager:       fnManager,
 		VmController:    vmController,
 		SnapshotManager: ssManager,
 	}
 
-	// pe := registerPrometheus()
+	setupMetrics()
+	if err := setupTracing(config.Tracing, addr); err != nil {
+		log.Fatalf("bad tracing config: %v", err)
+	}
 	// registerZipkin(zipkinHost, port)
 	// mux := http.NewServeMux()
 
@@ -153,7 +181,8 @@ func Setup(s *http.Server, scheme, addr string) *DaemonState {
 	// address := fmt.Sprintf(":%v", port)
 	// log.Printf("Server listening at %v! ...", address)
 	// log.Fatal(http.ListenAndServe(address, h))
-	reap.Setup()
+	reap.Setup(config.Reap)
+	reap.OnFailure(vmController.killReapVM)
 
 	return state
 }
@@ -179,22 +208,75 @@ func Setup(s *http.Server, scheme, addr string) *DaemonState {
 // }
 
 func CreateFunction(params operations.PostFunctionsParams) error {
-	return fnManager.CreateFunction(*params.Function.FuncName, params.Function.Kernel, params.Function.Image, int(params.Function.Vcpu), int(params.Function.MemSize))
+	policy, err := policyFromModel(params.Function.Policy)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := fnManager.CreateFunction(*params.Function.FuncName, params.Function.Kernel, params.Function.Image, int(params.Function.Vcpu), int(params.Function.MemSize), params.Function.Secrets); err != nil {
+		return err
+	}
+	if policy != nil {
+		return fnManager.SetPolicy(*params.Function.FuncName, policy)
+	}
+	return nil
 }
 
-func StartVM(req *http.Request, name, ssId, namespace string) (string, error) {
+func SetFunctionPolicy(name string, p *models.SnapshotPolicy) error {
+	policy, err := policyFromModel(p)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return fnManager.SetPolicy(name, policy)
+}
+
+func GetFunctions() []*models.Function {
+	return fnManager.ListFunctions()
+}
+
+func GetVMs(function, namespace string) []*models.VM {
+	return vmController.ListVMs(function, namespace)
+}
+
+func GetVM(vmID string) (*models.VM, error) {
+	return vmController.GetVM(vmID)
+}
+
+func StartVM(req *http.Request, name, ssId, namespace string, useMemFile, overlayRegions, useWsFile, enableReap, enableDiffSnapshots bool) (string, error) {
+	var (
+		vmID string
+		err  error
+	)
+	if err := beginCall(); err != nil {
+		return "", err
+	}
+	defer endCall()
 	if ssId == "" {
-		return DoStartVM(req.Context(), name, namespace)
+		vmID, err = DoStartVM(req.Context(), name, namespace, enableDiffSnapshots)
 	} else {
-		return "", nil // TODO
+		vmID, err = RestoreVM(req, &models.Invocation{
+			FuncName:            &name,
+			SsID:                ssId,
+			Namespace:           namespace,
+			UseMemFile:          useMemFile,
+			OverlayRegions:      overlayRegions,
+			UseWsFile:           useWsFile,
+			EnableReap:          enableReap,
+			EnableDiffSnapshots: enableDiffSnapshots,
+		})
+	}
+	if err != nil {
+		return "", err
 	}
+	return vmID, nil // owned by the client, never put in the warm pool
 }
 
-func DoStartVM(ctx context.Context, function, namespace string) (string, error) {
+func DoStartVM(ctx context.Context, function, namespace string, trackDirtyPages bool) (string, error) {
 	_, span := trace.StartSpan(ctx, fmt.Sprintf("doStartVM_%v", function))
 	defer span.End()
-	if fn, ok := fnManager.Functions[function]; ok {
-		if id, err := vmController.StartVM(&ctx, fn.Name, fn.Kernel, fn.Image, namespace, fn.Vcpu, fn.MemSize); err != nil {
+	if fn, ok := fnManager.lookup(function); ok {
+		if id, err := vmController.StartVM(&ctx, fn.Name, fn.Kernel, fn.Image, namespace, fn.Vcpu, fn.MemSize, trackDirtyPages); err != nil {
 			return "", err
 		} else {
 			return id, nil
@@ -212,13 +294,14 @@ func StopVM(req *http.Request, vmID string) error {
 func StartVMM(ctx context.Context, enableReap bool, namespace string) (string, error) {
 	_, span := trace.StartSpan(ctx, "start_vmm")
 	defer span.End()
-	return vmController.StartVMM(ctx, enableReap, namespace)
+	span.AddAttributes(trace.BoolAttribute("reap", enableReap))
+	vmID, err := vmController.StartVMM(ctx, enableReap, namespace)
+	span.AddAttributes(spanAttributes("", vmID, "", "")...)
+	return vmID, err
 }
 
 func TakeSnapshot(req *http.Request, vmID string, snapshotType string, snapshotPath string, memFilePath string, version string, recordRegions bool, sizeThreshold, intervalThreshold int) (string, error) {
-	vmController.Lock()
-	vm, ok := vmController.Machines[vmID]
-	vmController.Unlock()
+	vm, ok := vmController.lookup(vmID)
 	if !ok {
 		log.Println("vmID not exists: ", vmID)
 		return "", errors.New("vmID not exists")
@@ -226,11 +309,26 @@ func TakeSnapshot(req *http.Request, vmID string, snapshotType string, snapshotP
 	if snapshotType == "" || snapshotPath == "" || memFilePath == "" || version == "" {
 		return "", errors.New("snapshot configs incomplete")
 	}
+	var parent *Snapshot
+	if snapshotType == SnapshotDiff {
+		var enabled bool
+		if parent, enabled = vm.diffParent(); !enabled {
+			log.Println("diff snapshots are not enabled for", vmID)
+			return "", errors.New("diff snapshots are not enabled for the VM")
+		}
+		if parent == nil {
+			log.Println("no full snapshot of", vmID, "to diff against")
+			return "", errors.New("take a full snapshot of the VM before a diff snapshot")
+		}
+	}
 
+	vmController.Lock()
+	function := vm.Function
+	vmController.Unlock()
 	ssId := "ss_" + RandStringRunes(8)
 	snap := &Snapshot{
 		SnapshotId:     ssId,
-		Function:       vm.Function,
+		Function:       function,
 		SnapshotBase:   ssManager.config.BasePath + "/" + ssId,
 		SnapshotType:   snapshotType,
 		MemFilePath:    memFilePath,
@@ -240,30 +338,49 @@ func TakeSnapshot(req *http.Request, vmID string, snapshotType string, snapshotP
 		wsRegions:      [][]int{},
 		loadOnce:       new(sync.Once),
 	}
+	if parent != nil {
+		// the VMM writes the dirty pages, the memory is merged on restore
+		snap.Parent = parent.SnapshotId
+		snap.DiffFilePath = memFilePath + ".diff"
+	}
 
 	var err error
 	if err = vmController.TakeSnapshot(req, vmID, snap); err != nil {
 		log.Println("snapshot failed: ", err)
 		return "", err
 	}
+	vm.setDiffParent(snap)
 
 	if err := ssManager.RegisterSnapshot(snap); err != nil {
 		return "", err
 	}
 	log.Println("snap.SnapshotId:", snap.SnapshotId)
 
+	if parent != nil {
+		dirty, err := dirtyPages(snap.DiffFilePath, snap.Size)
+		if err != nil {
+			log.Println("reading dirty pages failed: ", err)
+			return "", err
+		}
+		snap.inherit(parent, dirty)
+	}
+
 	if recordRegions {
+		if err = ssManager.MergeLayers(snap); err != nil {
+			return "", err
+		}
 		if err = snap.RecordRegions(req.Context(), sizeThreshold, intervalThreshold); err != nil {
 			log.Println("RecordRegions failed: ", err)
 			return "", err
 		}
 	}
+	snap.save()
 
 	return snap.SnapshotId, nil
 }
 
 func LoadSnapshot(req *http.Request, invoc *models.Invocation, reapId string) (string, error) {
-	snapshot, ok := ssManager.Snapshots[invoc.SsID]
+	snapshot, ok := ssManager.Lookup(invoc.SsID)
 	if !ok {
 		log.Println("snapshot not exists")
 		return "", errors.New("snapshot not exists")
@@ -277,86 +394,331 @@ func LoadSnapshot(req *http.Request, invoc *models.Invocation, reapId string) (s
 	return vmID, nil
 }
 
-func ChangeSnapshot(req *http.Request, ssID string, digHole, loadCache, dropCache bool) error {
-	log.Println("ChangeSnapshot", ssID, digHole, loadCache, dropCache)
-	snapshot, ok := ssManager.Snapshots[ssID]
+func ChangeSnapshot(req *http.Request, ssID string, digHole, loadCache, dropCache, dedup, compress bool) error {
+	log.Println("ChangeSnapshot", ssID, digHole, loadCache, dropCache, dedup, compress)
+	snapshot, ok := ssManager.Lookup(ssID)
 	if !ok {
 		log.Println("snapshot not exists")
 		return errors.New("snapshot not exists")
 	}
-	return snapshot.UpdateCacheState(digHole, loadCache, dropCache)
+	if digHole || loadCache || dropCache || !(dedup || compress) {
+		if err := ssManager.MergeLayers(snapshot); err != nil {
+			return err
+		}
+		if err := snapshot.UpdateCacheState(digHole, loadCache, dropCache); err != nil {
+			return err
+		}
+	}
+	if dedup && compress {
+		return errors.New("snapshots are either deduplicated or compressed")
+	}
+	if dedup || compress {
+		// the mem file goes away, so no restore may read it and REAP must
+		// not have it mapped
+		if err := ssManager.markShrinking(ssID); err != nil {
+			return err
+		}
+		defer ssManager.unmarkShrinking(ssID)
+		if err := releaseSnapshot(ssID); err != nil {
+			return err
+		}
+	}
+	if dedup {
+		return ssManager.DedupSnapshot(ssID)
+	}
+	if compress {
+		return ssManager.CompressSnapshot(ssID)
+	}
+	return nil
 }
 
 func CopySnapshot(ctx context.Context, fromSnapshot, memFilePath string) (*models.Snapshot, error) {
 	return ssManager.CopySnapshot(ctx, fromSnapshot, memFilePath)
 }
 
+func GetSnapshots() []*models.Snapshot {
+	return ssManager.ListSnapshots()
+}
+
+func GetSnapshot(ssID string) (*models.Snapshot, error) {
+	return ssManager.GetSnapshot(ssID)
+}
+
+// ExportSnapshot prepares a bundle of a snapshot, written by the returned
+// function.
+func ExportSnapshot(ssID string) (func(io.Writer) error, error) {
+	return ssManager.ExportSnapshot(ssID)
+}
+
+// ImportSnapshot registers the snapshot in a bundle.
+func ImportSnapshot(bundle io.Reader) (*models.Snapshot, error) {
+	return ssManager.ImportSnapshot(bundle)
+}
+
+// VerifySnapshot checks the files of a snapshot against their checksums.
+func VerifySnapshot(ssID string, sample float64, record bool) (*operations.PostSnapshotsSsIDVerifyOKBody, error) {
+	files, pages, err := ssManager.VerifySnapshot(ssID, sample, record)
+	if err != nil {
+		return nil, err
+	}
+	return &operations.PostSnapshotsSsIDVerifyOKBody{Files: int64(files), Pages: int64(pages)}, nil
+}
+
+// RerecordSnapshot discards the REAP record of a snapshot so that its next
+// REAP invocation records the working set again.
+func RerecordSnapshot(ssID string) error {
+	snapshot, ok := ssManager.Lookup(ssID)
+	if !ok {
+		log.Println("snapshot", ssID, "not found")
+		return fmt.Errorf("snapshot %v not found", ssID)
+	}
+	if err := reap.Rerecord(ssID, snapshot.SnapshotBase); err != nil {
+		log.Println("Rerecord REAP failed", err)
+		return err
+	}
+	return nil
+}
+
+// GetReapStats returns the REAP stats of a snapshot.
+func GetReapStats(ssID string) (*models.ReapStats, error) {
+	st, err := reap.GetStats(ssID)
+	if err != nil {
+		log.Println("reap.GetStats error", err)
+		return nil, err
+	}
+	return &models.ReapStats{
+		Metrics:       st.Metrics,
+		RecordPages:   int64(st.RecordPages),
+		RecordRegions: int64(st.RecordRegions),
+		Replays:       int64(st.Replays),
+		FetchStateUs:  st.FetchStateUs,
+		InstallWsUs:   st.InstallWSUs,
+		ServeUniqueUs: st.ServeUniqueUs,
+		UniqueFaults:  st.UniqueFaults,
+	}, nil
+}
+
+// ResetReapStats drops the REAP stats of a snapshot.
+func ResetReapStats(ssID string) error {
+	if err := reap.ResetStats(ssID); err != nil {
+		log.Println("reap.ResetStats error", err)
+		return err
+	}
+	return nil
+}
+
+// SetReapMetrics turns measuring REAP replays of a snapshot on or off.
+func SetReapMetrics(ssID string, on bool) error {
+	if _, ok := ssManager.Lookup(ssID); !ok {
+		log.Println("snapshot", ssID, "not found")
+		return fmt.Errorf("snapshot %v not found", ssID)
+	}
+	reap.SetMetrics(ssID, on)
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot that no VM runs from. Restores of the
+// snapshot are refused from the moment the deletion starts.
+func DeleteSnapshot(ssID string) error {
+	if err := ssManager.markDeleting(ssID); err != nil {
+		return err
+	}
+	if err := releaseSnapshot(ssID); err != nil {
+		ssManager.unmarkDeleting(ssID)
+		return err
+	}
+	if err := ssManager.DeleteSnapshot(ssID); err != nil {
+		ssManager.unmarkDeleting(ssID)
+		return err
+	}
+	return nil
+}
+
+// releaseSnapshot checks that no VM runs from a snapshot and drops its REAP
+// instances, so that its files can be removed.
+func releaseSnapshot(ssID string) error {
+	vmController.Lock()
+	for _, vm := range vmController.Machines {
+		if vm.Snapshot != nil && vm.Snapshot.SnapshotId == ssID {
+			vmController.Unlock()
+			log.Println("snapshot", ssID, "in use by VM", vm.VmId)
+			return fmt.Errorf("snapshot in use by VM %v", vm.VmId)
+		}
+	}
+	vmController.Unlock()
+	if err := reap.Deregister(ssID); err != nil {
+		log.Println("Deregister REAP failed", err)
+		return err
+	}
+	return nil
+}
+
 func PutNetwork(req *http.Request, namespace, hostDevName, ifaceId, guestMac, guestAddr, uniqueAddr string) error {
 	return vmController.AddNetwork(req, namespace, hostDevName, ifaceId, guestMac, guestAddr, uniqueAddr)
 }
 
-func InvokeFunction(req *http.Request, invoc *models.Invocation) (string, string, string, error) {
+// lazyMemory reports whether a restore of a deduplicated or compressed
+// snapshot can leave its mem file unbuilt: REAP serves guest memory from the
+// page store or the compressed mem file and nothing else reads the mem file.
+func lazyMemory(snapshot *Snapshot, invoc *models.Invocation) bool {
+	if !(snapshot.deduped() || snapshot.compressed()) || !invoc.EnableReap || invoc.UseMemFile || invoc.OverlayRegions {
+		return false
+	}
+	if (invoc.Mincore != nil && *invoc.Mincore >= 0) || invoc.MincoreSize > 0 {
+		return false // the mem file is scanned
+	}
+	layers, _ := snapshot.layers()
+	return layers == nil || invoc.UseWsFile // or else it is prewarmed
+}
+
+// RestoreVM loads invoc.SsID into a new VM and resumes it, optionally serving
+// its memory through REAP. The VM is left running without invoking the function.
+func RestoreVM(req *http.Request, invoc *models.Invocation) (string, error) {
+	var vm, reapId string
+	var err error
+	snapshot, ok := ssManager.acquire(invoc.SsID)
+	if !ok {
+		log.Println("Snapshot not exists")
+		return "", errors.New("Snapshot not exists")
+	}
+	defer ssManager.release(snapshot)
+	guestMem := reap.GuestMemory{Path: snapshot.MemFilePath}
+	switch {
+	case !lazyMemory(snapshot, invoc):
+		err = ssManager.MergeLayers(snapshot)
+	case snapshot.deduped():
+		guestMem.Path = ssManager.pages.dataPath()
+		guestMem.Pages, err = readPageMap(snapshot.pageMapPath())
+	default:
+		guestMem = reap.GuestMemory{Path: snapshot.compressedPath(), Compressed: true}
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := ssManager.verifyBeforeUse(snapshot); err != nil {
+		return "", err
+	}
+
+	if !invoc.EnableReap {
+		return LoadSnapshot(req, invoc, "")
+	}
+
+	resultChan := make(chan error, 1)
+	reapId, err = reap.Register(req.Context(), invoc.SsID, snapshot.SnapshotBase, snapshot.SnapshotPath, guestMem, snapshot.Size, invoc.WsFileDirectIo, invoc.WsSingleRead)
+	if err != nil {
+		log.Println("Register REAP failed", err.Error())
+		return "", err
+	}
+	go func() {
+		err := reap.Activate(req, reapId)
+		if err != nil {
+			log.Println("Activate REAP failed", err.Error())
+		}
+		resultChan <- err
+	}()
+	if vm, err = LoadSnapshot(req, invoc, reapId); err != nil {
+		return "", err
+	}
+	if err := <-resultChan; err != nil {
+		return "", err
+	}
+	vmController.setReapId(vm, reapId)
+	return vm, nil
+}
+
+// InvokeFunction serves an invocation. Invocations that name neither a VM nor
+// a snapshot are routed to an idle warm VM, then to the snapshot prepared by
+// the function's policy, and finally to a cold start.
+func InvokeFunction(req *http.Request, invoc *models.Invocation) (string, string, string, *models.InvocationTiming, error) {
+	if err := beginCall(); err != nil {
+		return "", "", "", nil, err
+	}
+	defer endCall()
+	var prepare *Function
+	// only VMs the daemon picks or starts itself go back to the warm pool
+	pooled := invoc.VMID == "" && invoc.SsID == "" && vmController.warmPoolEnabled()
+	acquired := false
+	if invoc.VMID == "" && invoc.SsID == "" {
+		if vmController.warmPoolEnabled() {
+			invoc.VMID = vmController.AcquireIdle(*invoc.FuncName, invoc.Namespace)
+			acquired = invoc.VMID != ""
+		}
+		if invoc.VMID == "" && !policyInvocation(invoc) {
+			prepare = claimPolicy(invoc)
+		}
+	}
+
+	span := trace.FromContext(req.Context())
+	invocationSpans.watch(span.SpanContext().TraceID)
+	start, tStart := startType(invoc), time.Now()
+	resp, vm, traceId, err := invokeFunction(req, invoc, acquired)
+	total := time.Since(tStart)
+	timing := invocationTiming(start, invocationSpans.take(span.SpanContext().TraceID), total)
+	recordInvocation(*invoc.FuncName, start, err, total)
+	span.AddAttributes(append(spanAttributes(*invoc.FuncName, vm, invoc.SsID, restoreMode(invoc)), trace.StringAttribute("start", start))...)
+	if err != nil {
+		if prepare != nil {
+			fnManager.policyDone(prepare, "", err)
+		}
+		if vm != "" && pooled {
+			// the client never learns the id of a VM the daemon picked
+			if err := vmController.StopVM(nil, vm); err != nil {
+				log.Println("stopping", vm, "failed:", err)
+			}
+		} else if vm != "" {
+			vmController.MarkRunning(vm)
+		}
+		return "", "", traceId, timing, err
+	}
+	if prepare != nil {
+		// the cold-started VM is handed over to the policy
+		if err := beginCall(); err != nil {
+			fnManager.policyDone(prepare, "", err)
+		} else {
+			go func() {
+				defer endCall()
+				preparePolicy(req, prepare, vm, invoc)
+			}()
+		}
+	} else if pooled {
+		vmController.Release(vm)
+	} else {
+		vmController.MarkRunning(vm)
+	}
+	return resp, vm, traceId, timing, nil
+}
+
+// invokeFunction starts or picks the VM selected by invoc and invokes the
+// function in it. The VM is left busy. acquired tells that invoc.VMID was
+// taken from the warm pool and is busy already.
+func invokeFunction(req *http.Request, invoc *models.Invocation, acquired bool) (string, string, string, error) {
 	var vm string
 	var snapshot *Snapshot
 	var finished chan bool
 	var scan bool
-	var reapId string
 	span := trace.FromContext(req.Context())
 	traceId := span.SpanContext().TraceID.String()
 
 	switch {
 	case invoc.VMID != "":
 		// warm start
-		var ok bool
-		vmController.Lock()
-		_, ok = vmController.Machines[invoc.VMID]
-		vmController.Unlock()
-		if !ok {
-			log.Println("VM not exists")
-			return "", "", traceId, errors.New("VM not exists")
+		if !acquired {
+			if err := vmController.MarkBusy(invoc.VMID); err != nil {
+				return "", "", traceId, err
+			}
 		}
 		vm = invoc.VMID
 	case invoc.SsID != "":
 		// snapshot start
 		var err error
-		resultChan := make(chan error)
-		snapshot, ok := ssManager.Snapshots[invoc.SsID]
-		if !ok {
-			log.Println("Snapshot not exists")
-			return "", "", traceId, errors.New("Snapshot not exists")
-		}
-
-		if invoc.EnableReap {
-			reapId, err = reap.Register(req.Context(), invoc.SsID, snapshot.SnapshotBase, snapshot.SnapshotPath, snapshot.MemFilePath, snapshot.Size, invoc.WsFileDirectIo, invoc.WsSingleRead)
-			if err != nil {
-				log.Println("Register REAP failed", err.Error())
-				return "", "", traceId, err
-			}
-			go func() {
-				err := reap.Activate(req, reapId)
-				if err != nil {
-					log.Println("Activate REAP failed", err.Error())
-				}
-				resultChan <- err
-			}()
-			if vm, err = LoadSnapshot(req, invoc, reapId); err != nil {
-				log.Println("Snapshot start invocation failed")
-				return "", "", traceId, err
-			}
-			if err := <-resultChan; err != nil {
-				return "", "", traceId, err
-			}
-			vmController.Machines[vm].ReapId = reapId
-		} else {
-			if vm, err = LoadSnapshot(req, invoc, ""); err != nil {
-				log.Println("Snapshot start invocation failed")
-				return "", "", traceId, err
-			}
+		if vm, err = RestoreVM(req, invoc); err != nil {
+			log.Println("Snapshot start invocation failed")
+			return "", "", traceId, err
 		}
 	default:
 		// cold start
 		var err error
-		if vm, err = DoStartVM(req.Context(), *invoc.FuncName, invoc.Namespace); err != nil {
+		if vm, err = DoStartVM(req.Context(), *invoc.FuncName, invoc.Namespace, false); err != nil {
 			log.Println("Cold start invocation failed")
 			return "", "", traceId, err
 		}
@@ -367,15 +729,30 @@ func InvokeFunction(req *http.Request, invoc *models.Invocation) (string, string
 			log.Println("both mincore modes specified")
 			return "", "", traceId, errors.New("both mincore modes specified")
 		}
-		snapshot = ssManager.Snapshots[invoc.SsID]
-		if snapshot.mincoreLayers == nil {
+		var ok bool
+		if snapshot, ok = ssManager.Lookup(invoc.SsID); !ok {
+			log.Println("Snapshot not exists")
+			return "", vm, traceId, errors.New("Snapshot not exists")
+		}
+		if layers, _ := snapshot.layers(); layers == nil {
 			scan = true
 		}
 	}
 
 	if scan {
+		machine, ok := vmController.lookup(vm)
+		if !ok {
+			log.Println("VM not exists")
+			return "", vm, traceId, errors.New("VM not exists")
+		}
 		finished = make(chan bool)
-		go snapshot.ScanMincore(req, vmController.Machines[vm].process.Pid, int(*invoc.Mincore), int(invoc.MincoreSize), finished)
+		snapshot.scanWg.Add(1)
+		go func(snapshot *Snapshot, process VMMProcess) {
+			defer snapshot.scanWg.Done()
+			if err := snapshot.ScanMincore(req, process.Rss, int(*invoc.Mincore), int(invoc.MincoreSize), finished); err == nil {
+				snapshot.save()
+			}
+		}(snapshot, machine.process)
 		defer func() {
 			go func() {
 				finished <- true
@@ -383,9 +760,15 @@ func InvokeFunction(req *http.Request, invoc *models.Invocation) (string, string
 		}()
 	}
 
+	reapId := vmController.reapIdOf(vm)
 	resp, err := vmController.InvokeFunction(req, vm, *invoc.FuncName, invoc.Params)
 	if err != nil {
-		return "", "", traceId, err
+		if reapId != "" {
+			if reapErr := reap.Failure(reapId); reapErr != nil {
+				return "", vm, traceId, fmt.Errorf("serving page faults failed: %v", reapErr)
+			}
+		}
+		return "", vm, traceId, err
 	}
 
 	// if enableReap {
@@ -413,11 +796,15 @@ func ChangeReapCacheState(req *http.Request, ssID string, cache bool) error {
 
 func ChangeMincoreState(ctx context.Context, ssID string, fromRecordSize int, trimRegions bool, toWsFile string, inactiveWs, zeroWs bool, sizeThreshold, intervalThreshold int, nlayers []int64, dropWsCache bool) error {
 	log.Println("ChangeMincoreState", nlayers, trimRegions)
-	snapshot, ok := ssManager.Snapshots[ssID]
+	snapshot, ok := ssManager.Lookup(ssID)
 	if !ok {
 		log.Println("snapshot", ssID, "not exists")
 		return errors.New("snapshot not exists")
 	}
+	defer snapshot.save()
+	if err := ssManager.MergeLayers(snapshot); err != nil {
+		return err
+	}
 	if fromRecordSize > 0 {
 		if err := snapshot.EmulateMincore(ctx, fromRecordSize); err != nil {
 			return err
@@ -449,11 +836,25 @@ func GetMincore(req *http.Request, ssID string) (*operations.GetSnapshotsSsIDMin
 }
 
 func CopyMincore(req *http.Request, ssID string, source string) error {
-	return ssManager.CopyMincore(req, ssID, source)
+	if err := ssManager.CopyMincore(req, ssID, source); err != nil {
+		return err
+	}
+	snapshot, ok := ssManager.Lookup(ssID)
+	if !ok {
+		return errors.New("snapshot not exists")
+	}
+	return snapshot.save()
 }
 
 func AddMincoreLayer(req *http.Request, ssID string, position int, fromDiff string) error {
-	return ssManager.AddMincoreLayer(req, ssID, position, fromDiff)
+	if err := ssManager.AddMincoreLayer(req, ssID, position, fromDiff); err != nil {
+		return err
+	}
+	snapshot, ok := ssManager.Lookup(ssID)
+	if !ok {
+		return errors.New("snapshot not exists")
+	}
+	return snapshot.save()
 }
 
 // func getDmesg(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,414 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ucsdsysnet/faasnap/models"
+	"github.com/ucsdsysnet/faasnap/reap"
+	"go.opencensus.io/trace"
+)
+
+const (
+	testFunction  = "hello"
+	testNamespace = "fc0"
+	testMemSize   = 8 // MiB
+)
+
+var reapOnce sync.Once
+
+// setupTestDaemon points the daemon at a fresh BasePath with fake VMMs
+// reached over vsock, and creates testFunction.
+func setupTestDaemon(t *testing.T) *Config {
+	t.Helper()
+	config := &Config{
+		BasePath:        t.TempDir(),
+		Images:          map[string]string{"debian": "/dev/null"},
+		Kernels:         map[string]string{"vmlinux": "/dev/null"},
+		Executables:     map[string]string{"vanilla": "firecracker", "uffd": "firecracker"},
+		Launcher:        LauncherFake,
+		Transport:       TransportVsock,
+		SnapshotVersion: fakeVersion,
+	}
+	fnManager = NewFunctionManager(config)
+	vmController = NewVMController(config)
+	ssManager = NewSnapshotManager(config)
+	reapOnce.Do(func() {
+		reap.Setup(reap.MemoryManagerCfg{})
+		reap.OnFailure(func(id string, err error) { vmController.killReapVM(id, err) })
+	})
+	if err := vmController.AddNetwork(nil, testNamespace, "tap0", "eth0", "AA:FC:00:00:00:01", "172.16.0.2", "192.168.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fnManager.CreateFunction(testFunction, "vmlinux", "debian", 1, testMemSize, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, vm := range vmController.ListVMs("", "") {
+			vmController.StopVM(nil, *vm.VMID)
+			vmController.WaitStopped(*vm.VMID, stopTimeout)
+		}
+	})
+	return config
+}
+
+// testRequest returns a request with a span, like the ones served by the API.
+func testRequest(t *testing.T) *http.Request {
+	ctx, span := trace.StartSpan(context.Background(), t.Name())
+	t.Cleanup(span.End)
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://localhost/invocations", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func testInvocation(vmID, ssID string) *models.Invocation {
+	name, noMincore := testFunction, int64(-1)
+	return &models.Invocation{
+		FuncName:   &name,
+		VMID:       vmID,
+		SsID:       ssID,
+		Namespace:  testNamespace,
+		Params:     "{}",
+		Mincore:    &noMincore,
+		UseMemFile: ssID != "",
+	}
+}
+
+// takeTestSnapshot cold starts a VM, snapshots it and stops it.
+func takeTestSnapshot(t *testing.T, config *Config) string {
+	t.Helper()
+	req := testRequest(t)
+	vm, err := DoStartVM(req.Context(), testFunction, testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("%v/%v", config.BasePath, vm)
+	ssID, err := TakeSnapshot(req, vm, SnapshotFull, base+".snapshot", base+".memfile", fakeVersion, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stopAndWait(vm); err != nil {
+		t.Fatal(err)
+	}
+	return ssID
+}
+
+func TestInvokeColdWarmSnapshot(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+
+	_, vm, _, _, err := InvokeFunction(testRequest(t), testInvocation("", ssID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetVM(vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SsID != ssID {
+		t.Errorf("VM restored from %q, want %q", got.SsID, ssID)
+	}
+	if _, _, _, _, err := InvokeFunction(testRequest(t), testInvocation(vm, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSnapshot(ssID); err == nil {
+		t.Error("deleted a snapshot in use")
+	}
+	if err := stopAndWait(vm); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSnapshot(ssID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentInvokeSnapshotDelete runs cold, warm and snapshot starts,
+// snapshots, stops and deletes at once. Run it with -race.
+func TestConcurrentInvokeSnapshotDelete(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+	victim := takeTestSnapshot(t, config)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	run := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		// snapshot start, then warm start the same VM
+		run(func() error {
+			_, vm, _, _, err := InvokeFunction(testRequest(t), testInvocation("", ssID))
+			if err != nil {
+				return err
+			}
+			if _, _, _, _, err := InvokeFunction(testRequest(t), testInvocation(vm, "")); err != nil {
+				return err
+			}
+			return stopAndWait(vm)
+		})
+		// cold start, snapshot and stop
+		run(func() error {
+			req := testRequest(t)
+			vm, err := StartVM(req, testFunction, "", testNamespace, false, false, false, false, false)
+			if err != nil {
+				return err
+			}
+			base := fmt.Sprintf("%v/%v", config.BasePath, vm)
+			if _, err := TakeSnapshot(req, vm, SnapshotFull, base+".snapshot", base+".memfile", fakeVersion, false, 0, 0); err != nil {
+				return err
+			}
+			return stopAndWait(vm)
+		})
+		// restores racing the deletion may fail, but must not leave a VM
+		// running from the deleted snapshot
+		run(func() error {
+			if _, vm, _, _, err := InvokeFunction(testRequest(t), testInvocation("", victim)); err == nil {
+				return stopAndWait(vm)
+			}
+			return nil
+		})
+		run(func() error {
+			GetVMs("", "")
+			GetSnapshots()
+			return nil
+		})
+	}
+	run(func() error {
+		for {
+			err := DeleteSnapshot(victim)
+			if err == nil {
+				return nil
+			}
+			if _, ok := ssManager.Lookup(victim); !ok {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if _, err := GetSnapshot(victim); err == nil {
+		t.Error("snapshot", victim, "not deleted")
+	}
+	for _, vm := range GetVMs("", "") {
+		if vm.SsID == victim {
+			t.Error("VM", *vm.VMID, "runs from the deleted snapshot")
+		}
+	}
+}
+
+// TestMarkBusyOnce checks that concurrent warm starts of one VM do not share it.
+func TestMarkBusyOnce(t *testing.T) {
+	setupTestDaemon(t)
+	vm, err := DoStartVM(context.Background(), testFunction, testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	busy := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if vmController.MarkBusy(vm) == nil {
+				mu.Lock()
+				busy++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if busy != 1 {
+		t.Errorf("%d invocations got the VM, want 1", busy)
+	}
+}
+
+// TestEnvInjectedOnStart checks that the guest has the secrets of the function
+// as soon as it is started or restored, and that they are stored privately.
+func TestEnvInjectedOnStart(t *testing.T) {
+	config := setupTestDaemon(t)
+	if err := fnManager.CreateFunction("secret", "vmlinux", "debian", 1, testMemSize, map[string]string{"TOKEN": "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fnManager.statePath()); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("functions.json mode %v, %v", fi.Mode(), err)
+	}
+	checkEnv := func(vmID string) {
+		t.Helper()
+		vm, _ := vmController.lookup(vmID)
+		vmm := vm.process.(*fakeVMM)
+		vmm.Lock()
+		env := vmm.guest.Env()
+		vmm.Unlock()
+		if env["TOKEN"] != "s3cret" {
+			t.Errorf("guest of %v has env %v", vmID, env)
+		}
+	}
+
+	req := testRequest(t)
+	vm, err := DoStartVM(req.Context(), "secret", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEnv(vm)
+	base := fmt.Sprintf("%v/%v", config.BasePath, vm)
+	ssID, err := TakeSnapshot(req, vm, SnapshotFull, base+".snapshot", base+".memfile", fakeVersion, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stopAndWait(vm); err != nil {
+		t.Fatal(err)
+	}
+	name := "secret"
+	vm, err = RestoreVM(testRequest(t), &models.Invocation{FuncName: &name, SsID: ssID, Namespace: testNamespace, UseMemFile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEnv(vm)
+}
+
+// TestWarmPoolFailedInvocation checks that a pooled VM whose invocation
+// failed is stopped rather than left busy.
+func TestWarmPoolFailedInvocation(t *testing.T) {
+	config := setupTestDaemon(t)
+	config.WarmPool.MaxWarm = 1
+	_, vm, _, _, err := InvokeFunction(testRequest(t), testInvocation("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoc := testInvocation("", "")
+	invoc.Params = "not json"
+	if _, _, _, _, err := InvokeFunction(testRequest(t), invoc); err == nil {
+		t.Fatal("invocation with bad params succeeded")
+	}
+	if err := vmController.WaitStopped(vm, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDedupDuringRestore checks that a snapshot is not deduplicated or
+// compressed while it is restored, and that restores wait for a
+// deduplication.
+func TestDedupDuringRestore(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+
+	snapshot, ok := ssManager.acquire(ssID)
+	if !ok {
+		t.Fatal("snapshot not found")
+	}
+	if err := ChangeSnapshot(testRequest(t), ssID, false, false, false, true, false); err == nil {
+		t.Error("deduplicated a snapshot being restored")
+	}
+	if err := ChangeSnapshot(testRequest(t), ssID, false, false, false, false, true); err == nil {
+		t.Error("compressed a snapshot being restored")
+	}
+	ssManager.release(snapshot)
+
+	if err := ssManager.markShrinking(ssID); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan *Snapshot)
+	go func() {
+		snapshot, _ := ssManager.acquire(ssID)
+		acquired <- snapshot
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("restore did not wait for the deduplication")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ssManager.unmarkShrinking(ssID)
+	ssManager.release(<-acquired)
+
+	if err := ChangeSnapshot(testRequest(t), ssID, false, false, false, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := InvokeFunction(testRequest(t), testInvocation("", ssID)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDiffSnapshotOfColdStart checks that a VM booted with dirty page
+// tracking takes diff snapshots once it has a full snapshot.
+func TestDiffSnapshotOfColdStart(t *testing.T) {
+	config := setupTestDaemon(t)
+	req := testRequest(t)
+	untracked, err := StartVM(req, testFunction, "", testNamespace, false, false, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("%v/%v", config.BasePath, untracked)
+	if _, err := TakeSnapshot(req, untracked, SnapshotDiff, base+".snapshot", base+".memfile", fakeVersion, false, 0, 0); err == nil {
+		t.Error("took a diff snapshot of a VM without dirty page tracking")
+	}
+
+	vm, err := StartVM(req, testFunction, "", testNamespace, false, false, false, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base = fmt.Sprintf("%v/%v", config.BasePath, vm)
+	if _, err := TakeSnapshot(req, vm, SnapshotDiff, base+".diff0.snapshot", base+".diff0.memfile", fakeVersion, false, 0, 0); err == nil {
+		t.Error("took a diff snapshot without a full one")
+	}
+	full, err := TakeSnapshot(req, vm, SnapshotFull, base+".snapshot", base+".memfile", fakeVersion, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := InvokeFunction(testRequest(t), testInvocation(vm, "")); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := TakeSnapshot(req, vm, SnapshotDiff, base+".diff.snapshot", base+".diff.memfile", fakeVersion, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stopAndWait(vm); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, ok := ssManager.Lookup(diff)
+	if !ok || snapshot.Parent != full {
+		t.Fatalf("diff snapshot %v not based on %v", diff, full)
+	}
+	if _, _, _, _, err := InvokeFunction(testRequest(t), testInvocation("", diff)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,563 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/ucsdsysnet/faasnap/agent"
+	"github.com/ucsdsysnet/faasnap/reap"
+	"golang.org/x/sys/unix"
+)
+
+// fakeVersion is the firecracker version reported by fake VMMs.
+const fakeVersion = "0.23.0"
+
+// fakeWorkingSetStride is the distance in pages between the guest pages an
+// invocation of a fake VM reads.
+const fakeWorkingSetStride = 3
+
+// fakeLauncher starts in-process VMMs that serve the subset of the firecracker
+// API used by faasnap. The guest memory of a fake VMM is a mapping of the
+// daemon, filled with deterministic contents on boot and loaded from the mem
+// file or through REAP on restore, so the snapshot, mincore, ws file and REAP
+// paths can run without KVM.
+type fakeLauncher struct{}
+
+type fakeVMM struct {
+	sync.Mutex
+	listener net.Listener
+	server   *http.Server
+	memSize  int // bytes
+	vmPath   string
+	vsock    *Vsock
+	agent    *http.Server
+	guest    *agent.Agent
+	state    string
+	dirty    bool // dirty pages are tracked for diff snapshots
+	resumed  bool // the guest ran since it was started or loaded
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// guest memory; read with readGuest and memLock held, and unmapped with
+	// it locked
+	memLock sync.RWMutex
+	mem     []byte
+	// serves the missing pages of mem through REAP
+	uffdLock sync.Mutex
+	uffd     *os.File
+	guestSum uint64 // of what the guest read, updated atomically
+}
+
+// fakeSnapshotState is the content of a snapshot file written by a fake VMM.
+type fakeSnapshotState struct {
+	MemSize int    `json:"mem_size"`
+	Vsock   *Vsock `json:"vsock,omitempty"`
+}
+
+func (l *fakeLauncher) Launch(ctx context.Context, spec *LaunchSpec) (VMMProcess, error) {
+	os.Remove(spec.ApiSock)
+	listener, err := net.Listen("unix", spec.ApiSock)
+	if err != nil {
+		return nil, err
+	}
+	vmm := &fakeVMM{
+		listener: listener,
+		state:    "Not started",
+		vmPath:   spec.VmPath,
+		done:     make(chan struct{}),
+	}
+	if spec.Config != nil {
+		vmm.memSize = spec.Config.MachineConfig.MemSizeMib << 20
+		vmm.dirty = spec.Config.MachineConfig.TrackDirtyPages
+		vmm.state = "Running"
+		if vmm.mem, err = unix.Mmap(-1, 0, vmm.memSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		fillFakeMemory(vmm.mem)
+		if err := vmm.startAgent(spec.Config.Vsock); err != nil {
+			unix.Munmap(vmm.mem)
+			listener.Close()
+			return nil, err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", vmm.handleRoot)
+	mux.HandleFunc("/vm", vmm.handleVM)
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"firecracker_version": fakeVersion})
+	})
+	mux.HandleFunc("/snapshot/create", vmm.handleCreate)
+	mux.HandleFunc("/snapshot/load", vmm.handleLoad)
+	vmm.server = &http.Server{Handler: mux}
+	go vmm.server.Serve(listener)
+	return vmm, nil
+}
+
+// Pid returns 0, as the fake runs in the daemon and has no process.
+func (vmm *fakeVMM) Pid() int {
+	return 0
+}
+
+// Rss returns the KiB of guest memory the fake mapped in.
+func (vmm *fakeVMM) Rss() (int, error) {
+	vmm.memLock.RLock()
+	defer vmm.memLock.RUnlock()
+	if vmm.mem == nil {
+		return 0, nil
+	}
+	pages, err := residentPages(vmm.mem)
+	if err != nil {
+		return 0, err
+	}
+	return pages * os.Getpagesize() >> 10, nil
+}
+
+func (vmm *fakeVMM) Signal(sig os.Signal) error {
+	if sig != syscall.SIGTERM && sig != syscall.SIGKILL {
+		return nil
+	}
+	select {
+	case <-vmm.done:
+		return errors.New("os: process already finished")
+	default:
+	}
+	vmm.stopOnce.Do(func() {
+		// before anything else, so that reads waiting for REAP return
+		vmm.uffdLock.Lock()
+		if vmm.uffd != nil {
+			if err := reap.CloseUserfaultfd(vmm.uffd, vmm.mem); err != nil {
+				log.Println("fake vmm: closing the uffd:", err)
+			}
+			vmm.uffd = nil
+		}
+		vmm.uffdLock.Unlock()
+		vmm.server.Close()
+		vmm.Lock()
+		if vmm.agent != nil {
+			vmm.agent.Close()
+		}
+		vmm.Unlock()
+		vmm.memLock.Lock()
+		if vmm.mem != nil {
+			unix.Munmap(vmm.mem)
+			vmm.mem = nil
+		}
+		vmm.memLock.Unlock()
+		close(vmm.done)
+	})
+	return nil
+}
+
+func (vmm *fakeVMM) Wait() error {
+	<-vmm.done
+	return nil
+}
+
+func fakeError(w http.ResponseWriter, code int, err error) {
+	log.Println("fake vmm:", err)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"fault_message": err.Error()})
+}
+
+func (vmm *fakeVMM) handleRoot(w http.ResponseWriter, r *http.Request) {
+	vmm.Lock()
+	defer vmm.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"id": "fake", "state": vmm.state})
+}
+
+func (vmm *fakeVMM) handleVM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	vmm.Lock()
+	first := false
+	switch {
+	case body.State == "Paused" && vmm.state == "Running":
+		vmm.state = "Paused"
+	case body.State == "Resumed" && vmm.state == "Paused":
+		vmm.state = "Running"
+		first, vmm.resumed = !vmm.resumed, true
+	default:
+		vmm.Unlock()
+		fakeError(w, http.StatusBadRequest, errors.New("invalid state transition from "+vmm.state+" to "+body.State))
+		return
+	}
+	vmm.Unlock()
+	if first {
+		// REAP takes the first fault for the start of guest memory
+		vmm.runGuest(1, 1)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (vmm *fakeVMM) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		SnapshotType string `json:"snapshot_type"`
+		SnapshotPath string `json:"snapshot_path"`
+		MemFilePath  string `json:"mem_file_path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	vmm.Lock()
+	defer vmm.Unlock()
+	if vmm.state != "Paused" {
+		fakeError(w, http.StatusBadRequest, errors.New("vm is not paused"))
+		return
+	}
+	data, err := json.Marshal(&fakeSnapshotState{MemSize: vmm.memSize, Vsock: vmm.vsock})
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := os.WriteFile(body.SnapshotPath, data, 0644); err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	diff := body.SnapshotType == SnapshotDiff
+	if diff && !vmm.dirty {
+		fakeError(w, http.StatusBadRequest, errors.New("diff snapshots are not enabled"))
+		return
+	}
+	if err := vmm.writeMemory(body.MemFilePath, diff); err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (vmm *fakeVMM) handleLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		SnapshotPath         string `json:"snapshot_path"`
+		MemFilePath          string `json:"mem_file_path"`
+		OverlayFilePath      string `json:"overlay_file_path"`
+		EnableDiffSnapshots  bool   `json:"enable_diff_snapshots"`
+		EnableUserPageFaults bool   `json:"enable_user_page_faults"`
+		SockFilePath         string `json:"sock_file_path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	data, err := os.ReadFile(body.SnapshotPath)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var state fakeSnapshotState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	vmm.Lock()
+	defer vmm.Unlock()
+	if vmm.state != "Not started" {
+		fakeError(w, http.StatusBadRequest, errors.New("snapshot can only be loaded into a fresh vmm"))
+		return
+	}
+	var mem []byte
+	var uffd *os.File
+	switch {
+	case body.EnableUserPageFaults:
+		mem, uffd, err = loadFakeMemoryReap(state.MemSize, body.SockFilePath)
+	case body.MemFilePath != "":
+		mem, err = loadFakeMemory(body.MemFilePath, state.MemSize)
+	case body.OverlayFilePath != "":
+		// the regions overlaid from the mem file are the pages it holds
+		mem, err = loadFakeMemory(body.OverlayFilePath, state.MemSize)
+	default:
+		err = errors.New("no guest memory to load")
+	}
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := vmm.startAgent(state.Vsock); err != nil {
+		if uffd != nil {
+			reap.CloseUserfaultfd(uffd, mem)
+		}
+		unix.Munmap(mem)
+		fakeError(w, http.StatusBadRequest, err)
+		return
+	}
+	vmm.memLock.Lock()
+	vmm.mem = mem
+	vmm.memLock.Unlock()
+	vmm.uffdLock.Lock()
+	vmm.uffd = uffd
+	vmm.uffdLock.Unlock()
+	vmm.memSize = state.MemSize
+	vmm.dirty = body.EnableDiffSnapshots
+	vmm.state = "Paused"
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startAgent serves a stand-in guest agent behind the vsock device, if any.
+// Invocations read the fake working set of guest memory before they run.
+// Callers must hold the lock of vmm unless it is not shared yet.
+func (vmm *fakeVMM) startAgent(vsock *Vsock) error {
+	if vsock == nil {
+		return nil
+	}
+	uds := vsock.UdsPath
+	if !filepath.IsAbs(uds) {
+		uds = filepath.Join(vmm.vmPath, uds)
+	}
+	os.Remove(uds)
+	l, err := agent.ListenVsock(uds, agent.VsockPort)
+	if err != nil {
+		return err
+	}
+	vmm.vsock = vsock
+	vmm.guest = agent.New()
+	handler := vmm.guest.Handler()
+	vmm.agent = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/invoke" {
+			vmm.runGuest(fakeWorkingSetStride, -1)
+		}
+		handler.ServeHTTP(w, r)
+	})}
+	go vmm.agent.Serve(l)
+	return nil
+}
+
+// runGuest reads every stride-th page of guest memory from the first one on,
+// count pages or all of them if count is negative, faulting them in like a
+// guest would.
+func (vmm *fakeVMM) runGuest(stride, count int) {
+	vmm.memLock.RLock()
+	defer vmm.memLock.RUnlock()
+	pagesize, sum := os.Getpagesize(), uint64(0)
+	var b [1]byte
+	for i := 0; i < len(vmm.mem) && count != 0; i += stride * pagesize {
+		if err := vmm.readGuest(b[:], i); err != nil {
+			log.Println("fake vmm: reading guest memory:", err)
+			return
+		}
+		sum += uint64(b[0])
+		count--
+	}
+	atomic.AddUint64(&vmm.guestSum, sum)
+}
+
+// readGuest copies the guest memory at offset to buf. The kernel copies it,
+// so a goroutine waiting for REAP to serve a page is in a syscall and does
+// not hold up the garbage collector, which the REAP goroutines need. Callers
+// must hold memLock.
+func (vmm *fakeVMM) readGuest(buf []byte, offset int) error {
+	if offset+len(buf) > len(vmm.mem) {
+		return fmt.Errorf("%d bytes at %d out of guest memory", len(buf), offset)
+	}
+	local := []unix.Iovec{{Base: &buf[0]}}
+	local[0].SetLen(len(buf))
+	remote := []unix.RemoteIovec{{Base: uintptr(unsafe.Pointer(&vmm.mem[offset])), Len: len(buf)}}
+	for len(buf) > 0 {
+		n, err := unix.ProcessVMReadv(os.Getpid(), local, remote, 0)
+		if err != nil {
+			return err
+		}
+		buf, offset = buf[n:], offset+n
+		if len(buf) > 0 {
+			local[0] = unix.Iovec{Base: &buf[0]}
+			local[0].SetLen(len(buf))
+			remote[0] = unix.RemoteIovec{Base: uintptr(unsafe.Pointer(&vmm.mem[offset])), Len: len(buf)}
+		}
+	}
+	return nil
+}
+
+// writeMemory writes guest memory to path, leaving zero pages as holes. Diff
+// snapshots hold every eighth page.
+func (vmm *fakeVMM) writeMemory(path string, diff bool) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	vmm.memLock.RLock()
+	defer vmm.memLock.RUnlock()
+	if !diff {
+		if err := f.Truncate(int64(len(vmm.mem))); err != nil {
+			return err
+		}
+	}
+	pagesize, step := os.Getpagesize(), 1
+	if diff {
+		step = 8
+	}
+	page := make([]byte, pagesize)
+	for i := 0; i*pagesize < len(vmm.mem); i += step {
+		if err := vmm.readGuest(page, i*pagesize); err != nil {
+			return err
+		}
+		if zeroPage(page) {
+			continue
+		}
+		if _, err := f.WriteAt(page, int64(i*pagesize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func zeroPage(page []byte) bool {
+	for _, b := range page {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fillFakeMemory fills guest memory on boot. Every fourth page is left zero,
+// the others are filled with a non-zero byte derived from the page number.
+func fillFakeMemory(mem []byte) {
+	pagesize := os.Getpagesize()
+	for i := 0; i*pagesize < len(mem); i++ {
+		if i%4 == 3 {
+			continue
+		}
+		page := mem[i*pagesize : (i+1)*pagesize]
+		for j := range page {
+			page[j] = byte(i%255 + 1)
+		}
+	}
+}
+
+// loadFakeMemory maps a mem file as guest memory, copy-on-write like
+// firecracker does.
+func loadFakeMemory(path string, size int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < int64(size) {
+		return nil, fmt.Errorf("mem file %v holds %d of %d bytes", path, fi.Size(), size)
+	}
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE)
+}
+
+// loadFakeMemoryReap maps empty guest memory with a uffd, and hands the uffd
+// to REAP when it connects to sockPath.
+func loadFakeMemoryReap(size int, sockPath string) ([]byte, *os.File, error) {
+	if sockPath == "" {
+		return nil, nil, errors.New("no uffd socket")
+	}
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, nil, err
+	}
+	uffd, features, err := reap.NewUserfaultfd(mem)
+	if err != nil {
+		unix.Munmap(mem)
+		return nil, nil, err
+	}
+	if err := sendFakeUffd(sockPath, uffd, features); err != nil {
+		reap.CloseUserfaultfd(uffd, mem)
+		unix.Munmap(mem)
+		return nil, nil, err
+	}
+	return mem, uffd, nil
+}
+
+// fakeUffdTimeout bounds the wait for REAP to connect to the uffd socket.
+const fakeUffdTimeout = 5 * time.Second
+
+func sendFakeUffd(sockPath string, uffd *os.File, features uint64) error {
+	os.Remove(sockPath)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// REAP removes the socket, like the one firecracker leaves behind
+	l.SetUnlinkOnClose(false)
+	defer l.Close()
+	l.SetDeadline(time.Now().Add(fakeUffdTimeout))
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return fmt.Errorf("waiting for REAP: %v", err)
+	}
+	defer conn.Close()
+	return reap.SendUserfaultfd(conn, uffd, features)
+}
+
+// residentPages counts the pages of mem mapped in, from /proc/self/pagemap.
+func residentPages(mem []byte) (int, error) {
+	f, err := os.Open("/proc/self/pagemap")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	pagesize := os.Getpagesize()
+	entries := make([]byte, len(mem)/pagesize*8)
+	start := int64(uintptr(unsafe.Pointer(&mem[0]))) / int64(pagesize) * 8
+	if _, err := f.ReadAt(entries, start); err != nil {
+		return 0, err
+	}
+	pages := 0
+	for i := 0; i < len(entries); i += 8 {
+		// bit 63 is set for present pages, bit 62 for swapped ones
+		if binary.LittleEndian.Uint64(entries[i:])>>62 != 0 {
+			pages++
+		}
+	}
+	return pages, nil
+}
@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/ucsdsysnet/faasnap/reap"
+)
+
+// fakeOf returns the fake VMM of vmID.
+func fakeOf(t *testing.T, vmID string) *fakeVMM {
+	t.Helper()
+	vm, ok := vmController.lookup(vmID)
+	if !ok {
+		t.Fatal("VM", vmID, "not exists")
+	}
+	return vm.process.(*fakeVMM)
+}
+
+// checkGuestMemory compares the guest memory of vmID with the mem file.
+func checkGuestMemory(t *testing.T, vmID string, memFile []byte) {
+	t.Helper()
+	vmm := fakeOf(t, vmID)
+	vmm.memLock.RLock()
+	defer vmm.memLock.RUnlock()
+	mem := make([]byte, len(vmm.mem))
+	if err := vmm.readGuest(mem, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem, memFile) {
+		t.Error("guest memory of", vmID, "differs from the mem file")
+	}
+}
+
+func TestFakeSnapshotMemory(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+	snapshot, _ := ssManager.Lookup(ssID)
+	memFile, err := os.ReadFile(snapshot.MemFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pagesize := os.Getpagesize()
+	if len(memFile) != testMemSize<<20 {
+		t.Fatalf("mem file holds %d bytes, want %d", len(memFile), testMemSize<<20)
+	}
+	for i := 0; i*pagesize < len(memFile); i++ {
+		want := byte(i%255 + 1)
+		if i%4 == 3 {
+			want = 0
+		}
+		if page := memFile[i*pagesize : (i+1)*pagesize]; !bytes.Equal(page, bytes.Repeat([]byte{want}, pagesize)) {
+			t.Fatalf("page %d of the mem file is not filled with %d", i, want)
+		}
+	}
+
+	_, vm, _, _, err := InvokeFunction(testRequest(t), testInvocation("", ssID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGuestMemory(t, vm, memFile)
+	if rss, err := fakeOf(t, vm).Rss(); err != nil || rss == 0 {
+		t.Errorf("rss %d KiB, %v", rss, err)
+	}
+	if got, _ := GetVM(vm); got.Pid != 0 {
+		t.Errorf("fake VM reported pid %d", got.Pid)
+	}
+}
+
+func TestFakeMincoreBySize(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+	snapshot, _ := ssManager.Lookup(ssID)
+
+	invoc := testInvocation("", ssID)
+	invoc.MincoreSize = 16
+	_, vm, _, _, err := InvokeFunction(testRequest(t), invoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stopAndWait(vm); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.scanWg.Wait()
+	layers, current := snapshot.layers()
+	if layers == nil || current == 0 {
+		t.Fatal("no mincore layers were scanned")
+	}
+	resident := 0
+	for _, layer := range layers {
+		if layer > 0 {
+			resident++
+		}
+	}
+	if resident == 0 {
+		t.Error("no pages of the mem file were resident")
+	}
+}
+
+// TestFakeReapRecordReplay serves the guest memory of fake VMs through REAP,
+// first recording the pages an invocation reads, then replaying them.
+func TestFakeReapRecordReplay(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+	snapshot, _ := ssManager.Lookup(ssID)
+	memFile, err := os.ReadFile(snapshot.MemFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reapInvocation := func() string {
+		invoc := testInvocation("", ssID)
+		invoc.UseMemFile = false
+		invoc.EnableReap = true
+		_, vm, _, _, err := InvokeFunction(testRequest(t), invoc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vm
+	}
+
+	vm := reapInvocation()
+	if err := stopAndWait(vm); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := reap.GetStats(ssID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := testMemSize << 20 / os.Getpagesize()
+	if want := (pages + fakeWorkingSetStride - 1) / fakeWorkingSetStride; stats.RecordPages != want {
+		t.Errorf("recorded %d pages, want the %d the invocation read", stats.RecordPages, want)
+	}
+
+	vm = reapInvocation()
+	// pages outside the working set are served on demand
+	checkGuestMemory(t, vm, memFile)
+	if err := stopAndWait(vm); err != nil {
+		t.Fatal(err)
+	}
+	if err := reap.Failure(vmController.reapIdOf(vm)); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestFakeReapCompressed serves the guest memory of a fake VM from a
+// compressed snapshot through REAP.
+func TestFakeReapCompressed(t *testing.T) {
+	config := setupTestDaemon(t)
+	ssID := takeTestSnapshot(t, config)
+	snapshot, _ := ssManager.Lookup(ssID)
+	memFile, err := os.ReadFile(snapshot.MemFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ChangeSnapshot(testRequest(t), ssID, false, false, false, false, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // record, then replay
+		invoc := testInvocation("", ssID)
+		invoc.UseMemFile = false
+		invoc.EnableReap = true
+		_, vm, _, _, err := InvokeFunction(testRequest(t), invoc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGuestMemory(t, vm, memFile)
+		if err := stopAndWait(vm); err != nil {
+			t.Fatal(err)
+		}
+		if err := reap.Failure(vmController.reapIdOf(vm)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(snapshot.MemFilePath); !os.IsNotExist(err) {
+		t.Errorf("mem file rebuilt for REAP: %v", err)
+	}
+}
@@ -23,19 +23,31 @@
 package daemon
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/ucsdsysnet/faasnap/models"
 )
 
 type Function struct {
-	Name    string `json:"name"`
-	Kernel  string `json:"kernel"`
-	Image   string `json:"image"`
-	Vcpu    int    `json:"vcpu"`
-	MemSize int    `json:"memSize"`
+	Name        string          `json:"name"`
+	Kernel      string          `json:"kernel"`
+	Image       string          `json:"image"`
+	Vcpu        int             `json:"vcpu"`
+	MemSize     int             `json:"memSize"`
+	Policy      *SnapshotPolicy `json:"policy,omitempty"`
+	Secrets     Secrets         `json:"secrets,omitempty"`    // redacted when marshalled
+	PolicySsId  string          `json:"policySsId,omitempty"` // snapshot prepared by the policy
+	policyState string
+	policyFails int       // failed preparations in a row
+	policyRetry time.Time // a failed preparation is not retried before
 }
 
 type FunctionManager struct {
@@ -51,7 +63,86 @@ func NewFunctionManager(config *Config) *FunctionManager {
 	}
 }
 
-func (fm *FunctionManager) CreateFunction(name string, kernel string, image string, vcpu, memSize int) error {
+// ListFunctions returns all functions sorted by name.
+func (fm *FunctionManager) ListFunctions() []*models.Function {
+	fm.Lock()
+	defer fm.Unlock()
+	ret := make([]*models.Function, 0, len(fm.Functions))
+	for _, fn := range fm.Functions {
+		name := fn.Name
+		ret = append(ret, &models.Function{
+			FuncName: &name,
+			Kernel:   fn.Kernel,
+			Image:    fn.Image,
+			Vcpu:     int64(fn.Vcpu),
+			MemSize:  int64(fn.MemSize),
+			Policy:   fn.policyModel(),
+			Secrets:  fn.Secrets.Redacted(),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return *ret[i].FuncName < *ret[j].FuncName })
+	return ret
+}
+
+// lookup returns the function name.
+func (fm *FunctionManager) lookup(name string) (*Function, bool) {
+	fm.Lock()
+	defer fm.Unlock()
+	fn, ok := fm.Functions[name]
+	return fn, ok
+}
+
+func (fm *FunctionManager) statePath() string {
+	return fm.config.BasePath + "/functions.json"
+}
+
+// functionMeta is the on-disk form of a function. Unlike Function it keeps the
+// values of the secrets.
+type functionMeta struct {
+	*Function
+	Secrets map[string]string `json:"secrets,omitempty"`
+}
+
+// save persists the function table. Callers must hold fm's lock.
+func (fm *FunctionManager) save() error {
+	metas := make(map[string]*functionMeta, len(fm.Functions))
+	for name, fn := range fm.Functions {
+		metas[name] = &functionMeta{Function: fn, Secrets: fn.Secrets}
+	}
+	data, err := json.Marshal(metas)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fm.config.BasePath, 0755); err != nil {
+		return err
+	}
+	// holds the secrets of the functions
+	return WriteFileAtomic(fm.statePath(), data, 0600)
+}
+
+// LoadFunctions restores the functions created by a previous run of the daemon.
+func (fm *FunctionManager) LoadFunctions() error {
+	fm.Lock()
+	defer fm.Unlock()
+	data, err := ioutil.ReadFile(fm.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	functions := map[string]*functionMeta{}
+	if err := json.Unmarshal(data, &functions); err != nil {
+		return err
+	}
+	for name, meta := range functions {
+		meta.Function.Secrets = meta.Secrets
+		fm.Functions[name] = meta.Function
+	}
+	log.Println("loaded", len(functions), "functions")
+	return nil
+}
+
+func (fm *FunctionManager) CreateFunction(name string, kernel string, image string, vcpu, memSize int, secrets map[string]string) error {
 	fm.Lock()
 	defer fm.Unlock()
 
@@ -86,10 +177,14 @@ func (fm *FunctionManager) CreateFunction(name string, kernel string, image stri
 		Image:   imagePath,
 		Vcpu:    vcpu,
 		MemSize: memSize,
+		Secrets: secrets,
 	}
 
 	log.Println("adding function:", *newFunc)
 
 	fm.Functions[name] = newFunc
+	if err := fm.save(); err != nil {
+		log.Error("saving functions failed: ", err)
+	}
 	return nil
 }
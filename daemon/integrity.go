@@ -0,0 +1,398 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+)
+
+// VerifyConfig tells the daemon whether to check snapshots before they are
+// restored or copied.
+type VerifyConfig struct {
+	Enabled bool    `json:"enabled"`
+	Sample  float64 `json:"sample"` // ratio of mem and ws file pages checked; 0 checks whole files
+}
+
+// FileChecksum is the recorded digest of a snapshot file.
+type FileChecksum struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// the snapshot files checksums are recorded for
+const (
+	fileSnapshot   = "snapshot"
+	fileMem        = "mem"
+	fileDiff       = "diff"
+	fileWs         = "ws"
+	fileCompressed = "compressed"
+)
+
+// errNoChecksums is returned when verifying snapshots taken before checksums
+// were recorded.
+var errNoChecksums = errors.New("no checksums recorded")
+
+var pageTable = crc64.MakeTable(crc64.ECMA)
+
+// The page index stores the CRC-64 (ECMA) of each page of the mem file:
+//
+//	magic "FSPAGES" | version byte | page size, 8 bytes | page count, 8 bytes |
+//	page hashes, 8 bytes each | CRC-32 (IEEE) of everything before it, 4 bytes
+//
+// All integers are little endian.
+const (
+	pageIndexMagic   = "FSPAGES"
+	pageIndexVersion = 1
+)
+
+func (snapshot *Snapshot) pageIndexPath() string {
+	return snapshot.SnapshotBase + "/" + snapshot.SnapshotId + ".pages"
+}
+
+// filePath returns the path of a snapshot file by its checksum key.
+func (snapshot *Snapshot) filePath(file string) string {
+	switch file {
+	case fileSnapshot:
+		return snapshot.SnapshotPath
+	case fileMem:
+		return snapshot.MemFilePath
+	case fileDiff:
+		return snapshot.DiffFilePath
+	case fileWs:
+		return snapshot.WsFile
+	case fileCompressed:
+		return snapshot.compressedPath()
+	}
+	return ""
+}
+
+// hashFile returns the checksum of a file and, if pages is set, the hash of
+// each of its pages.
+func hashFile(path string, pages bool) (FileChecksum, []uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileChecksum{}, nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	pagesize := os.Getpagesize()
+	buf := make([]byte, 256*pagesize)
+	var size int64
+	var index []uint64
+	for {
+		n, err := io.ReadFull(f, buf)
+		h.Write(buf[:n])
+		size += int64(n)
+		if pages {
+			for off := 0; off < n; off += pagesize {
+				end := off + pagesize
+				if end > n {
+					end = n
+				}
+				index = append(index, crc64.Checksum(buf[off:end], pageTable))
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return FileChecksum{}, nil, err
+		}
+	}
+	return FileChecksum{Size: size, Sha256: hex.EncodeToString(h.Sum(nil))}, index, nil
+}
+
+// recordChecksums hashes the given files of the snapshot, and indexes the
+// pages of the mem file.
+func (snapshot *Snapshot) recordChecksums(files ...string) error {
+	for _, file := range files {
+		path := snapshot.filePath(file)
+		if path == "" {
+			continue
+		}
+		sum, index, err := hashFile(path, file == fileMem)
+		if err != nil {
+			log.Println("hashing", path, "failed:", err)
+			return err
+		}
+		if file == fileMem {
+			if err := writePageIndex(snapshot.pageIndexPath(), index); err != nil {
+				log.Println("writing page index of", snapshot.SnapshotId, "failed:", err)
+				return err
+			}
+		}
+		snapshot.Lock()
+		if snapshot.Checksums == nil {
+			snapshot.Checksums = map[string]FileChecksum{}
+		}
+		snapshot.Checksums[file] = sum
+		snapshot.Unlock()
+	}
+	return nil
+}
+
+func writePageIndex(path string, index []uint64) error {
+	buf := make([]byte, 0, len(pageIndexMagic)+1+16+8*len(index)+4)
+	buf = append(buf, pageIndexMagic...)
+	buf = append(buf, pageIndexVersion)
+	var word [8]byte
+	binary.LittleEndian.PutUint64(word[:], uint64(os.Getpagesize()))
+	buf = append(buf, word[:]...)
+	binary.LittleEndian.PutUint64(word[:], uint64(len(index)))
+	buf = append(buf, word[:]...)
+	for _, h := range index {
+		binary.LittleEndian.PutUint64(word[:], h)
+		buf = append(buf, word[:]...)
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf))
+	buf = append(buf, sum[:]...)
+	return WriteFileAtomic(path, buf, 0644)
+}
+
+func readPageIndex(path string) ([]uint64, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := len(pageIndexMagic) + 1 + 16
+	if len(buf) < header+4 || !bytes.Equal(buf[:len(pageIndexMagic)], []byte(pageIndexMagic)) {
+		return nil, errors.New("not a page index")
+	}
+	body, sum := buf[:len(buf)-4], buf[len(buf)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return nil, errors.New("page index checksum mismatch")
+	}
+	body = body[len(pageIndexMagic):]
+	if body[0] != pageIndexVersion || binary.LittleEndian.Uint64(body[1:9]) != uint64(os.Getpagesize()) {
+		return nil, errors.New("unsupported page index version")
+	}
+	count := binary.LittleEndian.Uint64(body[9:17])
+	body = body[17:]
+	if uint64(len(body)) != 8*count {
+		return nil, errors.New("page index truncated")
+	}
+	index := make([]uint64, count)
+	for i := range index {
+		index[i] = binary.LittleEndian.Uint64(body[8*i:])
+	}
+	return index, nil
+}
+
+// storedChecksums returns the checksums of the snapshot files that are on
+// disk. The mem file of a deduplicated or compressed snapshot is only there
+// while it is in use.
+func (snapshot *Snapshot) storedChecksums() map[string]FileChecksum {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	checksums := make(map[string]FileChecksum, len(snapshot.Checksums))
+	for file, sum := range snapshot.Checksums {
+		checksums[file] = sum
+	}
+	if snapshot.Deduped || snapshot.Compressed {
+		if _, err := os.Stat(snapshot.MemFilePath); os.IsNotExist(err) {
+			delete(checksums, fileMem)
+		}
+	}
+	return checksums
+}
+
+// checkSizes compares the sizes of the snapshot files with the recorded ones,
+// which catches truncated files cheaply.
+func (snapshot *Snapshot) checkSizes(checksums map[string]FileChecksum) error {
+	for file, sum := range checksums {
+		path := snapshot.filePath(file)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%v file: %v", file, err)
+		}
+		if fi.Size() != sum.Size {
+			return fmt.Errorf("%v file %v has %d bytes, recorded %d", file, path, fi.Size(), sum.Size)
+		}
+	}
+	return nil
+}
+
+// Verify checks the snapshot files against their recorded checksums and
+// returns the number of files and pages checked. With a sample ratio in
+// (0, 1), only that ratio of mem and ws file pages is checked against the
+// page index and the other files but the snapshot file are checked by size.
+func (snapshot *Snapshot) Verify(sample float64) (int, int, error) {
+	checksums := snapshot.storedChecksums()
+	snapshot.Lock()
+	wsRegions := snapshot.wsRegions
+	empty := len(snapshot.Checksums) == 0
+	snapshot.Unlock()
+	if empty {
+		return 0, 0, errNoChecksums
+	}
+	if err := snapshot.checkSizes(checksums); err != nil {
+		return 0, 0, err
+	}
+
+	full := sample <= 0 || sample >= 1
+	files := 0
+	for file, sum := range checksums {
+		if !full && file != fileSnapshot {
+			continue
+		}
+		path := snapshot.filePath(file)
+		got, _, err := hashFile(path, false)
+		if err != nil {
+			return files, 0, fmt.Errorf("%v file: %v", file, err)
+		}
+		if got.Sha256 != sum.Sha256 {
+			return files, 0, fmt.Errorf("%v file %v does not match its checksum", file, path)
+		}
+		files += 1
+	}
+	if full {
+		return files, 0, nil
+	}
+
+	if _, ok := checksums[fileMem]; !ok {
+		return files, 0, nil
+	}
+	index, err := readPageIndex(snapshot.pageIndexPath())
+	if err != nil {
+		return files, 0, fmt.Errorf("page index: %v", err)
+	}
+	pages, err := verifyPages(snapshot.MemFilePath, index, nil, sample)
+	if err != nil {
+		return files, pages, fmt.Errorf("mem file: %v", err)
+	}
+	if _, ok := checksums[fileWs]; ok && len(wsRegions) > 0 {
+		// the ws file holds the pages of the ws regions back to back
+		wsPages := []int{}
+		for _, region := range wsRegions {
+			for page := region[0]; page < region[0]+region[1]; page++ {
+				wsPages = append(wsPages, page)
+			}
+		}
+		n, err := verifyPages(snapshot.WsFile, index, wsPages, sample)
+		pages += n
+		if err != nil {
+			return files, pages, fmt.Errorf("ws file: %v", err)
+		}
+	}
+	return files, pages, nil
+}
+
+// verifyPages checks a random sample of the pages of a file against the page
+// index of the mem file. Page i of the file is page memPages[i] of the mem
+// file, or page i if memPages is nil.
+func verifyPages(path string, index []uint64, memPages []int, sample float64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	count := len(index)
+	if memPages != nil {
+		count = len(memPages)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	n := int(float64(count) * sample)
+	if n < 1 {
+		n = 1
+	}
+	pagesize := os.Getpagesize()
+	page := make([]byte, pagesize)
+	for i := 0; i < n; i++ {
+		filePage := rand.Intn(count)
+		memPage := filePage
+		if memPages != nil {
+			memPage = memPages[filePage]
+		}
+		if memPage >= len(index) {
+			return i, fmt.Errorf("page %d is out of the mem file", memPage)
+		}
+		read, err := f.ReadAt(page, int64(filePage)*int64(pagesize))
+		if err != nil && err != io.EOF {
+			return i, err
+		}
+		if crc64.Checksum(page[:read], pageTable) != index[memPage] {
+			return i, fmt.Errorf("page %d does not match its hash", filePage)
+		}
+	}
+	return n, nil
+}
+
+// verifyBeforeUse checks a snapshot if verification is enabled. Snapshots
+// without checksums are let through.
+func (sm *SnapshotManager) verifyBeforeUse(snapshot *Snapshot) error {
+	if !sm.config.Verify.Enabled {
+		return nil
+	}
+	_, pages, err := snapshot.Verify(sm.config.Verify.Sample)
+	if err == errNoChecksums {
+		log.Println("snapshot", snapshot.SnapshotId, "has no checksums, not verified")
+		return nil
+	}
+	if err != nil {
+		log.Println("snapshot", snapshot.SnapshotId, "failed verification:", err)
+		return fmt.Errorf("snapshot %v is corrupted: %v", snapshot.SnapshotId, err)
+	}
+	log.Println("snapshot", snapshot.SnapshotId, "verified,", pages, "pages sampled")
+	return nil
+}
+
+// VerifySnapshot checks a snapshot against its checksums, which are recorded
+// first if record is set.
+func (sm *SnapshotManager) VerifySnapshot(ssID string, sample float64, record bool) (int, int, error) {
+	snapshot, ok := sm.Lookup(ssID)
+	if !ok {
+		log.Println("snapshot", ssID, "not exists")
+		return 0, 0, errors.New("snapshot not exists")
+	}
+	if record {
+		files := []string{fileSnapshot, fileDiff, fileWs}
+		if snapshot.compressed() {
+			files = append(files, fileCompressed)
+		}
+		if _, err := os.Stat(snapshot.MemFilePath); err == nil { // diff snapshots may not be merged yet
+			files = append(files, fileMem)
+		}
+		if err := snapshot.recordChecksums(files...); err != nil {
+			return 0, 0, err
+		}
+		if err := snapshot.save(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return snapshot.Verify(sample)
+}
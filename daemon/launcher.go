@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	LauncherFirecracker = "firecracker" // exec firecracker under `ip netns exec`
+	LauncherFake        = "fake"        // in-process fake serving the API subset faasnap uses
+)
+
+// VMMProcess is a running VMM.
+type VMMProcess interface {
+	Pid() int // 0 if the VMM has no process of its own
+	// Rss returns the resident memory of the VMM in KiB.
+	Rss() (int, error)
+	Signal(sig os.Signal) error
+	// Wait blocks until the VMM exits.
+	Wait() error
+}
+
+// LaunchSpec describes a VMM to start.
+type LaunchSpec struct {
+	Namespace  string    // network namespace
+	Executable string    // firecracker binary
+	ApiSock    string    // unix socket serving the firecracker API
+	VmPath     string    // directory for stdout and stderr
+	Args       []string  // extra firecracker arguments
+	Config     *VmConfig // boot config; nil for a VMM that waits for a snapshot
+}
+
+// Launcher starts VMM processes.
+type Launcher interface {
+	Launch(ctx context.Context, spec *LaunchSpec) (VMMProcess, error)
+}
+
+func newLauncher(config *Config) Launcher {
+	if config.Launcher == LauncherFake {
+		return &fakeLauncher{}
+	}
+	return &execLauncher{}
+}
+
+// execLauncher runs firecracker in the VM's network namespace.
+type execLauncher struct{}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *execProcess) Rss() (int, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(p.Pid()) + "/smaps_rollup")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if strings.HasPrefix(line, "Rss:") {
+			fields := strings.Fields(line)
+			return strconv.Atoi(fields[len(fields)-2])
+		}
+	}
+	return 0, errors.New("rss not found")
+}
+
+func (p *execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *execProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+func (l *execLauncher) Launch(ctx context.Context, spec *LaunchSpec) (VMMProcess, error) {
+	outFile, err := os.Create(spec.VmPath + "/stdout")
+	if err != nil {
+		return nil, err
+	}
+	errFile, err := os.Create(spec.VmPath + "/stderr")
+	if err != nil {
+		return nil, err
+	}
+
+	ip := "/bin/ip"
+	cmd := &exec.Cmd{
+		Path: ip,
+		Args: append([]string{
+			ip,
+			"netns",
+			"exec",
+			spec.Namespace,
+			spec.Executable,
+			"--api-sock", spec.ApiSock,
+		}, spec.Args...),
+		Dir:    spec.VmPath, // relative sockets, e.g. vsock, are created here
+		Stdout: outFile,
+		Stderr: errFile,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd: cmd}, nil
+}
@@ -0,0 +1,251 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/ucsdsysnet/faasnap/models"
+
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// start types of invocations
+const (
+	startCold     = "cold"
+	startWarm     = "warm"
+	startSnapshot = "snapshot"
+	startReap     = "reap"
+	startWsFile   = "wsfile"
+)
+
+var (
+	keyFunction, _ = tag.NewKey("function")
+	keyStart, _    = tag.NewKey("start")
+	keyStatus, _   = tag.NewKey("status")
+
+	invocationLatency = stats.Float64("invocation_latency", "Invocation latency", stats.UnitMilliseconds)
+
+	invocationViews = []*view.View{
+		{
+			Name:        "invocations",
+			Description: "Invocations by function, start type and status",
+			Measure:     invocationLatency,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{keyFunction, keyStart, keyStatus},
+		},
+		{
+			Name:        "invocation_latency",
+			Description: "Invocation latency by function and start type",
+			Measure:     invocationLatency,
+			Aggregation: view.Distribution(1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000),
+			TagKeys:     []tag.Key{keyFunction, keyStart},
+		},
+	}
+)
+
+var promExporter *prometheus.Exporter
+
+// setupMetrics exports the opencensus views and the daemon gauges for
+// MetricsHandler.
+func setupMetrics() {
+	promExporter = registerPrometheus()
+	if err := view.Register(invocationViews...); err != nil {
+		log.Println("Failed to register invocation views:", err)
+	}
+	metricproducer.GlobalManager().AddProducer(daemonMetrics{})
+}
+
+// MetricsHandler serves the metrics in the Prometheus format.
+func MetricsHandler() http.Handler {
+	return promExporter
+}
+
+// startType returns how an invocation starts its VM.
+func startType(invoc *models.Invocation) string {
+	switch {
+	case invoc.VMID != "":
+		return startWarm
+	case invoc.SsID == "":
+		return startCold
+	default:
+		return restoreMode(invoc)
+	}
+}
+
+func recordInvocation(function, start string, err error, d time.Duration) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	stats.RecordWithTags(context.Background(), []tag.Mutator{
+		tag.Upsert(keyFunction, function),
+		tag.Upsert(keyStart, start),
+		tag.Upsert(keyStatus, status),
+	}, invocationLatency.M(float64(d)/float64(time.Millisecond)))
+}
+
+// daemonMetrics reads gauges of the daemon state on every scrape.
+type daemonMetrics struct{}
+
+func (daemonMetrics) Read() []*metricdata.Metric {
+	now := time.Now()
+
+	var vmmPool int64
+	vmStates := map[string]int64{
+		vmStateRunning:  0,
+		vmStateBusy:     0,
+		vmStateIdle:     0,
+		vmStateStopping: 0,
+	}
+	vmController.Lock()
+	for _, vm := range vmController.Machines {
+		vmStates[vm.State]++
+	}
+	vmmPool = int64(len(vmController.VMMPool))
+	vmController.Unlock()
+
+	ssManager.Lock()
+	snapshots := make([]*Snapshot, 0, len(ssManager.Snapshots))
+	for _, snap := range ssManager.Snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	ssManager.Unlock()
+
+	vms := gauge("vms", "VMs by state", metricdata.UnitDimensionless, "state")
+	for state, n := range vmStates {
+		vms.add(now, n, state)
+	}
+	pool := gauge("vmm_pool_size", "VMMs started ahead of invocations", metricdata.UnitDimensionless)
+	pool.add(now, vmmPool)
+
+	disk := gauge("snapshot_disk_bytes", "Disk space used by snapshot files", metricdata.UnitBytes, "snapshot")
+	ws := gauge("working_set_bytes", "Size of snapshot working set files", metricdata.UnitBytes, "snapshot", "kind")
+	cached := gauge("mem_file_cached_bytes", "Page cache resident part of snapshot memory files", metricdata.UnitBytes, "snapshot")
+	for _, snap := range snapshots {
+		id := snap.SnapshotId
+		reapWs := snap.SnapshotBase + "/working_set"
+		disk.add(now, diskUsage(snap.MemFilePath)+diskUsage(snap.compressedPath())+diskUsage(snap.DiffFilePath)+diskUsage(snap.SnapshotPath)+diskUsage(snap.WsFile)+diskUsage(reapWs), id)
+		ws.add(now, fileSize(snap.WsFile), id, startWsFile)
+		ws.add(now, fileSize(reapWs), id, startReap)
+		cached.add(now, residentBytes(snap.MemFilePath), id)
+	}
+
+	stored, refs := ssManager.pages.Stats()
+	store := gauge("page_store_pages", "Pages in the page store, and references to them from deduplicated snapshots", metricdata.UnitDimensionless, "kind")
+	store.add(now, stored, "stored")
+	store.add(now, refs, "referenced")
+	storeDisk := gauge("page_store_disk_bytes", "Disk space used by the page store", metricdata.UnitBytes)
+	storeDisk.add(now, diskUsage(ssManager.pages.dataPath()))
+
+	return []*metricdata.Metric{vms.Metric, pool.Metric, disk.Metric, ws.Metric, cached.Metric, store.Metric, storeDisk.Metric}
+}
+
+type gaugeMetric struct {
+	*metricdata.Metric
+}
+
+func gauge(name, description string, unit metricdata.Unit, labels ...string) gaugeMetric {
+	keys := make([]metricdata.LabelKey, len(labels))
+	for i, l := range labels {
+		keys[i] = metricdata.LabelKey{Key: l}
+	}
+	return gaugeMetric{&metricdata.Metric{
+		Descriptor: metricdata.Descriptor{
+			Name:        name,
+			Description: description,
+			Unit:        unit,
+			Type:        metricdata.TypeGaugeInt64,
+			LabelKeys:   keys,
+		},
+	}}
+}
+
+func (g gaugeMetric) add(now time.Time, v int64, labels ...string) {
+	values := make([]metricdata.LabelValue, len(labels))
+	for i, l := range labels {
+		values[i] = metricdata.NewLabelValue(l)
+	}
+	g.TimeSeries = append(g.TimeSeries, &metricdata.TimeSeries{
+		LabelValues: values,
+		Points:      []metricdata.Point{metricdata.NewInt64Point(now, v)},
+		StartTime:   now,
+	})
+}
+
+// diskUsage returns the bytes allocated to a possibly sparse file.
+func diskUsage(path string) int64 {
+	var st syscall.Stat_t
+	if path == "" || syscall.Stat(path, &st) != nil {
+		return 0
+	}
+	return st.Blocks * 512
+}
+
+func fileSize(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// residentBytes returns how much of a file is in the page cache.
+func residentBytes(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	pages, err := FileMincore(f, fi.Size())
+	if err != nil {
+		return 0
+	}
+	var n int64
+	for _, resident := range pages {
+		if resident {
+			n++
+		}
+	}
+	return n * int64(os.Getpagesize())
+}
@@ -0,0 +1,549 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// The page store keeps the pages of deduplicated mem files once each. Page
+// slot i is at offset i*pagesize of its pages file. Slot 0 is the zero page
+// and is never written. The index file holds the SHA-256 of the page in each
+// slot, zero for free slots:
+//
+//	magic "FSSTORE" | version byte | page size, 8 bytes | slot count, 8 bytes |
+//	SHA-256 of each slot, 32 bytes each | CRC-32 (IEEE) of everything before it, 4 bytes
+//
+// The page map of a deduplicated snapshot holds the slot of each page of its
+// mem file:
+//
+//	magic "FSPGMAP" | version byte | page size, 8 bytes | page count, 8 bytes |
+//	slots, 4 bytes each | CRC-32 (IEEE) of everything before it, 4 bytes
+//
+// All integers are little endian. References are not stored, they are counted
+// from the page maps when the daemon starts, so pages left behind by a crash
+// are freed then.
+const (
+	pageStoreMagic   = "FSSTORE"
+	pageStoreVersion = 1
+	pageMapMagic     = "FSPGMAP"
+	pageMapVersion   = 1
+)
+
+type pageSum [sha256.Size]byte
+
+// PageStore is a content-addressed store of the mem file pages of
+// deduplicated snapshots.
+type PageStore struct {
+	sync.Mutex
+	dir   string
+	sums  []pageSum // by slot
+	refs  []uint32  // by slot
+	slots map[pageSum]uint32
+	free  []uint32
+}
+
+func NewPageStore(dir string) *PageStore {
+	return &PageStore{
+		dir:   dir,
+		sums:  make([]pageSum, 1),
+		refs:  make([]uint32, 1),
+		slots: map[pageSum]uint32{},
+	}
+}
+
+func (ps *PageStore) dataPath() string {
+	return ps.dir + "/pages"
+}
+
+func (ps *PageStore) indexPath() string {
+	return ps.dir + "/index"
+}
+
+// load reads the index of the store and takes the references of the page
+// maps, by snapshot id. The ids of page maps referring to missing pages are
+// returned. Pages no page map refers to are freed.
+func (ps *PageStore) load(pageMaps map[string][]uint32) ([]string, error) {
+	ps.Lock()
+	defer ps.Unlock()
+	buf, err := ioutil.ReadFile(ps.indexPath())
+	if os.IsNotExist(err) {
+		buf, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if buf != nil {
+		count, body, err := openTable(buf, pageStoreMagic, pageStoreVersion, sha256.Size)
+		if err != nil {
+			return nil, fmt.Errorf("page store index: %v", err)
+		}
+		if count == 0 {
+			return nil, errors.New("page store index has no zero page")
+		}
+		ps.sums = make([]pageSum, count)
+		for i := range ps.sums {
+			copy(ps.sums[i][:], body[i*sha256.Size:])
+		}
+	}
+	ps.refs = make([]uint32, len(ps.sums))
+
+	broken := []string{}
+	for id, pages := range pageMaps {
+		ok := true
+		for _, slot := range pages {
+			if int(slot) >= len(ps.sums) || (slot != 0 && ps.sums[slot] == pageSum{}) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			broken = append(broken, id)
+			continue
+		}
+		for _, slot := range pages {
+			if slot != 0 {
+				ps.refs[slot]++
+			}
+		}
+	}
+
+	data, err := os.OpenFile(ps.dataPath(), os.O_RDWR, 0644)
+	if err != nil && !os.IsNotExist(err) {
+		return broken, err
+	}
+	freed := 0
+	for slot := 1; slot < len(ps.sums); slot++ {
+		if ps.refs[slot] > 0 {
+			ps.slots[ps.sums[slot]] = uint32(slot)
+			continue
+		}
+		if ps.sums[slot] != (pageSum{}) {
+			ps.sums[slot] = pageSum{}
+			if data != nil {
+				punchPage(data, uint32(slot))
+			}
+			freed++
+		}
+		ps.free = append(ps.free, uint32(slot))
+	}
+	if data != nil {
+		data.Close()
+	}
+	if freed > 0 {
+		log.Println("freed", freed, "unreferenced pages of the page store")
+		return broken, ps.saveIndex()
+	}
+	return broken, nil
+}
+
+// saveIndex writes the index. Callers must hold the lock of ps.
+func (ps *PageStore) saveIndex() error {
+	entries := make([]byte, 0, len(ps.sums)*sha256.Size)
+	for _, sum := range ps.sums {
+		entries = append(entries, sum[:]...)
+	}
+	return WriteFileAtomic(ps.indexPath(), sealTable(pageStoreMagic, pageStoreVersion, len(ps.sums), entries), 0644)
+}
+
+// openData opens the pages file, creating it with the zero page.
+func (ps *PageStore) openData() (*os.File, error) {
+	if err := os.MkdirAll(ps.dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(ps.dataPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() < int64(os.Getpagesize()) {
+		if err := f.Truncate(int64(os.Getpagesize())); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Add stores the pages of a file that are not in the store yet and returns
+// the slot of each page. The file holds a reference to each of its pages
+// until they are released.
+func (ps *PageStore) Add(path string) ([]uint32, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+	data, err := ps.openData()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer data.Close()
+
+	pagesize := os.Getpagesize()
+	pages := make([]uint32, (fi.Size()+int64(pagesize)-1)/int64(pagesize))
+	zeros := make([]byte, pagesize)
+	buf := make([]byte, 256*pagesize)
+	added, page := 0, 0
+	fail := func(err error) ([]uint32, int, error) {
+		ps.drop(data, pages[:page])
+		ps.saveIndex()
+		return nil, 0, err
+	}
+	for page < len(pages) {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fail(err)
+		}
+		if n == 0 {
+			return fail(fmt.Errorf("%v ends at page %d of %d", path, page, len(pages)))
+		}
+		for off := 0; off < n && page < len(pages); off, page = off+pagesize, page+1 {
+			content := buf[off:n]
+			if len(content) > pagesize {
+				content = content[:pagesize]
+			}
+			if len(content) < pagesize { // pad the last page
+				content = append(append([]byte{}, content...), zeros[len(content):]...)
+			}
+			if bytes.Equal(content, zeros) {
+				pages[page] = 0
+				continue
+			}
+			sum := pageSum(sha256.Sum256(content))
+			slot, ok := ps.slots[sum]
+			if !ok {
+				slot = ps.alloc(sum)
+				if _, err := data.WriteAt(content, int64(slot)*int64(pagesize)); err != nil {
+					ps.freeSlot(data, slot)
+					return fail(err)
+				}
+				added++
+			}
+			ps.refs[slot]++
+			pages[page] = slot
+		}
+	}
+	if err := data.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := ps.saveIndex(); err != nil {
+		return fail(err)
+	}
+	return pages, added, nil
+}
+
+// alloc returns a free slot for a page. Callers must hold the lock of ps.
+func (ps *PageStore) alloc(sum pageSum) uint32 {
+	var slot uint32
+	if n := len(ps.free); n > 0 {
+		slot, ps.free = ps.free[n-1], ps.free[:n-1]
+		ps.sums[slot] = sum
+	} else {
+		slot = uint32(len(ps.sums))
+		ps.sums = append(ps.sums, sum)
+		ps.refs = append(ps.refs, 0)
+	}
+	ps.slots[sum] = slot
+	return slot
+}
+
+// Release drops the references of a page map. Pages that are no longer
+// referenced are freed.
+func (ps *PageStore) Release(pages []uint32) error {
+	ps.Lock()
+	defer ps.Unlock()
+	data, err := os.OpenFile(ps.dataPath(), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	ps.drop(data, pages)
+	return ps.saveIndex()
+}
+
+// drop drops the references of pages. Callers must hold the lock of ps.
+func (ps *PageStore) drop(data *os.File, pages []uint32) {
+	for _, slot := range pages {
+		if slot == 0 || int(slot) >= len(ps.refs) || ps.refs[slot] == 0 {
+			continue
+		}
+		ps.refs[slot]--
+		if ps.refs[slot] == 0 {
+			ps.freeSlot(data, slot)
+		}
+	}
+}
+
+// freeSlot frees a slot that is no longer referenced. Callers must hold the
+// lock of ps.
+func (ps *PageStore) freeSlot(data *os.File, slot uint32) {
+	delete(ps.slots, ps.sums[slot])
+	ps.sums[slot] = pageSum{}
+	ps.free = append(ps.free, slot)
+	punchPage(data, slot)
+}
+
+// punchPage gives the disk space of a slot back to the file system.
+func punchPage(data *os.File, slot uint32) {
+	pagesize := int64(os.Getpagesize())
+	if err := unix.Fallocate(int(data.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, int64(slot)*pagesize, pagesize); err != nil {
+		log.Println("punching page", slot, "of the page store failed:", err)
+	}
+}
+
+// Materialize writes the file of size bytes a page map was made of to path.
+// Zero pages are left as holes.
+func (ps *PageStore) Materialize(pages []uint32, path string, size int64) error {
+	data, err := os.Open(ps.dataPath())
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	pagesize := int64(os.Getpagesize())
+	buf := make([]byte, 256*pagesize)
+	for page := 0; page < len(pages); {
+		if pages[page] == 0 {
+			page++
+			continue
+		}
+		// copy runs of pages that are contiguous in the store at once
+		run := 1
+		for page+run < len(pages) && run < 256 && pages[page+run] == pages[page]+uint32(run) {
+			run++
+		}
+		length := int64(run) * pagesize
+		if rest := size - int64(page)*pagesize; length > rest {
+			length = rest
+		}
+		if _, err := data.ReadAt(buf[:length], int64(pages[page])*pagesize); err != nil {
+			return fmt.Errorf("reading page %d of the page store: %v", pages[page], err)
+		}
+		if _, err := f.WriteAt(buf[:length], int64(page)*pagesize); err != nil {
+			return err
+		}
+		page += run
+	}
+	return f.Sync()
+}
+
+// Stats returns the number of pages in the store and the number of
+// references to them.
+func (ps *PageStore) Stats() (int64, int64) {
+	ps.Lock()
+	defer ps.Unlock()
+	var refs int64
+	for _, n := range ps.refs {
+		refs += int64(n)
+	}
+	return int64(len(ps.slots)), refs
+}
+
+func (snapshot *Snapshot) pageMapPath() string {
+	return snapshot.SnapshotBase + "/" + snapshot.SnapshotId + ".pagemap"
+}
+
+func writePageMap(path string, pages []uint32) error {
+	entries := make([]byte, 4*len(pages))
+	for i, slot := range pages {
+		binary.LittleEndian.PutUint32(entries[4*i:], slot)
+	}
+	return WriteFileAtomic(path, sealTable(pageMapMagic, pageMapVersion, len(pages), entries), 0644)
+}
+
+func readPageMap(path string) ([]uint32, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	count, body, err := openTable(buf, pageMapMagic, pageMapVersion, 4)
+	if err != nil {
+		return nil, fmt.Errorf("page map: %v", err)
+	}
+	pages := make([]uint32, count)
+	for i := range pages {
+		pages[i] = binary.LittleEndian.Uint32(body[4*i:])
+	}
+	return pages, nil
+}
+
+// sealTable frames the entries of a table with its header and checksum.
+func sealTable(magic string, version byte, count int, entries []byte) []byte {
+	buf := make([]byte, 0, len(magic)+1+16+len(entries)+4)
+	buf = append(buf, magic...)
+	buf = append(buf, version)
+	var word [8]byte
+	binary.LittleEndian.PutUint64(word[:], uint64(os.Getpagesize()))
+	buf = append(buf, word[:]...)
+	binary.LittleEndian.PutUint64(word[:], uint64(count))
+	buf = append(buf, word[:]...)
+	buf = append(buf, entries...)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf))
+	return append(buf, sum[:]...)
+}
+
+// openTable checks the header and checksum of a table and returns its entry
+// count and entries.
+func openTable(buf []byte, magic string, version byte, entrySize int) (int, []byte, error) {
+	header := len(magic) + 1 + 16
+	if len(buf) < header+4 || !bytes.Equal(buf[:len(magic)], []byte(magic)) {
+		return 0, nil, errors.New("bad magic")
+	}
+	body, sum := buf[:len(buf)-4], buf[len(buf)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return 0, nil, errors.New("checksum mismatch")
+	}
+	body = body[len(magic):]
+	if body[0] != version || binary.LittleEndian.Uint64(body[1:9]) != uint64(os.Getpagesize()) {
+		return 0, nil, errors.New("unsupported version")
+	}
+	count := binary.LittleEndian.Uint64(body[9:17])
+	body = body[17:]
+	if uint64(len(body)) != uint64(entrySize)*count {
+		return 0, nil, errors.New("truncated")
+	}
+	return int(count), body, nil
+}
+
+// DedupSnapshot moves the mem file of a snapshot into the page store. The mem
+// file is rebuilt from the store when it is needed, and removed again by
+// deduplicating the snapshot once more.
+func (sm *SnapshotManager) DedupSnapshot(ssID string) error {
+	snapshot, ok := sm.Lookup(ssID)
+	if !ok {
+		log.Println("snapshot", ssID, "not exists")
+		return errors.New("snapshot not exists")
+	}
+	if snapshot.compressed() {
+		log.Println("snapshot", ssID, "is compressed")
+		return errors.New("snapshot is compressed")
+	}
+	if err := sm.MergeLayers(snapshot); err != nil {
+		return err
+	}
+	snapshot.merging.Lock()
+	defer snapshot.merging.Unlock()
+
+	if !snapshot.deduped() {
+		if err := sm.verifyBeforeUse(snapshot); err != nil {
+			return err
+		}
+		pages, added, err := sm.pages.Add(snapshot.MemFilePath)
+		if err != nil {
+			log.Println("adding", snapshot.MemFilePath, "to the page store failed:", err)
+			return err
+		}
+		if err := writePageMap(snapshot.pageMapPath(), pages); err != nil {
+			log.Println("writing page map of", ssID, "failed:", err)
+			sm.pages.Release(pages)
+			return err
+		}
+		snapshot.Lock()
+		snapshot.Deduped = true
+		snapshot.Unlock()
+		if err := snapshot.save(); err != nil {
+			return err
+		}
+		log.Println("deduplicated snapshot", ssID, "with", len(pages), "pages,", added, "new")
+	}
+
+	sm.Lock()
+	shared := false
+	for _, other := range sm.Snapshots {
+		if other != snapshot && other.MemFilePath == snapshot.MemFilePath {
+			shared = true
+		}
+	}
+	sm.Unlock()
+	if shared {
+		log.Println("keeping", snapshot.MemFilePath, "shared with other snapshots")
+		return nil
+	}
+	if err := os.Remove(snapshot.MemFilePath); err != nil && !os.IsNotExist(err) {
+		log.Println("removing", snapshot.MemFilePath, "failed:", err)
+		return err
+	}
+	return nil
+}
+
+// materialize rebuilds the mem file of a deduplicated snapshot from the page
+// store. Callers must hold the merging lock of snapshot.
+func (sm *SnapshotManager) materialize(snapshot *Snapshot) error {
+	pages, err := readPageMap(snapshot.pageMapPath())
+	if err != nil {
+		log.Println("reading page map of", snapshot.SnapshotId, "failed:", err)
+		return err
+	}
+	tmp := snapshot.MemFilePath + ".tmp"
+	if err := sm.pages.Materialize(pages, tmp, int64(snapshot.Size)); err != nil {
+		log.Println("rebuilding", snapshot.MemFilePath, "failed:", err)
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, snapshot.MemFilePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Println("rebuilt the mem file of snapshot", snapshot.SnapshotId, "from the page store")
+	return nil
+}
+
+// deduped reports whether the mem file pages of the snapshot are in the page
+// store.
+func (snapshot *Snapshot) deduped() bool {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	return snapshot.Deduped
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePages writes a file of the given pages to dir. A nil page is a zero
+// page; the last page may be short.
+func writePages(t *testing.T, dir, name string, pages ...[]byte) (string, []byte) {
+	t.Helper()
+	pagesize := os.Getpagesize()
+	var content []byte
+	for _, page := range pages {
+		if page == nil {
+			page = make([]byte, pagesize)
+		}
+		content = append(content, page...)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, content
+}
+
+func fillPage(b byte) []byte {
+	return bytes.Repeat([]byte{b}, os.Getpagesize())
+}
+
+func checkStats(t *testing.T, ps *PageStore, pages, refs int64) {
+	t.Helper()
+	if gotPages, gotRefs := ps.Stats(); gotPages != pages || gotRefs != refs {
+		t.Fatalf("store has %d pages and %d references, want %d and %d", gotPages, gotRefs, pages, refs)
+	}
+}
+
+// TestPageStore dedups two files sharing pages, releases one, reloads the
+// store and rebuilds the other.
+func TestPageStore(t *testing.T) {
+	dir := t.TempDir()
+	shared, onlyA, onlyB := fillPage(1), fillPage(2), fillPage(3)
+	pathA, _ := writePages(t, dir, "a", onlyA, shared, nil, fillPage(4), []byte("short last page"))
+	pathB, contentB := writePages(t, dir, "b", shared, onlyB, onlyA, nil, fillPage(5), []byte("another short page"))
+
+	ps := NewPageStore(filepath.Join(dir, "store"))
+	pagesA, added, err := ps.Add(pathA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 4 || len(pagesA) != 5 || pagesA[2] != 0 {
+		t.Fatalf("added %d pages with page map %v", added, pagesA)
+	}
+	pagesB, added, err := ps.Add(pathB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 || pagesB[0] != pagesA[1] || pagesB[2] != pagesA[0] || pagesB[3] != 0 {
+		t.Fatalf("added %d pages with page map %v, first file %v", added, pagesB, pagesA)
+	}
+	checkStats(t, ps, 7, 9)
+
+	mapB := filepath.Join(dir, "b.pagemap")
+	if err := writePageMap(mapB, pagesB); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPageMap(mapB); err != nil || !equalSlots(got, pagesB) {
+		t.Fatalf("page map read back as %v, %v, want %v", got, err, pagesB)
+	}
+
+	if err := ps.Release(pagesA); err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, ps, 5, 5)
+	// the slots freed are reused
+	pagesA, added, err = ps.Add(pathA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Fatalf("added %d pages again, want 2", added)
+	}
+	for _, slot := range pagesA {
+		if slot > 7 {
+			t.Fatalf("page map %v does not reuse the freed slots", pagesA)
+		}
+	}
+	checkStats(t, ps, 7, 9)
+
+	// the first file is gone when the daemon starts again, its pages are freed
+	reloaded := NewPageStore(ps.dir)
+	broken, err := reloaded.load(map[string][]uint32{"b": pagesB})
+	if err != nil || len(broken) != 0 {
+		t.Fatalf("loading the store: broken %v, %v", broken, err)
+	}
+	checkStats(t, reloaded, 5, 5)
+	if broken, err := NewPageStore(ps.dir).load(map[string][]uint32{"a": pagesA, "b": pagesB}); err != nil || len(broken) != 1 || broken[0] != "a" {
+		t.Fatalf("page map of freed pages not reported broken: %v, %v", broken, err)
+	}
+
+	out := filepath.Join(dir, "b.rebuilt")
+	if err := reloaded.Materialize(pagesB, out, int64(len(contentB))); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt, contentB) {
+		t.Fatal("rebuilt file differs")
+	}
+
+	index, err := ioutil.ReadFile(reloaded.indexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index[len(index)/2] ^= 1
+	if err := ioutil.WriteFile(reloaded.indexPath(), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPageStore(ps.dir).load(nil); err == nil {
+		t.Fatal("loaded a corrupted index")
+	}
+}
+
+func equalSlots(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPageStoreTable(t *testing.T) {
+	entries := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	table := sealTable(pageMapMagic, pageMapVersion, 2, entries)
+	count, body, err := openTable(table, pageMapMagic, pageMapVersion, 4)
+	if err != nil || count != 2 || !bytes.Equal(body, entries) {
+		t.Fatalf("opened %d entries %v, %v", count, body, err)
+	}
+	for name, bad := range map[string][]byte{
+		"magic":     sealTable(pageStoreMagic, pageMapVersion, 2, entries),
+		"version":   sealTable(pageMapMagic, pageMapVersion+1, 2, entries),
+		"count":     sealTable(pageMapMagic, pageMapVersion, 3, entries),
+		"truncated": table[:len(table)/2],
+		"corrupted": append(append([]byte{}, table[:20]...), append([]byte{table[20] ^ 1}, table[21:]...)...),
+	} {
+		if _, _, err := openTable(bad, pageMapMagic, pageMapVersion, 4); err == nil {
+			t.Errorf("opened a table with a bad %v", name)
+		}
+	}
+}
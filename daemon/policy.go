@@ -0,0 +1,367 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ucsdsysnet/faasnap/models"
+	"go.opencensus.io/trace"
+)
+
+const (
+	PolicyVanilla = "vanilla" // restore the full mem file
+	PolicyReap    = "reap"    // restore through REAP with a recorded working set
+	PolicyFaasnap = "faasnap" // restore with overlay regions and a working set file
+
+	policyPreparing = "preparing"
+	policyReady     = "ready"
+	policyFailed    = "failed"
+
+	stopTimeout = 10 * time.Second
+
+	policyBackoff    = 5 * time.Second // after the first failed preparation, doubled after each
+	policyMaxBackoff = 10 * time.Minute
+
+	dropCachesMode = 8 // written to drop_caches in the guest; disables sanitizing
+)
+
+// SnapshotPolicy tells the daemon how to prepare and use a snapshot for
+// invocations that only name the function.
+type SnapshotPolicy struct {
+	Strategy          string `json:"strategy"`
+	Namespace         string `json:"namespace"`         // used when the invocation has none
+	MincoreSize       int    `json:"mincoreSize"`       // faasnap: scan mincore by RSS growth; 0 scans every 100 ms
+	SizeThreshold     int    `json:"sizeThreshold"`     // faasnap: region size threshold
+	IntervalThreshold int    `json:"intervalThreshold"` // faasnap: region interval threshold
+}
+
+func policyFromModel(p *models.SnapshotPolicy) (*SnapshotPolicy, error) {
+	if p == nil {
+		return nil, nil
+	}
+	policy := &SnapshotPolicy{
+		Namespace:         p.Namespace,
+		MincoreSize:       int(p.MincoreSize),
+		SizeThreshold:     int(p.SizeThreshold),
+		IntervalThreshold: int(p.IntervalThreshold),
+	}
+	if p.Strategy != nil {
+		policy.Strategy = *p.Strategy
+	}
+	switch policy.Strategy {
+	case PolicyVanilla, PolicyReap, PolicyFaasnap:
+	default:
+		return nil, fmt.Errorf("unknown snapshot strategy %q", policy.Strategy)
+	}
+	return policy, nil
+}
+
+// policyModel converts the policy to its API representation. Callers must hold
+// the function manager's lock.
+func (fn *Function) policyModel() *models.SnapshotPolicy {
+	if fn.Policy == nil {
+		return nil
+	}
+	strategy := fn.Policy.Strategy
+	state := fn.policyState
+	if fn.PolicySsId != "" {
+		state = policyReady
+	}
+	return &models.SnapshotPolicy{
+		Strategy:          &strategy,
+		Namespace:         fn.Policy.Namespace,
+		MincoreSize:       int64(fn.Policy.MincoreSize),
+		SizeThreshold:     int64(fn.Policy.SizeThreshold),
+		IntervalThreshold: int64(fn.Policy.IntervalThreshold),
+		SsID:              fn.PolicySsId,
+		State:             state,
+	}
+}
+
+// SetPolicy replaces the snapshot policy of a function. The snapshot prepared
+// by the previous policy is deleted. A nil policy disables automatic snapshots.
+func (fm *FunctionManager) SetPolicy(name string, policy *SnapshotPolicy) error {
+	fm.Lock()
+	fn, ok := fm.Functions[name]
+	if !ok {
+		fm.Unlock()
+		return fmt.Errorf("function %v not exists", name)
+	}
+	if fn.policyState == policyPreparing {
+		fm.Unlock()
+		return errors.New("snapshot policy is being prepared")
+	}
+	old := fn.PolicySsId
+	fn.Policy = policy
+	fn.PolicySsId = ""
+	fn.policyState = ""
+	fn.policyFails = 0
+	err := fm.save()
+	fm.Unlock()
+	if err != nil {
+		log.Println("saving functions failed:", err)
+	}
+	if old != "" {
+		if err := DeleteSnapshot(old); err != nil {
+			log.Println("deleting policy snapshot", old, "failed:", err)
+		}
+	}
+	return nil
+}
+
+// policyDone records the result of a policy preparation. A failed
+// preparation is retried by a later invocation after an exponential backoff.
+func (fm *FunctionManager) policyDone(fn *Function, ssId string, err error) {
+	fm.Lock()
+	defer fm.Unlock()
+	if err != nil {
+		backoff := policyBackoff << fn.policyFails
+		if backoff > policyMaxBackoff || backoff <= 0 {
+			backoff = policyMaxBackoff
+		}
+		fn.policyState = policyFailed
+		fn.policyFails++
+		fn.policyRetry = time.Now().Add(backoff)
+		log.Println("retrying the policy of", fn.Name, "in", backoff)
+	} else {
+		fn.policyState = ""
+		fn.policyFails = 0
+		fn.PolicySsId = ssId
+	}
+	if err := fm.save(); err != nil {
+		log.Println("saving functions failed:", err)
+	}
+}
+
+// policyInvocation rewrites an invocation that only names its function to
+// start from the snapshot prepared by the function's policy. It returns false
+// if there is no policy or its snapshot is not ready.
+func policyInvocation(invoc *models.Invocation) bool {
+	fnManager.Lock()
+	fn, ok := fnManager.Functions[*invoc.FuncName]
+	if !ok || fn.Policy == nil || fn.PolicySsId == "" {
+		fnManager.Unlock()
+		return false
+	}
+	policy := *fn.Policy
+	ssId := fn.PolicySsId
+	fnManager.Unlock()
+
+	if _, ok := ssManager.Lookup(ssId); !ok {
+		return false
+	}
+
+	invoc.SsID = ssId
+	if invoc.Namespace == "" {
+		invoc.Namespace = policy.Namespace
+	}
+	switch policy.Strategy {
+	case PolicyVanilla:
+		invoc.UseMemFile = true
+	case PolicyReap:
+		invoc.EnableReap = true
+		invoc.WsSingleRead = true
+	case PolicyFaasnap:
+		invoc.OverlayRegions = true
+		invoc.UseWsFile = true
+	}
+	return true
+}
+
+// claimPolicy returns the function if its policy still has to be prepared and
+// marks the preparation as started. The cold start serving invoc is then used
+// to record the snapshot.
+func claimPolicy(invoc *models.Invocation) *Function {
+	fnManager.Lock()
+	defer fnManager.Unlock()
+	fn, ok := fnManager.Functions[*invoc.FuncName]
+	if !ok || fn.Policy == nil || fn.PolicySsId != "" {
+		return nil
+	}
+	switch fn.policyState {
+	case "":
+	case policyFailed:
+		if time.Now().Before(fn.policyRetry) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	fn.policyState = policyPreparing
+	if invoc.Namespace == "" {
+		invoc.Namespace = fn.Policy.Namespace
+	}
+	return fn
+}
+
+// preparePolicy snapshots the cold-started vmID and runs the record steps of
+// the function's strategy in the background.
+func preparePolicy(req *http.Request, fn *Function, vmID string, invoc *models.Invocation) {
+	ctx := trace.NewContext(context.Background(), trace.FromContext(req.Context()))
+	ssId, err := runPolicy(req.WithContext(ctx), fn, vmID, invoc)
+	if err != nil {
+		log.Println("preparing policy of", fn.Name, "failed:", err)
+	} else {
+		log.Println("policy of", fn.Name, "prepared snapshot", ssId)
+	}
+	fnManager.policyDone(fn, ssId, err)
+}
+
+func stopAndWait(vmID string) error {
+	if err := vmController.StopVM(nil, vmID); err != nil {
+		return err
+	}
+	return vmController.WaitStopped(vmID, stopTimeout)
+}
+
+// runPolicy records the snapshot of the function's strategy from vmID. The
+// snapshots it registers are deleted if it fails, since a retry writes to the
+// same files.
+func runPolicy(req *http.Request, fn *Function, vmID string, first *models.Invocation) (ssId string, err error) {
+	fnManager.Lock()
+	policy := *fn.Policy
+	fnManager.Unlock()
+
+	dir := ssManager.config.BasePath + "/policy_" + fn.Name
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		vmController.StopVM(nil, vmID)
+		return "", err
+	}
+	noMincore := int64(-1)
+	version, err := vmController.snapshotVersion(req.Context(), vmID)
+	if err != nil {
+		vmController.StopVM(nil, vmID)
+		return "", err
+	}
+
+	base, err := TakeSnapshot(req, vmID, "Full", dir+"/base.snapshot", dir+"/base.memfile", version, false, 0, 0)
+	if stopErr := stopAndWait(vmID); stopErr != nil {
+		log.Println("stopping", vmID, "failed:", stopErr)
+	}
+	if err != nil {
+		return "", err
+	}
+	var warm string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, ss := range []string{warm, base} {
+			if ss == "" {
+				continue
+			}
+			if err := DeleteSnapshot(ss); err != nil {
+				log.Println("deleting policy snapshot", ss, "failed:", err)
+			}
+		}
+	}()
+	if err := ChangeSnapshot(req, base, false, false, true, false, false); err != nil {
+		return "", err
+	}
+
+	switch policy.Strategy {
+	case PolicyVanilla:
+		return base, nil
+
+	case PolicyReap:
+		// the first REAP invocation records the working set, which is written
+		// out when the VM is stopped
+		_, vm, _, err := invokeFunction(req, &models.Invocation{
+			FuncName:       first.FuncName,
+			SsID:           base,
+			Params:         first.Params,
+			Mincore:        &noMincore,
+			EnableReap:     true,
+			WsFileDirectIo: true,
+			Namespace:      first.Namespace,
+		}, false)
+		if vm != "" {
+			if err := stopAndWait(vm); err != nil {
+				log.Println("stopping", vm, "failed:", err)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := ChangeReapCacheState(req, base, false); err != nil {
+			return "", err
+		}
+		return base, nil
+
+	case PolicyFaasnap:
+		// record the mincore layers of a snapshot start
+		scanInterval := int64(100)
+		if policy.MincoreSize > 0 {
+			scanInterval = -1
+		}
+		_, vm, _, err := invokeFunction(req, &models.Invocation{
+			FuncName:    first.FuncName,
+			SsID:        base,
+			Params:      first.Params,
+			Mincore:     &scanInterval,
+			MincoreSize: int64(policy.MincoreSize),
+			UseMemFile:  true,
+			Namespace:   first.Namespace,
+		}, false)
+		if snapshot, ok := ssManager.Lookup(base); ok {
+			snapshot.scanWg.Wait()
+		}
+		if err != nil {
+			if vm != "" {
+				stopAndWait(vm)
+			}
+			return "", err
+		}
+		if err := vmController.DropGuestCaches(req.Context(), vm, dropCachesMode); err != nil {
+			log.Println("dropping guest caches failed:", err)
+		}
+		warm, err = TakeSnapshot(req, vm, "Full", dir+"/warm.snapshot", dir+"/warm.memfile", version, true, policy.SizeThreshold, policy.IntervalThreshold)
+		if stopErr := stopAndWait(vm); stopErr != nil {
+			log.Println("stopping", vm, "failed:", stopErr)
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := CopyMincore(req, warm, base); err != nil {
+			return "", err
+		}
+		if err := ChangeMincoreState(req.Context(), warm, 0, false, dir+"/wsfile", false, false, policy.SizeThreshold, policy.IntervalThreshold, nil, true); err != nil {
+			return "", err
+		}
+		if err := ChangeSnapshot(req, warm, false, false, true, false, false); err != nil {
+			return "", err
+		}
+		if err := DeleteSnapshot(base); err != nil {
+			log.Println("deleting base snapshot", base, "failed:", err)
+		}
+		return warm, nil
+	}
+	return "", fmt.Errorf("unknown snapshot strategy %q", policy.Strategy)
+}
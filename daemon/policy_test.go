@@ -0,0 +1,74 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+// waitPolicy waits until the policy of testFunction is prepared or failed.
+func waitPolicy(t *testing.T) (string, string) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		fnManager.Lock()
+		fn := fnManager.Functions[testFunction]
+		ssID, state := fn.PolicySsId, fn.policyState
+		fnManager.Unlock()
+		if ssID != "" || state == policyFailed {
+			return ssID, state
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("policy not prepared in time")
+	return "", ""
+}
+
+// TestPolicyVMMVersion prepares a policy without a configured snapshot
+// version, so it is asked from the cold-started VMM.
+func TestPolicyVMMVersion(t *testing.T) {
+	config := setupTestDaemon(t)
+	config.SnapshotVersion = ""
+	if err := fnManager.SetPolicy(testFunction, &SnapshotPolicy{Strategy: PolicyVanilla}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := InvokeFunction(testRequest(t), testInvocation("", "")); err != nil {
+		t.Fatal(err)
+	}
+	ssID, state := waitPolicy(t)
+	if ssID == "" {
+		t.Fatalf("policy %v", state)
+	}
+	_, vm, _, _, err := InvokeFunction(testRequest(t), testInvocation("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetVM(vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SsID != ssID {
+		t.Errorf("VM restored from %q, want the policy snapshot %q", got.SsID, ssID)
+	}
+}
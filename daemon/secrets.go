@@ -0,0 +1,138 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const redacted = "<redacted>"
+
+// Secret is a string that is redacted when marshalled, e.g. in the /ui/data
+// dump. It unmarshals like a plain string.
+type Secret string
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// Secrets are environment variables for the guest whose values are redacted
+// when marshalled.
+type Secrets map[string]string
+
+func (s Secrets) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Redacted())
+}
+
+func (s Secrets) String() string {
+	return fmt.Sprint(s.Redacted())
+}
+
+// Redacted returns the names of the secrets with their values redacted.
+func (s Secrets) Redacted() map[string]string {
+	if s == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(s))
+	for k := range s {
+		ret[k] = redacted
+	}
+	return ret
+}
+
+// guestEnv returns the environment injected into VMs of function: the Redis
+// settings and secrets from Config, overridden by the function's secrets.
+func guestEnv(config *Config, function string) map[string]string {
+	env := map[string]string{
+		"REDIS_HOST":   config.RedisHost,
+		"REDIS_PASSWD": string(config.RedisPasswd),
+	}
+	for k, v := range config.Secrets {
+		env[k] = v
+	}
+	fnManager.Lock()
+	if fn, ok := fnManager.Functions[function]; ok {
+		for k, v := range fn.Secrets {
+			env[k] = v
+		}
+	}
+	fnManager.Unlock()
+	return env
+}
+
+// agentTimeout bounds the wait for the agent of a booting guest.
+const agentTimeout = 30 * time.Second
+
+// injectEnv sends the guest environment of function to the agent of vm. It is
+// called as the VM is started or restored, before it serves invocations, and
+// waits for the agent of a booting guest to come up.
+func (vc *VMController) injectEnv(ctx context.Context, vm *VM, function string) error {
+	data, err := json.Marshal(guestEnv(vc.config, function))
+	if err != nil {
+		return err
+	}
+	client, base := vc.transport.Client(vm)
+	_, span := trace.StartSpan(ctx, "inject_env")
+	defer span.End()
+	deadline := time.Now().Add(agentTimeout)
+	for {
+		req, err := http.NewRequestWithContext(ctx, "POST", base+"/env", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode > 299 {
+				log.Println("injecting env into", vm.VmId, "response:", resp.Status)
+				return errors.New("injecting env failed")
+			}
+			break
+		}
+		// the agent is not up yet
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			log.Println("injecting env into", vm.VmId, "failed:", err)
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Printf("injected env into %v for function %q\n", vm.VmId, function)
+	return nil
+}
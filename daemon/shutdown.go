@@ -0,0 +1,195 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownTimeout bounds how long Drain waits for in-flight calls and how long
+// Shutdown waits for VMs to exit.
+const ShutdownTimeout = 30 * time.Second
+
+var errShuttingDown = errors.New("daemon is shutting down")
+
+var (
+	callsLock sync.Mutex
+	draining  bool
+	inflight  sync.WaitGroup
+)
+
+// beginCall registers an in-flight call. It fails once the daemon is draining.
+func beginCall() error {
+	callsLock.Lock()
+	defer callsLock.Unlock()
+	if draining {
+		return errShuttingDown
+	}
+	inflight.Add(1)
+	return nil
+}
+
+func endCall() {
+	inflight.Done()
+}
+
+func stopAccepting() {
+	callsLock.Lock()
+	draining = true
+	callsLock.Unlock()
+}
+
+// Drain stops accepting invocations and waits for in-flight calls until
+// timeout. It returns false if calls were still running at the deadline.
+func Drain(timeout time.Duration) bool {
+	stopAccepting()
+	log.Println("draining in-flight calls")
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("all calls finished")
+		return true
+	case <-time.After(timeout):
+		log.Println("calls still running after", timeout)
+		return false
+	}
+}
+
+// Shutdown stops every VM, deactivating its REAP instance so the working set
+// is recorded, and persists the daemon state.
+func Shutdown(timeout time.Duration) {
+	stopAccepting()
+	vmController.StopAll(timeout)
+
+	fnManager.Lock()
+	if err := fnManager.save(); err != nil {
+		log.Println("saving functions failed:", err)
+	}
+	fnManager.Unlock()
+	vmController.Lock()
+	if err := vmController.saveNetworks(); err != nil {
+		log.Println("saving networks failed:", err)
+	}
+	vmController.Unlock()
+	ssManager.Lock()
+	snapshots := make([]*Snapshot, 0, len(ssManager.Snapshots))
+	for _, snapshot := range ssManager.Snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	ssManager.Unlock()
+	for _, snapshot := range snapshots {
+		if err := snapshot.save(); err != nil {
+			log.Println("saving snapshot", snapshot.SnapshotId, "failed:", err)
+		}
+	}
+	flushTracing()
+	log.Println("shutdown complete")
+}
+
+// StopAll stops all VMs and pooled VMMs and kills those that have not exited
+// within timeout.
+func (vc *VMController) StopAll(timeout time.Duration) {
+	vc.Lock()
+	ids := make([]string, 0, len(vc.Machines))
+	for id := range vc.Machines {
+		ids = append(ids, id)
+	}
+	for id := range vc.VMMPool {
+		if _, ok := vc.Machines[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	vc.Unlock()
+
+	for _, id := range ids {
+		if err := vc.StopVM(nil, id); err != nil {
+			log.Println("stopping", id, "failed:", err)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for _, id := range ids {
+		if err := vc.WaitStopped(id, time.Until(deadline)); err != nil {
+			if vm, ok := vc.lookup(id); ok {
+				log.Println("killing", id)
+				vm.process.Signal(syscall.SIGKILL)
+			}
+		}
+	}
+}
+
+// cleanupOrphans kills firecracker processes left by a previous run of the
+// daemon and removes their sockets under basePath.
+func cleanupOrphans(basePath string) {
+	if basePath == "" {
+		return
+	}
+	prefix := filepath.Clean(basePath) + "/"
+	procs, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, path := range procs {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		for i, arg := range args {
+			if arg == "--api-sock" && i+1 < len(args) && strings.HasPrefix(args[i+1], prefix) {
+				pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+				if err != nil || pid == os.Getpid() {
+					break
+				}
+				log.Println("killing orphaned firecracker", pid, "with socket", args[i+1])
+				if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+					log.Println("killing", pid, "failed:", err)
+				}
+				break
+			}
+		}
+	}
+
+	filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := info.Name()
+		if info.Mode()&os.ModeSocket != 0 && (name == "firecracker.sock" || name == vsockUds ||
+			strings.HasPrefix(name, "uffd-") && strings.HasSuffix(name, ".sock")) {
+			log.Println("removing stale socket", path)
+			os.Remove(path)
+		}
+		return nil
+	})
+}
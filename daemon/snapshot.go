@@ -26,12 +26,16 @@ import (
 	"bytes"
 	"container/list"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"sync"
 	"syscall"
@@ -42,49 +46,342 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+const (
+	SnapshotFull = "Full"
+	SnapshotDiff = "Diff" // only the pages dirtied since the parent snapshot
+)
+
 type Snapshot struct {
 	sync.Mutex
 	Function            string `json:"function"`
-	MemFilePath         string `json:"memFilePath"`
+	MemFilePath         string `json:"memFilePath"` // of a diff snapshot, created by MergeLayers
+	Parent              string `json:"parent"`
+	DiffFilePath        string `json:"diffFilePath"` // sparse, dirty pages only
+	Deduped             bool   `json:"deduped"`      // mem file pages in the page store, see DedupSnapshot
+	Compressed          bool   `json:"compressed"`   // mem file compressed, see CompressSnapshot
 	loadOnce            *sync.Once
+	scanWg              sync.WaitGroup // in-flight ScanMincore
+	merging             sync.Mutex     // held while MemFilePath is built or removed
+	restoring           int            // in-flight restores, guarded by the SnapshotManager lock
+	deleting            bool           // hidden from Lookup, guarded by the SnapshotManager lock
+	shrinking           chan struct{}  // closed when the mem file is replaced, guarded by the SnapshotManager lock
 	records             []uint64
-	mincoreLayers       []int
+	mincoreLayers       []int // copy-on-write, see layers()
 	mincoreCurrentLayer int
 	nonZero             []bool
-	overlayRegions      map[int]int // offset->length
-	wsRegions           [][]int     // [[offset, length]...]
-	WsFile              string      `json:"wsFile"`
-	Size                int         `json:"size"`
-	BlockSize           int         `json:"blockSize"`
-	SnapshotBase        string      `json:"snapshotBase"`
-	SnapshotType        string      `json:"snapshotType"`
-	SnapshotId          string      `json:"snapshotId"`
-	SnapshotPath        string      `json:"snapshotPath"`
-	Version             string      `json:"functionVersion"`
+	overlayRegions      map[int]int             // offset->length
+	wsRegions           [][]int                 // [[offset, length]...]
+	WsFile              string                  `json:"wsFile"`
+	Size                int                     `json:"size"`
+	BlockSize           int                     `json:"blockSize"`
+	SnapshotBase        string                  `json:"snapshotBase"`
+	SnapshotType        string                  `json:"snapshotType"`
+	SnapshotId          string                  `json:"snapshotId"`
+	SnapshotPath        string                  `json:"snapshotPath"`
+	Version             string                  `json:"functionVersion"`
+	Checksums           map[string]FileChecksum `json:"checksums"`
+}
+
+// snapshotMeta is the on-disk form of a snapshot. It carries the unexported
+// mincore and region state next to the exported fields.
+type snapshotMeta struct {
+	*Snapshot
+	Records             []uint64    `json:"records"`
+	MincoreLayers       []int       `json:"mincoreLayers"`
+	MincoreCurrentLayer int         `json:"mincoreCurrentLayer"`
+	NonZero             []bool      `json:"nonZero"`
+	OverlayRegions      map[int]int `json:"overlayRegions"`
+	WsRegions           [][]int     `json:"wsRegions"`
+}
+
+// meta returns the on-disk form of the snapshot. Callers must hold the lock
+// of snapshot until it is marshalled.
+func (snapshot *Snapshot) meta() *snapshotMeta {
+	return &snapshotMeta{
+		Snapshot:            snapshot,
+		Records:             snapshot.records,
+		MincoreLayers:       snapshot.mincoreLayers,
+		MincoreCurrentLayer: snapshot.mincoreCurrentLayer,
+		NonZero:             snapshot.nonZero,
+		OverlayRegions:      snapshot.overlayRegions,
+		WsRegions:           snapshot.wsRegions,
+	}
+}
+
+func (snapshot *Snapshot) metaPath() string {
+	return snapshot.SnapshotBase + "/" + snapshot.SnapshotId + ".json"
+}
+
+// save writes the snapshot metadata under its SnapshotBase so that it can be
+// reloaded when the daemon restarts.
+func (snapshot *Snapshot) save() error {
+	snapshot.Lock()
+	data, err := json.Marshal(snapshot.meta())
+	snapshot.Unlock()
+	if err != nil {
+		log.Println("marshal snapshot", snapshot.SnapshotId, "failed:", err)
+		return err
+	}
+	if err := os.MkdirAll(snapshot.SnapshotBase, 0755); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := WriteFileAtomic(snapshot.metaPath(), data, 0644); err != nil {
+		log.Println("saving snapshot", snapshot.SnapshotId, "failed:", err)
+		return err
+	}
+	return nil
+}
+
+// layers returns the mincore layer vector and the number of layers. A published
+// vector is never modified in place, so it stays valid after the lock is
+// released.
+func (snapshot *Snapshot) layers() ([]int, int) {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	return snapshot.mincoreLayers, snapshot.mincoreCurrentLayer
+}
+
+// setLayers publishes a new mincore layer vector.
+func (snapshot *Snapshot) setLayers(layers []int, current int) {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	snapshot.mincoreLayers = layers
+	snapshot.mincoreCurrentLayer = current
+}
+
+func loadSnapshotMeta(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta := snapshotMeta{Snapshot: &Snapshot{}}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return meta.snapshot(), nil
+}
+
+// snapshot returns the snapshot with the state carried by meta.
+func (meta *snapshotMeta) snapshot() *Snapshot {
+	snapshot := meta.Snapshot
+	snapshot.loadOnce = new(sync.Once)
+	snapshot.records = meta.Records
+	snapshot.mincoreLayers = meta.MincoreLayers
+	snapshot.mincoreCurrentLayer = meta.MincoreCurrentLayer
+	snapshot.nonZero = meta.NonZero
+	snapshot.overlayRegions = meta.OverlayRegions
+	snapshot.wsRegions = meta.WsRegions
+	if snapshot.overlayRegions == nil {
+		snapshot.overlayRegions = map[int]int{}
+	}
+	if snapshot.wsRegions == nil {
+		snapshot.wsRegions = [][]int{}
+	}
+	return snapshot
 }
 
 type SnapshotManager struct {
 	sync.Mutex
 	Snapshots map[string]*Snapshot `json:"snapshots"`
 	config    *Config
+	pages     *PageStore
 }
 
 func NewSnapshotManager(config *Config) *SnapshotManager {
+	pageStore := config.PageStore
+	if pageStore == "" {
+		pageStore = config.BasePath + "/pagestore"
+	}
 	return &SnapshotManager{
 		Mutex:     sync.Mutex{},
 		Snapshots: map[string]*Snapshot{},
 		config:    config,
+		pages:     NewPageStore(pageStore),
+	}
+}
+
+// LoadSnapshots restores the snapshots saved under BasePath by a previous run
+// of the daemon. Snapshots whose files have disappeared are skipped.
+func (sm *SnapshotManager) LoadSnapshots() error {
+	paths, err := filepath.Glob(sm.config.BasePath + "/ss_*/ss_*.json")
+	if err != nil {
+		return err
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	pageMaps := map[string][]uint32{}
+	for _, path := range paths {
+		snapshot, err := loadSnapshotMeta(path)
+		if err != nil {
+			log.Println("loading snapshot metadata", path, "failed:", err)
+			continue
+		}
+		memFile := snapshot.MemFilePath
+		switch {
+		case snapshot.Deduped:
+			memFile = snapshot.pageMapPath() // rebuilt from the page store
+		case snapshot.Compressed:
+			memFile = snapshot.compressedPath() // decompressed on restore
+		case snapshot.Parent != "":
+			memFile = snapshot.DiffFilePath // merged on restore
+		}
+		if _, err := os.Stat(memFile); err != nil {
+			log.Println("skipping snapshot", snapshot.SnapshotId, "mem file:", err)
+			continue
+		}
+		if _, err := os.Stat(snapshot.SnapshotPath); err != nil {
+			log.Println("skipping snapshot", snapshot.SnapshotId, "snapshot file:", err)
+			continue
+		}
+		if err := snapshot.checkSizes(snapshot.storedChecksums()); err != nil {
+			log.Println("skipping snapshot", snapshot.SnapshotId, err)
+			continue
+		}
+		if snapshot.Deduped {
+			pages, err := readPageMap(snapshot.pageMapPath())
+			if err != nil {
+				log.Println("skipping snapshot", snapshot.SnapshotId, err)
+				continue
+			}
+			pageMaps[snapshot.SnapshotId] = pages
+		}
+		sm.Snapshots[snapshot.SnapshotId] = snapshot
+	}
+	broken, err := sm.pages.load(pageMaps)
+	if err != nil {
+		return err
+	}
+	for _, id := range broken {
+		log.Println("skipping snapshot", id, "with pages missing from the page store")
+		delete(sm.Snapshots, id)
+	}
+	log.Println("loaded", len(sm.Snapshots), "snapshots from", sm.config.BasePath)
+	return nil
+}
+
+// Lookup returns the snapshot registered as ssID. Snapshots being deleted are
+// not returned.
+func (sm *SnapshotManager) Lookup(ssID string) (*Snapshot, bool) {
+	sm.Lock()
+	defer sm.Unlock()
+	snapshot, ok := sm.Snapshots[ssID]
+	if !ok || snapshot.deleting {
+		return nil, false
+	}
+	return snapshot, ok
+}
+
+// acquire looks up ssID for a restore. The snapshot cannot be deleted until
+// the restore is released, by which time the restored VM references it. A
+// restore waits while the mem file of the snapshot is being replaced.
+func (sm *SnapshotManager) acquire(ssID string) (*Snapshot, bool) {
+	sm.Lock()
+	defer sm.Unlock()
+	for {
+		snapshot, ok := sm.Snapshots[ssID]
+		if !ok || snapshot.deleting {
+			return nil, false
+		}
+		if shrinking := snapshot.shrinking; shrinking != nil {
+			sm.Unlock()
+			<-shrinking
+			sm.Lock()
+			continue
+		}
+		snapshot.restoring++
+		return snapshot, true
+	}
+}
+
+// release ends a restore started by acquire.
+func (sm *SnapshotManager) release(snapshot *Snapshot) {
+	sm.Lock()
+	defer sm.Unlock()
+	snapshot.restoring--
+}
+
+// markDeleting hides ssID from Lookup and acquire. It fails while the
+// snapshot is being restored.
+func (sm *SnapshotManager) markDeleting(ssID string) error {
+	sm.Lock()
+	defer sm.Unlock()
+	snapshot, ok := sm.Snapshots[ssID]
+	if !ok || snapshot.deleting {
+		log.Println("snapshot", ssID, "not exists")
+		return errors.New("snapshot not exists")
+	}
+	if snapshot.restoring > 0 {
+		log.Println("snapshot", ssID, "is being restored")
+		return fmt.Errorf("snapshot %v is being restored", ssID)
+	}
+	if snapshot.shrinking != nil {
+		log.Println("snapshot", ssID, "is being shrunk")
+		return fmt.Errorf("snapshot %v is being shrunk", ssID)
+	}
+	snapshot.deleting = true
+	return nil
+}
+
+// unmarkDeleting undoes markDeleting when the deletion is refused.
+func (sm *SnapshotManager) unmarkDeleting(ssID string) {
+	sm.Lock()
+	defer sm.Unlock()
+	if snapshot, ok := sm.Snapshots[ssID]; ok {
+		snapshot.deleting = false
+	}
+}
+
+// markShrinking makes restores of ssID wait until unmarkShrinking, while its
+// mem file is replaced by a deduplicated or compressed one. It fails while
+// the snapshot is being restored.
+func (sm *SnapshotManager) markShrinking(ssID string) error {
+	sm.Lock()
+	defer sm.Unlock()
+	snapshot, ok := sm.Snapshots[ssID]
+	if !ok || snapshot.deleting {
+		log.Println("snapshot", ssID, "not exists")
+		return errors.New("snapshot not exists")
+	}
+	if snapshot.restoring > 0 {
+		log.Println("snapshot", ssID, "is being restored")
+		return fmt.Errorf("snapshot %v is being restored", ssID)
+	}
+	if snapshot.shrinking != nil {
+		log.Println("snapshot", ssID, "is being shrunk")
+		return fmt.Errorf("snapshot %v is being shrunk", ssID)
+	}
+	snapshot.shrinking = make(chan struct{})
+	return nil
+}
+
+// unmarkShrinking lets the restores waiting for ssID go on.
+func (sm *SnapshotManager) unmarkShrinking(ssID string) {
+	sm.Lock()
+	defer sm.Unlock()
+	if snapshot, ok := sm.Snapshots[ssID]; ok && snapshot.shrinking != nil {
+		close(snapshot.shrinking)
+		snapshot.shrinking = nil
 	}
 }
 
 func (sm *SnapshotManager) CopySnapshot(ctx context.Context, src, memFilePath string) (*models.Snapshot, error) {
-	oldSnap, ok := sm.Snapshots[src]
+	oldSnap, ok := sm.Lookup(src)
 	if !ok {
 		log.Println("snapshot not exists")
 		return nil, errors.New("snapshot not exists")
 	}
 
+	// the copy is a full snapshot
+	if err := sm.MergeLayers(oldSnap); err != nil {
+		return nil, err
+	}
+	if err := sm.verifyBeforeUse(oldSnap); err != nil {
+		return nil, err
+	}
+
 	newSsId := "ss_" + RandStringRunes(8)
+	oldSnap.Lock()
 	newSnap := &Snapshot{
 		Function:            oldSnap.Function,
 		MemFilePath:         memFilePath,
@@ -103,11 +400,23 @@ func (sm *SnapshotManager) CopySnapshot(ctx context.Context, src, memFilePath st
 		SnapshotId:          newSsId,
 		SnapshotPath:        oldSnap.SnapshotPath,
 		Version:             oldSnap.Version,
+		Checksums:           map[string]FileChecksum{},
+	}
+	for file, sum := range oldSnap.Checksums {
+		if file != fileDiff && file != fileCompressed {
+			newSnap.Checksums[file] = sum
+		}
 	}
+	oldSnap.Unlock()
 
 	if err := CopyFile(newSnap.MemFilePath, oldSnap.MemFilePath); err != nil {
 		return nil, err
 	}
+	if _, ok := newSnap.Checksums[fileMem]; ok {
+		if err := CopyFile(newSnap.pageIndexPath(), oldSnap.pageIndexPath()); err != nil {
+			return nil, err
+		}
+	}
 
 	if oldSnap.WsFile != "" {
 		newSnap.WsFile = oldSnap.WsFile + "." + newSsId
@@ -119,11 +428,266 @@ func (sm *SnapshotManager) CopySnapshot(ctx context.Context, src, memFilePath st
 	sm.Lock()
 	sm.Snapshots[newSsId] = newSnap
 	sm.Unlock()
+	newSnap.save()
+	return newSnap.Model(), nil
+}
+
+// ListSnapshots returns all snapshots sorted by id.
+func (sm *SnapshotManager) ListSnapshots() []*models.Snapshot {
+	sm.Lock()
+	defer sm.Unlock()
+	ret := make([]*models.Snapshot, 0, len(sm.Snapshots))
+	for _, snapshot := range sm.Snapshots {
+		ret = append(ret, snapshot.Model())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].SsID < ret[j].SsID })
+	return ret
+}
+
+// GetSnapshot returns the metadata of a single snapshot.
+func (sm *SnapshotManager) GetSnapshot(ssID string) (*models.Snapshot, error) {
+	sm.Lock()
+	defer sm.Unlock()
+	snapshot, ok := sm.Snapshots[ssID]
+	if !ok {
+		log.Println("snapshot", ssID, "not exists")
+		return nil, errors.New("snapshot not exists")
+	}
+	return snapshot.Model(), nil
+}
+
+// DeleteSnapshot unregisters a snapshot and removes the files it owns. Files
+// that are shared with other snapshots, e.g. by CopySnapshot, are kept.
+// Snapshots that diff snapshots are based on cannot be deleted. The snapshot
+// must have been marked by markDeleting.
+func (sm *SnapshotManager) DeleteSnapshot(ssID string) error {
+	sm.Lock()
+	snapshot, ok := sm.Snapshots[ssID]
+	if !ok || !snapshot.deleting {
+		sm.Unlock()
+		log.Println("snapshot", ssID, "not exists")
+		return errors.New("snapshot not exists")
+	}
+	if children := sm.children(ssID); len(children) > 0 {
+		sm.Unlock()
+		log.Println("snapshot", ssID, "has diff snapshots", children)
+		return fmt.Errorf("snapshot %v has diff snapshots %v", ssID, children)
+	}
+	delete(sm.Snapshots, ssID)
+	shared := map[string]bool{}
+	for _, other := range sm.Snapshots {
+		shared[other.MemFilePath] = true
+		shared[other.compressedPath()] = true
+		shared[other.DiffFilePath] = true
+		shared[other.SnapshotPath] = true
+		shared[other.WsFile] = true
+		shared[other.SnapshotBase] = true
+	}
+	sm.Unlock()
+
+	var firstErr error
+	remove := func(path string) {
+		if path == "" || shared[path] {
+			return
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Println("removing", path, "failed:", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if snapshot.deduped() {
+		pages, err := readPageMap(snapshot.pageMapPath())
+		if err == nil {
+			err = sm.pages.Release(pages)
+		}
+		if err != nil {
+			log.Println("releasing pages of", ssID, "failed:", err)
+			firstErr = err
+		}
+	}
+	remove(snapshot.MemFilePath)
+	if snapshot.compressed() {
+		remove(snapshot.compressedPath())
+	}
+	remove(snapshot.DiffFilePath)
+	remove(snapshot.SnapshotPath)
+	remove(snapshot.WsFile)
+	if shared[snapshot.SnapshotBase] {
+		remove(snapshot.metaPath())
+		remove(snapshot.pageIndexPath())
+		remove(snapshot.pageMapPath())
+	} else {
+		remove(snapshot.SnapshotBase) // metadata, REAP working set and trace
+	}
+	log.Println("deleted snapshot", ssID)
+	return firstErr
+}
+
+// children returns the ids of the diff snapshots based on ssID. Callers must
+// hold the lock of sm.
+func (sm *SnapshotManager) children(ssID string) []string {
+	ret := []string{}
+	for id, other := range sm.Snapshots {
+		if other.Parent == ssID {
+			ret = append(ret, id)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// MergeLayers builds the memory file of a diff snapshot by writing its dirty
+// pages over the memory of its parent, merging the parent first if it is a
+// diff snapshot itself. The memory file of a deduplicated snapshot is rebuilt
+// from the page store, and that of a compressed snapshot decompressed. Other
+// snapshots are left as they are.
+func (sm *SnapshotManager) MergeLayers(snapshot *Snapshot) error {
+	snapshot.merging.Lock()
+	defer snapshot.merging.Unlock()
+	deduped, compressed := snapshot.deduped(), snapshot.compressed()
+	if snapshot.Parent == "" && !deduped && !compressed {
+		return nil
+	}
+	if _, err := os.Stat(snapshot.MemFilePath); err == nil {
+		return nil
+	}
+	switch {
+	case deduped:
+		return sm.materialize(snapshot)
+	case compressed:
+		return sm.decompress(snapshot)
+	}
+	parent, ok := sm.Lookup(snapshot.Parent)
+	if !ok {
+		log.Println("parent", snapshot.Parent, "of snapshot", snapshot.SnapshotId, "not exists")
+		return fmt.Errorf("parent snapshot %v not exists", snapshot.Parent)
+	}
+	if err := sm.MergeLayers(parent); err != nil {
+		return err
+	}
+	if err := sm.verifyBeforeUse(parent); err != nil {
+		return err
+	}
+	if err := sm.verifyBeforeUse(snapshot); err != nil {
+		return err
+	}
+	tmp := snapshot.MemFilePath + ".tmp"
+	if err := CopyFile(tmp, parent.MemFilePath); err != nil {
+		log.Println("copying", parent.MemFilePath, "failed:", err)
+		return err
+	}
+	if err := ApplyDiffFile(tmp, snapshot.DiffFilePath); err != nil {
+		log.Println("applying", snapshot.DiffFilePath, "failed:", err)
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, snapshot.MemFilePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Println("merged snapshot", snapshot.SnapshotId, "over", parent.SnapshotId)
+	if err := snapshot.recordChecksums(fileMem); err != nil {
+		return err
+	}
+	return snapshot.save()
+}
+
+// dirtyPages returns which pages of guest memory a diff file holds.
+func dirtyPages(diffFilePath string, size int) ([]bool, error) {
+	f, err := os.Open(diffFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pagesize := int64(os.Getpagesize())
+	dirty := make([]bool, (int64(size)+pagesize-1)/pagesize)
+	err = FileExtents(f, func(offset, length int64) error {
+		for page := offset / pagesize; page*pagesize < offset+length && page < int64(len(dirty)); page++ {
+			dirty[page] = true
+		}
+		return nil
+	})
+	return dirty, err
+}
+
+// inherit takes the mincore layers and non-zero blocks of the pages a diff
+// snapshot shares with its parent. Dirty pages are left out of the layers and
+// taken as non-zero.
+func (snapshot *Snapshot) inherit(parent *Snapshot, dirty []bool) {
+	layers, current := parent.layers()
+	parent.Lock()
+	nonZero, blockSize := parent.nonZero, parent.BlockSize
+	parent.Unlock()
+
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	if len(layers) == len(dirty) {
+		inherited := make([]int, len(layers))
+		for i, layer := range layers {
+			if !dirty[i] {
+				inherited[i] = layer
+			}
+		}
+		snapshot.mincoreLayers = inherited
+		snapshot.mincoreCurrentLayer = current
+	}
+	if blockSize == os.Getpagesize() && len(nonZero) == len(dirty) {
+		inherited := make([]bool, len(nonZero))
+		for i, nz := range nonZero {
+			inherited[i] = nz || dirty[i]
+		}
+		snapshot.nonZero = inherited
+		snapshot.BlockSize = blockSize
+	}
+}
+
+// Model converts the snapshot to its API representation.
+func (snapshot *Snapshot) Model() *models.Snapshot {
 	vmId := ""
-	return &models.Snapshot{SsID: newSsId, MemFilePath: newSnap.MemFilePath, VMID: &vmId}, nil
+	snapshot.Lock()
+	checksums := make(map[string]string, len(snapshot.Checksums))
+	for file, sum := range snapshot.Checksums {
+		checksums[file] = sum.Sha256
+	}
+	deduped, compressed := snapshot.Deduped, snapshot.Compressed
+	snapshot.Unlock()
+	return &models.Snapshot{
+		VMID:         &vmId,
+		SsID:         snapshot.SnapshotId,
+		SnapshotType: snapshot.SnapshotType,
+		SnapshotPath: snapshot.SnapshotPath,
+		MemFilePath:  snapshot.MemFilePath,
+		Parent:       snapshot.Parent,
+		DiffFilePath: snapshot.DiffFilePath,
+		Deduped:      deduped,
+		Compressed:   compressed,
+		Version:      snapshot.Version,
+		Function:     snapshot.Function,
+		WsFile:       snapshot.WsFile,
+		Size:         int64(snapshot.Size),
+		Checksums:    checksums,
+	}
 }
 
 func (sm *SnapshotManager) RegisterSnapshot(snapshot *Snapshot) error {
+	if snapshot.Parent != "" {
+		parent, ok := sm.Lookup(snapshot.Parent)
+		if !ok {
+			log.Println("parent snapshot", snapshot.Parent, "not exists")
+			return errors.New("parent snapshot not exists")
+		}
+		// the diff file ends at the last dirty page
+		snapshot.Size = parent.Size
+		if err := snapshot.recordChecksums(fileSnapshot, fileDiff); err != nil {
+			return err
+		}
+		sm.Lock()
+		sm.Snapshots[snapshot.SnapshotId] = snapshot
+		sm.Unlock()
+		return nil
+	}
 	f, err := os.OpenFile(snapshot.MemFilePath, os.O_RDONLY, 0644)
 	if err != nil {
 		log.Println("open", snapshot.MemFilePath, "failed", err)
@@ -136,6 +700,9 @@ func (sm *SnapshotManager) RegisterSnapshot(snapshot *Snapshot) error {
 		return err
 	}
 	snapshot.Size = int(fi.Size())
+	if err := snapshot.recordChecksums(fileSnapshot, fileMem); err != nil {
+		return err
+	}
 	sm.Lock()
 	sm.Snapshots[snapshot.SnapshotId] = snapshot
 	sm.Unlock()
@@ -143,11 +710,13 @@ func (sm *SnapshotManager) RegisterSnapshot(snapshot *Snapshot) error {
 }
 
 func (sm *SnapshotManager) GetMincore(r *http.Request, src string) (*operations.GetSnapshotsSsIDMincoreOKBody, error) {
-	source, ok := sm.Snapshots[src]
+	source, ok := sm.Lookup(src)
 	if !ok {
 		log.Println("snapshot", src, "not exists")
 		return nil, errors.New("snapshot not exists")
 	}
+	source.Lock()
+	defer source.Unlock()
 	if source.mincoreLayers == nil {
 		log.Println("mincore for", src, "does not exist")
 		return nil, errors.New("mincore does not exist")
@@ -170,25 +739,24 @@ func (sm *SnapshotManager) GetMincore(r *http.Request, src string) (*operations.
 }
 
 func (sm *SnapshotManager) CopyMincore(r *http.Request, dst string, src string) error {
-	source, ok := sm.Snapshots[src]
+	source, ok := sm.Lookup(src)
 	if !ok {
 		log.Println("snapshot", src, "not exists")
 		return errors.New("snapshot not exists")
 	}
-	dest, ok := sm.Snapshots[dst]
+	dest, ok := sm.Lookup(dst)
 	if !ok {
 		log.Println("snapshot", dst, "not exists")
 		return errors.New("snapshot not exists")
 	}
-	source.Lock()
-	defer source.Unlock()
+	// layer vectors are never modified in place, so they can be shared
+	layers, current := source.layers()
 	dest.Lock()
 	defer dest.Unlock()
-	if len(source.mincoreLayers) > 0 {
-		dest.mincoreLayers = make([]int, len(source.mincoreLayers))
-		copy(dest.mincoreLayers, source.mincoreLayers)
+	if len(layers) > 0 {
+		dest.mincoreLayers = layers
 	}
-	dest.mincoreCurrentLayer = source.mincoreCurrentLayer
+	dest.mincoreCurrentLayer = current
 	// sum := func(list []int) int {
 	// 	ret := 0
 	// 	for _, v := range list {
@@ -202,16 +770,22 @@ func (sm *SnapshotManager) CopyMincore(r *http.Request, dst string, src string)
 }
 
 func (sm *SnapshotManager) AddMincoreLayer(req *http.Request, ssID string, position int, fromDiff string) error {
-	snapshot, ok := sm.Snapshots[ssID]
+	snapshot, ok := sm.Lookup(ssID)
 	if !ok {
 		log.Println("snapshot", ssID, "not exists")
 		return errors.New("snapshot not exists")
 	}
-	other, ok := sm.Snapshots[fromDiff]
+	other, ok := sm.Lookup(fromDiff)
 	if !ok {
 		log.Println("snapshot", fromDiff, "not exists")
 		return errors.New("snapshot not exists")
 	}
+	if err := sm.MergeLayers(snapshot); err != nil {
+		return err
+	}
+	if err := sm.MergeLayers(other); err != nil {
+		return err
+	}
 
 	fa, err := os.OpenFile(snapshot.MemFilePath, os.O_RDWR, 0644)
 	if err != nil {
@@ -241,6 +815,10 @@ func (sm *SnapshotManager) AddMincoreLayer(req *http.Request, ssID string, posit
 		log.Println(err)
 		return err
 	}
+	if statA.Size() != statB.Size() {
+		log.Println("mem files", snapshot.MemFilePath, "and", other.MemFilePath, "differ in size")
+		return fmt.Errorf("mem files differ in size: %d and %d bytes", statA.Size(), statB.Size())
+	}
 	mmapB, err := unix.Mmap(int(fb.Fd()), 0, int(statB.Size()), unix.PROT_READ, unix.MAP_PRIVATE)
 	if err != nil {
 		log.Println(err)
@@ -272,24 +850,26 @@ func (snapshot *Snapshot) InsertMincoreLayer(layer []bool, position int) error {
 	if position < 1 {
 		return errors.New("position must >= 1")
 	}
-	if snapshot.mincoreLayers == nil {
-		snapshot.mincoreLayers = make([]int, len(layer))
-	}
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	layers := make([]int, len(layer))
+	copy(layers, snapshot.mincoreLayers)
 	for i, v := range layer {
 		if v {
 			switch {
-			case snapshot.mincoreLayers[i] == 0:
-				snapshot.mincoreLayers[i] = position
-			case snapshot.mincoreLayers[i] > position:
-				snapshot.mincoreLayers[i] = position
+			case layers[i] == 0:
+				layers[i] = position
+			case layers[i] > position:
+				layers[i] = position
 			default:
 			}
 		} else {
-			if snapshot.mincoreLayers[i] >= position {
-				snapshot.mincoreLayers[i] += 1
+			if layers[i] >= position {
+				layers[i] += 1
 			}
 		}
 	}
+	snapshot.mincoreLayers = layers
 	snapshot.mincoreCurrentLayer += 1
 	return nil
 }
@@ -426,6 +1006,8 @@ func (snapshot *Snapshot) EmulateMincore(ctx context.Context, mincoreSize int) e
 		curLayer  int
 		layerSize int
 	)
+	snapshot.Lock()
+	defer snapshot.Unlock()
 	if len(snapshot.mincoreLayers) != 0 || len(snapshot.records) == 0 {
 		log.Println("EmulateMincore: mincore exists or records do not exist")
 		return errors.New("mincore exists or records do not exist")
@@ -456,7 +1038,7 @@ func (snapshot *Snapshot) EmulateMincore(ctx context.Context, mincoreSize int) e
 	return nil
 }
 
-func (snapshot *Snapshot) ScanMincore(r *http.Request, pid, scanInterval, sizeIncr int, finished chan bool) error {
+func (snapshot *Snapshot) ScanMincore(r *http.Request, rss func() (int, error), scanInterval, sizeIncr int, finished chan bool) error {
 	var (
 		mincore []int
 		cur     int
@@ -471,26 +1053,26 @@ func (snapshot *Snapshot) ScanMincore(r *http.Request, pid, scanInterval, sizeIn
 		log.Println(err)
 		return err
 	}
+	_, start := snapshot.layers()
 	if scanInterval > 0 {
-		mincore, cur, err = ScanFileMincore(f, fi.Size(), snapshot.mincoreCurrentLayer, scanInterval, finished)
+		mincore, cur, err = ScanFileMincore(f, fi.Size(), start, scanInterval, finished)
 	} else if sizeIncr > 0 {
-		mincore, cur, err = ScanFileMincoreBySize(f, fi.Size(), snapshot.mincoreCurrentLayer, pid, sizeIncr, finished)
+		mincore, cur, err = ScanFileMincoreBySize(f, fi.Size(), start, rss, sizeIncr, finished)
 	}
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	log.Println(cur-snapshot.mincoreCurrentLayer, "layers scanned")
-	snapshot.mincoreLayers = mincore
+	log.Println(cur-start, "layers scanned")
 	count := 0
-	for _, b := range snapshot.mincoreLayers {
+	for _, b := range mincore {
 		if b > 0 {
 			count += 1
 		}
 	}
 	log.Println("scanned mincore size:", count)
-	snapshot.mincoreCurrentLayer = cur
-	log.Println("snapshot.mincoreCurrentLayer:", snapshot.mincoreCurrentLayer)
+	snapshot.setLayers(mincore, cur)
+	log.Println("snapshot.mincoreCurrentLayer:", cur)
 	return nil
 }
 
@@ -521,16 +1103,16 @@ func (snapshot *Snapshot) loadMincore(ctx context.Context, layers []int64, retai
 
 	pagesize := os.Getpagesize()
 
-	if snapshot.mincoreLayers != nil { // mincore layers
+	if mincoreLayers, _ := snapshot.layers(); mincoreLayers != nil { // mincore layers
 		value := byte(0)
-		vecsize := len(snapshot.mincoreLayers)
+		vecsize := len(mincoreLayers)
 		_, span2 := trace.StartSpan(ctx, "load_mincoreLayers")
 		count := 0
 		defer span2.End()
 		for _, layer := range layers {
 			layerCount := 0
 			for cur := 0; cur < vecsize; cur++ {
-				if snapshot.mincoreLayers[cur] == int(layer) {
+				if mincoreLayers[cur] == int(layer) {
 					if (cur*pagesize) >= snapshot.Size || cur*pagesize < 0 {
 						log.Fatal("cur*pagesize out of range: ", cur*pagesize)
 					}
@@ -542,6 +1124,7 @@ func (snapshot *Snapshot) loadMincore(ctx context.Context, layers []int64, retai
 			log.Printf("layer %d: %d pages\n", layer, layerCount)
 		}
 		log.Printf("loaded nlayers: %d, pages: %d; value: %d; \n", len(layers), count, value)
+		span.AddAttributes(trace.Int64Attribute("pages", int64(count)))
 		return nil
 	} else {
 		log.Println("mincore and mincoreLayers not exist!")
@@ -736,32 +1319,33 @@ func (snapshot *Snapshot) createWsRegions(ctx context.Context, withInactive, wit
 	// if inRegion { // last page
 	// 	result = append(result, Region{regionStart, i - regionStart, regionLayer})
 	// }
+	mincoreLayers, _ := snapshot.layers()
 	include := func(i int) bool {
 		if withInactive {
 			if withZero {
-				return snapshot.mincoreLayers[i] > 0 || snapshot.nonZero[i]
+				return mincoreLayers[i] > 0 || snapshot.nonZero[i]
 			} else {
 				return snapshot.nonZero[i]
 			}
 		} else {
 			if withZero {
-				return snapshot.mincoreLayers[i] > 0
+				return mincoreLayers[i] > 0
 			} else {
-				return snapshot.mincoreLayers[i] > 0 && snapshot.nonZero[i]
+				return mincoreLayers[i] > 0 && snapshot.nonZero[i]
 			}
 		}
 	}
 	l := list.New()
-	l.PushBack(&Region{start: 0, len: 1, layer: snapshot.mincoreLayers[0], include: include(0)})
-	for i := 1; i < len(snapshot.mincoreLayers); i += 1 { // traverse all pages
+	l.PushBack(&Region{start: 0, len: 1, layer: mincoreLayers[0], include: include(0)})
+	for i := 1; i < len(mincoreLayers); i += 1 { // traverse all pages
 		last := l.Back().Value.(*Region)
 		if include(i) == last.include {
 			last.len += 1
-			if snapshot.mincoreLayers[i] > 0 && snapshot.mincoreLayers[i] < last.layer {
-				last.layer = snapshot.mincoreLayers[i] // elevate layer
+			if mincoreLayers[i] > 0 && mincoreLayers[i] < last.layer {
+				last.layer = mincoreLayers[i] // elevate layer
 			}
 		} else { // a change
-			l.PushBack(&Region{start: i, len: 1, layer: snapshot.mincoreLayers[i], include: include(i)})
+			l.PushBack(&Region{start: i, len: 1, layer: mincoreLayers[i], include: include(i)})
 		}
 	}
 	l.Remove(l.Front())
@@ -815,11 +1399,14 @@ func (snapshot *Snapshot) createWsRegions(ctx context.Context, withInactive, wit
 		}
 		return result[i].layer < result[j].layer
 	})
-	snapshot.wsRegions = make([][]int, 0)
+	wsRegions := make([][]int, 0)
 	for _, region := range result {
-		snapshot.wsRegions = append(snapshot.wsRegions, []int{region.start, region.len})
+		wsRegions = append(wsRegions, []int{region.start, region.len})
 	}
-	log.Println("created", len(snapshot.wsRegions), "Ws Regions")
+	snapshot.Lock()
+	snapshot.wsRegions = wsRegions
+	snapshot.Unlock()
+	log.Println("created", len(wsRegions), "Ws Regions")
 }
 
 func (snapshot *Snapshot) createWsFile(ctx context.Context, wsFilePath string, withInactive, withZero bool, sizeThreshold, intervalThreshold int) error {
@@ -844,18 +1431,23 @@ func (snapshot *Snapshot) createWsFile(ctx context.Context, wsFilePath string, w
 	}
 	defer wsFile.Close()
 
+	snapshot.Lock()
+	wsRegions := snapshot.wsRegions
+	snapshot.Unlock()
 	page_size := os.Getpagesize()
 	pageCount := 0
-	for _, region := range snapshot.wsRegions {
+	for _, region := range wsRegions {
 		if _, err := wsFile.Write(mmSrc[region[0]*page_size : (region[0]+region[1])*page_size]); err != nil {
 			log.Println("Write failed:", err)
 			return err
 		}
 		pageCount += region[1]
 	}
+	snapshot.Lock()
 	snapshot.WsFile = wsFilePath
+	snapshot.Unlock()
 	log.Println("wsfile created, pages:", pageCount, ", bytes:", pageCount*page_size)
-	return nil
+	return snapshot.recordChecksums(fileWs)
 }
 
 func (snapshot *Snapshot) loadWsFile(ctx context.Context) error {
@@ -899,6 +1491,7 @@ func (snapshot *Snapshot) loadWsFile(ctx context.Context) error {
 			value ^= mm[cur]
 		}
 		log.Println("ws file pages loaded:", count, "; value", value)
+		span.AddAttributes(trace.Int64Attribute("pages", int64(count)))
 	}
 	return nil
 }
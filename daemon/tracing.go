@@ -0,0 +1,445 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ucsdsysnet/faasnap/models"
+
+	"contrib.go.opencensus.io/exporter/zipkin"
+	openzipkin "github.com/openzipkin/zipkin-go"
+	zipkinHTTP "github.com/openzipkin/zipkin-go/reporter/http"
+	"go.opencensus.io/trace"
+)
+
+// TracingConfig selects where spans are exported and how many are sampled.
+type TracingConfig struct {
+	Exporter    string   `json:"exporter"`     // "zipkin" (default), "otlp", "jaeger", "file", "stdout" or "none"
+	Endpoint    string   `json:"endpoint"`     // collector URL, or the output path of "file"
+	SampleRatio *float64 `json:"sample_ratio"` // fraction of traces sampled, 1 if unset; invocations are always sampled
+}
+
+const (
+	TraceZipkin = "zipkin"
+	TraceOTLP   = "otlp"
+	TraceJaeger = "jaeger" // through the OTLP receiver of Jaeger 1.35+
+	TraceFile   = "file"
+	TraceStdout = "stdout"
+	TraceNone   = "none"
+)
+
+var defaultTraceEndpoints = map[string]string{
+	TraceZipkin: "http://localhost:9411",
+	TraceOTLP:   "http://localhost:4318/v1/traces",
+	TraceJaeger: "http://localhost:4318/v1/traces",
+}
+
+// flushTracing exports spans still buffered by the exporter.
+var flushTracing = func() {}
+
+// setupTracing registers the exporter of config. addr is the address the
+// daemon listens on, reported to Zipkin as the local endpoint.
+func setupTracing(config TracingConfig, addr string) error {
+	ratio := 1.0
+	if config.SampleRatio != nil {
+		ratio = *config.SampleRatio
+	}
+	exporter := config.Exporter
+	if exporter == "" {
+		exporter = TraceZipkin
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = defaultTraceEndpoints[exporter]
+	}
+
+	var export trace.Exporter
+	switch exporter {
+	case TraceZipkin:
+		localEndpoint, err := openzipkin.NewEndpoint("daemon", addr)
+		if err != nil {
+			return fmt.Errorf("creating the Zipkin exporter: %v", err)
+		}
+		reporter := zipkinHTTP.NewReporter(fmt.Sprintf("%v/api/v2/spans", endpoint))
+		export = zipkin.NewExporter(reporter, localEndpoint)
+		flushTracing = func() { reporter.Close() }
+	case TraceOTLP, TraceJaeger:
+		e := newOTLPExporter(endpoint)
+		export = e
+		flushTracing = e.Flush
+	case TraceFile:
+		if endpoint == "" {
+			return fmt.Errorf("tracing exporter %v needs an endpoint", exporter)
+		}
+		f, err := os.OpenFile(endpoint, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("opening the trace file: %v", err)
+		}
+		export = &jsonExporter{w: f}
+		flushTracing = func() { f.Sync() }
+	case TraceStdout:
+		export = &jsonExporter{w: os.Stdout}
+	case TraceNone:
+	default:
+		return fmt.Errorf("unknown tracing exporter %v", exporter)
+	}
+
+	if export != nil {
+		trace.RegisterExporter(export)
+	}
+	trace.RegisterExporter(invocationSpans)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(ratio)})
+	log.Println("tracing to", exporter, endpoint, "sampling", ratio)
+	return nil
+}
+
+// TraceStartOptions returns the options of the span started for request r.
+// Invocations are always sampled since their timing is taken from the spans
+// of their trace.
+func TraceStartOptions(r *http.Request) trace.StartOptions {
+	if r.Method == http.MethodPost && r.URL.Path == "/invocations" {
+		return trace.StartOptions{Sampler: trace.AlwaysSample()}
+	}
+	return trace.StartOptions{}
+}
+
+// spanCollector keeps the spans of the traces it watches.
+type spanCollector struct {
+	sync.Mutex
+	traces map[trace.TraceID][]*trace.SpanData
+}
+
+var invocationSpans = &spanCollector{traces: map[trace.TraceID][]*trace.SpanData{}}
+
+func (c *spanCollector) ExportSpan(sd *trace.SpanData) {
+	c.Lock()
+	defer c.Unlock()
+	if spans, ok := c.traces[sd.TraceID]; ok {
+		c.traces[sd.TraceID] = append(spans, sd)
+	}
+}
+
+// watch starts keeping the spans of a trace until take is called.
+func (c *spanCollector) watch(id trace.TraceID) {
+	c.Lock()
+	defer c.Unlock()
+	c.traces[id] = []*trace.SpanData{}
+}
+
+// take returns the spans of a trace ended since watch.
+func (c *spanCollector) take(id trace.TraceID) []*trace.SpanData {
+	c.Lock()
+	defer c.Unlock()
+	spans := c.traces[id]
+	delete(c.traces, id)
+	return spans
+}
+
+// spanAttributes returns the attributes spans are filtered by, leaving out
+// the empty ones.
+func spanAttributes(function, vmID, ssID, restore string) []trace.Attribute {
+	attrs := []trace.Attribute{}
+	for _, a := range []struct{ key, value string }{
+		{"function", function},
+		{"vmId", vmID},
+		{"ssId", ssID},
+		{"restore", restore},
+	} {
+		if a.value != "" {
+			attrs = append(attrs, trace.StringAttribute(a.key, a.value))
+		}
+	}
+	return attrs
+}
+
+// restoreMode returns how an invocation restores its snapshot, if it does.
+func restoreMode(invoc *models.Invocation) string {
+	if invoc.SsID == "" {
+		return ""
+	}
+	switch {
+	case invoc.EnableReap:
+		return startReap
+	case invoc.UseWsFile:
+		return startWsFile
+	default:
+		return startSnapshot
+	}
+}
+
+// jsonExporter writes one JSON object per span, for reading traces offline.
+type jsonExporter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+type jsonSpan struct {
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentSpanId,omitempty"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	DurationUs int64                  `json:"durationUs"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Status     int32                  `json:"status,omitempty"`
+	Message    string                 `json:"message,omitempty"`
+}
+
+func (e *jsonExporter) ExportSpan(sd *trace.SpanData) {
+	span := jsonSpan{
+		TraceID:    sd.TraceID.String(),
+		SpanID:     sd.SpanID.String(),
+		Name:       sd.Name,
+		Start:      sd.StartTime,
+		DurationUs: sd.EndTime.Sub(sd.StartTime).Microseconds(),
+		Attributes: sd.Attributes,
+		Status:     sd.Code,
+		Message:    sd.Message,
+	}
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		span.ParentID = sd.ParentSpanID.String()
+	}
+	data, err := json.Marshal(span)
+	if err != nil {
+		log.Println("marshal span failed:", err)
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.w.Write(append(data, '\n'))
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = time.Second
+)
+
+// otlpExporter sends spans in batches to an OTLP/HTTP collector, JSON encoded.
+type otlpExporter struct {
+	sync.Mutex
+	endpoint string
+	client   *http.Client
+	spans    []*trace.SpanData
+	full     chan struct{}
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		full:     make(chan struct{}, 1),
+	}
+	go func() {
+		ticker := time.NewTicker(otlpFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.full:
+			}
+			e.Flush()
+		}
+	}()
+	return e
+}
+
+func (e *otlpExporter) ExportSpan(sd *trace.SpanData) {
+	e.Lock()
+	e.spans = append(e.spans, sd)
+	full := len(e.spans) >= otlpBatchSize
+	e.Unlock()
+	if full {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush sends the buffered spans.
+func (e *otlpExporter) Flush() {
+	e.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		log.Println("marshal spans failed:", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println("exporting spans failed:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		log.Println("exporting spans failed:", resp.Status)
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the OTLP JSON encoding.
+func otlpRequest(spans []*trace.SpanData) interface{} {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, sd := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(sd.TraceID[:]),
+			SpanID:            hex.EncodeToString(sd.SpanID[:]),
+			Name:              sd.Name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(sd.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sd.EndTime.UnixNano(), 10),
+		}
+		if sd.ParentSpanID != (trace.SpanID{}) {
+			s.ParentSpanID = hex.EncodeToString(sd.ParentSpanID[:])
+		}
+		switch sd.SpanKind {
+		case trace.SpanKindServer:
+			s.Kind = 2
+		case trace.SpanKindClient:
+			s.Kind = 3
+		}
+		if sd.Code != 0 {
+			s.Status.Code = 2 // error
+			s.Status.Message = sd.Message
+		}
+		for k, v := range sd.Attributes {
+			s.Attributes = append(s.Attributes, otlpKeyValue{Key: k, Value: otlpAttribute(v)})
+		}
+		out = append(out, s)
+	}
+
+	service := "faasnap"
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue{StringValue: &service}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "faasnap"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttribute(v interface{}) otlpValue {
+	switch v := v.(type) {
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+// invocationTiming breaks the time of an invocation down by the spans of its
+// trace.
+func invocationTiming(start string, spans []*trace.SpanData, total time.Duration) *models.InvocationTiming {
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	t := &models.InvocationTiming{
+		Start:   start,
+		TotalMs: ms(total),
+	}
+	vmmStarted := false
+	for _, sd := range spans {
+		d := ms(sd.EndTime.Sub(sd.StartTime))
+		switch {
+		case sd.Name == "start_vmm", strings.HasPrefix(sd.Name, "doStartVM_"):
+			t.VmmStartMs += d
+			vmmStarted = true
+		case sd.Name == "reap.Register", sd.Name == "MemoryManager.Activate":
+			t.ReapActivateMs += d
+		case sd.Name == "request_load_snapshot":
+			t.SnapshotLoadMs += d
+		case sd.Name == "vm_resume":
+			t.ResumeMs += d
+		case sd.Name == "load_mincore", sd.Name == "load_ws_file", sd.Name == "MemoryManager.FetchState":
+			t.PrefetchMs += d
+		case sd.Name == "inject_env":
+			t.EnvMs += d
+		case strings.HasPrefix(sd.Name, "invoke_") && sd.Name != "invoke_dmesg":
+			t.ExecutionMs += d
+		}
+		if pages, ok := sd.Attributes["pages"].(int64); ok {
+			t.PrefetchedPages += pages
+		}
+	}
+	t.VmmFromPool = start != startCold && start != startWarm && !vmmStarted
+	return t
+}
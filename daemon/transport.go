@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ucsdsysnet/faasnap/agent"
+)
+
+const (
+	TransportHTTP  = "http"  // reach the guest agent over the VM network
+	TransportVsock = "vsock" // reach the guest agent over the firecracker vsock device
+
+	// vsockUds is the host side socket of the vsock device. It is relative to
+	// the working directory of firecracker, so VMs restored from the same
+	// snapshot get their own socket.
+	vsockUds      = "vsock.sock"
+	vsockGuestCid = 3
+)
+
+type Vsock struct {
+	VsockId  string `json:"vsock_id"`
+	GuestCid int    `json:"guest_cid"`
+	UdsPath  string `json:"uds_path"`
+}
+
+// Transport connects the daemon to the agent in a guest.
+type Transport interface {
+	// Client returns the client and base URL for the agent in vm.
+	Client(vm *VM) (*http.Client, string)
+	// Device returns the vsock device the transport needs, if any.
+	Device() *Vsock
+}
+
+func newTransport(config *Config) Transport {
+	if config.Transport == TransportVsock {
+		return &vsockTransport{}
+	}
+	return &httpTransport{client: &http.Client{}}
+}
+
+type httpTransport struct {
+	client *http.Client
+}
+
+func (t *httpTransport) Client(vm *VM) (*http.Client, string) {
+	return t.client, fmt.Sprintf("http://%s:%d", vm.VMNetwork.uniqueAddr, agent.HTTPPort)
+}
+
+func (t *httpTransport) Device() *Vsock {
+	return nil
+}
+
+type vsockTransport struct{}
+
+func (t *vsockTransport) Client(vm *VM) (*http.Client, string) {
+	uds := vm.VmPath + "/" + vsockUds
+	return &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true, // every connection needs its own handshake
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialVsock(ctx, uds, agent.VsockPort)
+			},
+		},
+	}, "http://localhost"
+}
+
+func (t *vsockTransport) Device() *Vsock {
+	return &Vsock{VsockId: "vsock0", GuestCid: vsockGuestCid, UdsPath: vsockUds}
+}
+
+// dialVsock connects to port in the guest through the host side socket of a
+// firecracker vsock device.
+func dialVsock(ctx context.Context, uds string, port int) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", uds)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// read the reply byte by byte so no response data is consumed
+	var line strings.Builder
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		line.WriteByte(buf[0])
+	}
+	if !strings.HasPrefix(line.String(), "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("vsock connect to port %d failed: %q", port, line.String())
+	}
+	return conn, nil
+}
@@ -23,14 +23,12 @@
 package daemon
 
 import (
-	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
-	"strconv"
-	"strings"
 	"time"
 	"unsafe"
 
@@ -63,6 +61,70 @@ func CopyFile(dst, src string) error {
 	return err
 }
 
+// FileExtents calls fn with the offset and length of each data extent of f,
+// skipping the holes of a sparse file.
+func FileExtents(f *os.File, fn func(offset, length int64) error) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fd := int(f.Fd())
+	for offset := int64(0); offset < fi.Size(); {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO { // no data after offset
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+		if err := fn(start, end-start); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+// ApplyDiffFile writes the data extents of the sparse file diff into dst at
+// the same offsets.
+func ApplyDiffFile(dst, diff string) error {
+	source, err := os.Open(diff)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(dst, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+	if err := FileExtents(source, func(offset, length int64) error {
+		if _, err := destination.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.Copy(destination, io.NewSectionReader(source, offset, length))
+		return err
+	}); err != nil {
+		return err
+	}
+	return destination.Sync()
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never observe a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func FileMincore(f *os.File, size int64) ([]bool, error) {
 	// borrowed from https://github.com/tobert/pcstat/blob/master/mincore.go
 	//skip could not mmap error when the file size is 0
@@ -174,7 +236,7 @@ func ScanFileMincore(f *os.File, size int64, startLayer int, interval int, stop
 	return mc, nlayers + startLayer, nil
 }
 
-func ScanFileMincoreBySize(f *os.File, size int64, startLayer int, pid, sizeIncr int, stop chan bool) ([]int, int, error) {
+func ScanFileMincoreBySize(f *os.File, size int64, startLayer int, rss func() (int, error), sizeIncr int, stop chan bool) ([]int, int, error) {
 	// borrowed from https://github.com/tobert/pcstat/blob/master/mincore.go
 	//skip could not mmap error when the file size is 0
 	if int(size) == 0 {
@@ -211,30 +273,20 @@ func ScanFileMincoreBySize(f *os.File, size int64, startLayer int, pid, sizeIncr
 	nlayers := 0
 	var running bool = true
 	reachSize := make(chan bool)
+	scanned := make(chan struct{}) // tells the size poller to stop
+	defer close(scanned)
 
 	getSize := func() (int, error) {
-		data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/smaps_rollup")
+		size, err := rss()
 		if err != nil {
-			log.Println("read prof file", err)
-			return 0, err
+			log.Println("reading rss", err)
 		}
-		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
-			if strings.HasPrefix(line, "Rss:") {
-				fields := strings.Fields(line)
-				intVar, err := strconv.Atoi(fields[len(fields)-2])
-				if err != nil {
-					log.Println("parsing integer", fields[len(fields)-2], err)
-					return 0, err
-				}
-				return intVar, nil
-			}
-		}
-		return 0, errors.New("rss not found")
+		return size, err
 	}
 
 	go func() {
 		cur := 0
-		for running {
+		for {
 			rssSize, err := getSize()
 			if err != nil {
 				log.Println("get size error")
@@ -245,9 +297,17 @@ func ScanFileMincoreBySize(f *os.File, size int64, startLayer int, pid, sizeIncr
 			if rssSize/4 >= cur+sizeIncr {
 				log.Println("oversize: ", rssSize/4-cur-sizeIncr)
 				cur = rssSize / 4
-				reachSize <- true
+				select {
+				case reachSize <- true:
+				case <-scanned:
+					return
+				}
 			} else {
-				time.Sleep(4 * time.Millisecond)
+				select {
+				case <-time.After(4 * time.Millisecond):
+				case <-scanned:
+					return
+				}
 			}
 		}
 	}()
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	vmStateRunning  = "running"
+	vmStateBusy     = "busy"
+	vmStateIdle     = "idle"
+	vmStateStopping = "stopping"
+)
+
+// WarmPoolConfig controls the per-function pool of warm VMs kept alive
+// between invocations. The pool is disabled when MaxWarm is 0.
+type WarmPoolConfig struct {
+	IdleTimeoutMs int `json:"idle_timeout_ms"` // stop VMs idle for longer than this; 0 keeps them forever
+	MaxWarm       int `json:"max_warm"`        // max idle VMs kept per function
+}
+
+func (vc *VMController) warmPoolEnabled() bool {
+	return vc.config.WarmPool.MaxWarm > 0
+}
+
+// AcquireIdle picks the most recently used idle VM of function, marks it busy
+// and returns its id. An empty namespace matches any namespace. It returns ""
+// when no idle VM is available.
+func (vc *VMController) AcquireIdle(function, namespace string) string {
+	vc.Lock()
+	defer vc.Unlock()
+	var found *VM
+	for _, vm := range vc.Machines {
+		if vm.State != vmStateIdle || vm.Function != function {
+			continue
+		}
+		if namespace != "" && (vm.VMNetwork == nil || vm.VMNetwork.namespace != namespace) {
+			continue
+		}
+		if found == nil || vm.LastUsed.After(found.LastUsed) {
+			found = vm
+		}
+	}
+	if found == nil {
+		return ""
+	}
+	found.State = vmStateBusy
+	return found.VmId
+}
+
+// MarkBusy marks a VM as serving an invocation. It fails if the VM already
+// serves one or is being stopped.
+func (vc *VMController) MarkBusy(vmID string) error {
+	vc.Lock()
+	defer vc.Unlock()
+	vm, ok := vc.Machines[vmID]
+	if !ok {
+		log.Println("VM not exists")
+		return errors.New("VM not exists")
+	}
+	if vm.State == vmStateBusy || vm.State == vmStateStopping {
+		log.Println("VM", vmID, "is", vm.State)
+		return fmt.Errorf("VM %v is %v", vmID, vm.State)
+	}
+	vm.State = vmStateBusy
+	return nil
+}
+
+// MarkRunning takes a VM out of the warm pool without stopping it, e.g.
+// after a failed invocation.
+func (vc *VMController) MarkRunning(vmID string) {
+	vc.setState(vmID, vmStateRunning)
+}
+
+func (vc *VMController) setState(vmID, state string) {
+	vc.Lock()
+	defer vc.Unlock()
+	if vm, ok := vc.Machines[vmID]; ok && vm.State != vmStateStopping {
+		vm.State = state
+	}
+}
+
+// Release puts a VM the daemon started for an invocation in the warm pool,
+// marking it idle so that later invocations of its function can reuse it.
+// VMs owned by clients must not be released. Idle VMs beyond MaxWarm are
+// stopped in least-recently-used order.
+func (vc *VMController) Release(vmID string) {
+	vc.Lock()
+	vm, ok := vc.Machines[vmID]
+	if !ok || vm.State == vmStateStopping {
+		vc.Unlock()
+		return
+	}
+	vm.State = vmStateIdle
+	vm.LastUsed = time.Now()
+	var evict []string
+	if vc.warmPoolEnabled() {
+		idle := []*VM{}
+		for _, other := range vc.Machines {
+			if other.State == vmStateIdle && other.Function == vm.Function {
+				idle = append(idle, other)
+			}
+		}
+		sort.Slice(idle, func(i, j int) bool { return idle[i].LastUsed.Before(idle[j].LastUsed) })
+		for i := 0; i < len(idle)-vc.config.WarmPool.MaxWarm; i++ {
+			idle[i].State = vmStateStopping
+			evict = append(evict, idle[i].VmId)
+		}
+	}
+	vc.Unlock()
+
+	for _, id := range evict {
+		log.Println("evicting warm VM", id)
+		if err := vc.StopVM(nil, id); err != nil {
+			log.Println("evicting warm VM", id, "failed:", err)
+		}
+	}
+}
+
+// reapIdle stops the warm VMs that have been idle for longer than the timeout.
+func (vc *VMController) reapIdle(timeout time.Duration) {
+	var expired []string
+	vc.Lock()
+	for _, vm := range vc.Machines {
+		if vm.State == vmStateIdle && time.Since(vm.LastUsed) > timeout {
+			vm.State = vmStateStopping
+			expired = append(expired, vm.VmId)
+		}
+	}
+	vc.Unlock()
+
+	for _, id := range expired {
+		log.Println("stopping idle VM", id)
+		if err := vc.StopVM(nil, id); err != nil {
+			log.Println("stopping idle VM", id, "failed:", err)
+		}
+	}
+}
+
+// StartIdleReaper periodically stops idle warm VMs according to the warm pool
+// configuration. It does nothing if the pool or the idle timeout is disabled.
+func (vc *VMController) StartIdleReaper() {
+	if !vc.warmPoolEnabled() || vc.config.WarmPool.IdleTimeoutMs <= 0 {
+		return
+	}
+	timeout := time.Duration(vc.config.WarmPool.IdleTimeoutMs) * time.Millisecond
+	interval := timeout / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	go func() {
+		for range time.Tick(interval) {
+			vc.reapIdle(timeout)
+		}
+	}()
+}
@@ -7,7 +7,6 @@ require (
 	contrib.go.opencensus.io/exporter/zipkin v0.1.2
 	github.com/asaskevich/govalidator v0.0.0-20210307081110-f21760c49a8d // indirect
 	github.com/ease-lab/vhive/metrics v0.0.0-20210607161503-ce9e244976f7
-	github.com/ftrvxmtrx/fd v0.0.0-20150925145434-c6d800382fff
 	github.com/go-openapi/analysis v0.20.1 // indirect
 	github.com/go-openapi/errors v0.20.0
 	github.com/go-openapi/jsonreference v0.19.6 // indirect
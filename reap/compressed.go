@@ -0,0 +1,421 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package reap
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// A compressed mem file holds the blocks of a guest memory file one after
+// another, each compressed on its own so that any page can be read without
+// the blocks before it:
+//
+//	magic "FSCMEMF" | version byte | codec byte | block size, 8 bytes | memory size, 8 bytes |
+//	blocks |
+//	index: offset, 8 bytes | length, 4 bytes | kind byte, for each block |
+//	block count, 8 bytes | index offset, 8 bytes | CRC-32 (IEEE) of the index and the two counts, 4 bytes
+//
+// All integers are little endian. Zero blocks take no space, and blocks that
+// do not compress or are asked to be kept raw are stored as they are.
+const (
+	compressedMagic   = "FSCMEMF"
+	compressedVersion = 1
+	compressedHeader  = len(compressedMagic) + 2 + 16
+	compressedEntry   = 13
+	compressedTrailer = 20
+
+	codecDeflate = 1
+)
+
+// block kinds
+const (
+	blockZero = iota
+	blockRaw
+	blockCompressed
+)
+
+type blockEntry struct {
+	offset int64
+	length uint32
+	kind   byte
+}
+
+// CompressMemory writes a compressed copy of the guest memory file src to
+// dst, in blocks of blockSize bytes, a multiple of the page size. Blocks for
+// which raw returns true are not compressed. It returns the size of dst.
+func CompressMemory(src, dst string, blockSize, level int, raw func(block int64) bool) (int64, error) {
+	if blockSize <= 0 || blockSize%os.Getpagesize() != 0 {
+		return 0, fmt.Errorf("block size %d is not a multiple of the page size", blockSize)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp) // gone once renamed
+	defer out.Close()
+
+	header := make([]byte, 0, compressedHeader)
+	header = append(header, compressedMagic...)
+	header = append(header, compressedVersion, codecDeflate)
+	header = appendUint64(header, uint64(blockSize))
+	header = appendUint64(header, uint64(fi.Size()))
+	if _, err := out.Write(header); err != nil {
+		return 0, err
+	}
+
+	var compressed bytes.Buffer
+	zw, err := flate.NewWriter(&compressed, level)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, blockSize)
+	zeros := make([]byte, blockSize)
+	offset := int64(len(header))
+	index := []blockEntry{}
+	for block := int64(0); block*int64(blockSize) < fi.Size(); block++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		data := buf[:n]
+		entry := blockEntry{offset: offset}
+		switch {
+		case bytes.Equal(data, zeros[:n]):
+			entry.kind = blockZero
+		case raw != nil && raw(block):
+			entry.kind = blockRaw
+		default:
+			compressed.Reset()
+			zw.Reset(&compressed)
+			if _, err := zw.Write(data); err != nil {
+				return 0, err
+			}
+			if err := zw.Close(); err != nil {
+				return 0, err
+			}
+			entry.kind = blockCompressed
+			if compressed.Len() >= n {
+				entry.kind = blockRaw
+			} else {
+				data = compressed.Bytes()
+			}
+		}
+		if entry.kind != blockZero {
+			if _, err := out.Write(data); err != nil {
+				return 0, err
+			}
+			entry.length = uint32(len(data))
+			offset += int64(len(data))
+		}
+		index = append(index, entry)
+	}
+
+	table := make([]byte, 0, len(index)*compressedEntry+compressedTrailer)
+	for _, entry := range index {
+		table = appendUint64(table, uint64(entry.offset))
+		table = appendUint32(table, entry.length)
+		table = append(table, entry.kind)
+	}
+	table = appendUint64(table, uint64(len(index)))
+	table = appendUint64(table, uint64(offset))
+	table = appendUint32(table, crc32.ChecksumIEEE(table))
+	if _, err := out.Write(table); err != nil {
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return 0, err
+	}
+	return offset + int64(len(table)), nil
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var word [8]byte
+	binary.LittleEndian.PutUint64(word[:], v)
+	return append(buf, word[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var word [4]byte
+	binary.LittleEndian.PutUint32(word[:], v)
+	return append(buf, word[:]...)
+}
+
+// CompressedMemory reads guest memory from a compressed mem file. Concurrent
+// reads decompress with blockReaders of their own, each keeping the last
+// block it read.
+type CompressedMemory struct {
+	sync.Mutex // guards readers
+	f          *os.File
+	blockSize  int64
+	size       int64
+	index      []blockEntry
+	readers    []*blockReader // idle
+}
+
+// blockReader decompresses the blocks of a CompressedMemory for one reader at
+// a time.
+type blockReader struct {
+	m      *CompressedMemory
+	zr     io.ReadCloser
+	cached int64 // block in buf, -1 if none
+	buf    []byte
+	in     []byte
+}
+
+// OpenCompressedMemory opens a compressed mem file.
+func OpenCompressedMemory(path string) (*CompressedMemory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readCompressedIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return m, nil
+}
+
+func readCompressedIndex(f *os.File) (*CompressedMemory, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, compressedHeader)
+	if _, err := f.ReadAt(header, 0); err != nil || !bytes.Equal(header[:len(compressedMagic)], []byte(compressedMagic)) {
+		return nil, errors.New("not a compressed mem file")
+	}
+	header = header[len(compressedMagic):]
+	if header[0] != compressedVersion || header[1] != codecDeflate {
+		return nil, fmt.Errorf("unsupported version %d or codec %d", header[0], header[1])
+	}
+	m := &CompressedMemory{
+		f:         f,
+		blockSize: int64(binary.LittleEndian.Uint64(header[2:])),
+		size:      int64(binary.LittleEndian.Uint64(header[10:])),
+	}
+	if m.blockSize <= 0 || m.blockSize%int64(os.Getpagesize()) != 0 {
+		return nil, fmt.Errorf("bad block size %d", m.blockSize)
+	}
+
+	trailer := make([]byte, compressedTrailer)
+	if fi.Size() < int64(compressedHeader+compressedTrailer) {
+		return nil, errors.New("truncated")
+	}
+	if _, err := f.ReadAt(trailer, fi.Size()-compressedTrailer); err != nil {
+		return nil, err
+	}
+	count := int64(binary.LittleEndian.Uint64(trailer))
+	indexOffset := int64(binary.LittleEndian.Uint64(trailer[8:]))
+	if count != (m.size+m.blockSize-1)/m.blockSize || indexOffset+count*compressedEntry+compressedTrailer != fi.Size() {
+		return nil, errors.New("bad index")
+	}
+	table := make([]byte, count*compressedEntry+compressedTrailer)
+	if _, err := f.ReadAt(table, indexOffset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(table[:len(table)-4]) != binary.LittleEndian.Uint32(table[len(table)-4:]) {
+		return nil, errors.New("index checksum mismatch")
+	}
+	m.index = make([]blockEntry, count)
+	for i := range m.index {
+		entry := table[i*compressedEntry:]
+		m.index[i] = blockEntry{
+			offset: int64(binary.LittleEndian.Uint64(entry)),
+			length: binary.LittleEndian.Uint32(entry[8:]),
+			kind:   entry[12],
+		}
+		if m.index[i].offset+int64(m.index[i].length) > indexOffset {
+			return nil, fmt.Errorf("block %d out of range", i)
+		}
+	}
+	return m, nil
+}
+
+// Size returns the size of the guest memory.
+func (m *CompressedMemory) Size() int64 {
+	return m.size
+}
+
+// BlockSize returns the size of the blocks the memory is compressed in.
+func (m *CompressedMemory) BlockSize() int64 {
+	return m.blockSize
+}
+
+// Zero reports whether a block is all zeros.
+func (m *CompressedMemory) Zero(block int64) bool {
+	return m.index[block].kind == blockZero
+}
+
+// reader returns an idle blockReader, to give back with put once the blocks
+// it read are no longer used.
+func (m *CompressedMemory) reader() *blockReader {
+	m.Lock()
+	defer m.Unlock()
+	if n := len(m.readers); n > 0 {
+		r := m.readers[n-1]
+		m.readers = m.readers[:n-1]
+		return r
+	}
+	return &blockReader{m: m, cached: -1, buf: make([]byte, m.blockSize)}
+}
+
+func (m *CompressedMemory) put(r *blockReader) {
+	m.Lock()
+	defer m.Unlock()
+	m.readers = append(m.readers, r)
+}
+
+// block returns the contents of a block. The slice is valid until the next
+// block is read with r.
+func (r *blockReader) block(block int64) ([]byte, error) {
+	m := r.m
+	if block < 0 || block >= int64(len(m.index)) {
+		return nil, fmt.Errorf("block %d out of range", block)
+	}
+	length := m.blockSize
+	if rest := m.size - block*m.blockSize; rest < length {
+		length = rest
+	}
+	data := r.buf[:length]
+	if r.cached == block {
+		return data, nil
+	}
+	r.cached = -1
+	entry := m.index[block]
+	switch entry.kind {
+	case blockZero:
+		for i := range data {
+			data[i] = 0
+		}
+	case blockRaw:
+		if _, err := m.f.ReadAt(data, entry.offset); err != nil {
+			return nil, fmt.Errorf("reading block %d: %v", block, err)
+		}
+	case blockCompressed:
+		if cap(r.in) < int(entry.length) {
+			r.in = make([]byte, entry.length)
+		}
+		in := r.in[:entry.length]
+		if _, err := m.f.ReadAt(in, entry.offset); err != nil {
+			return nil, fmt.Errorf("reading block %d: %v", block, err)
+		}
+		if r.zr == nil {
+			r.zr = flate.NewReader(bytes.NewReader(in))
+		} else if err := r.zr.(flate.Resetter).Reset(bytes.NewReader(in), nil); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r.zr, data); err != nil {
+			return nil, fmt.Errorf("decompressing block %d: %v", block, err)
+		}
+	default:
+		return nil, fmt.Errorf("block %d of unknown kind %d", block, entry.kind)
+	}
+	r.cached = block
+	return data, nil
+}
+
+func (m *CompressedMemory) ReadAt(p []byte, off int64) (int, error) {
+	r := m.reader()
+	defer m.put(r)
+	n := 0
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur >= m.size {
+			return n, io.EOF
+		}
+		data, err := r.block(cur / m.blockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[cur%m.blockSize:])
+	}
+	return n, nil
+}
+
+// Close closes the file. Readers must be done with m.
+func (m *CompressedMemory) Close() error {
+	m.Lock()
+	for _, r := range m.readers {
+		if r.zr != nil {
+			r.zr.Close()
+		}
+	}
+	m.readers = nil
+	m.Unlock()
+	return m.f.Close()
+}
+
+// DecompressMemory writes the guest memory in the compressed mem file src to
+// dst, leaving zero blocks as holes.
+func DecompressMemory(src, dst string) error {
+	m, err := OpenCompressedMemory(src)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := out.Truncate(m.size); err != nil {
+		return err
+	}
+	r := m.reader()
+	defer m.put(r)
+	for block := int64(0); block < int64(len(m.index)); block++ {
+		if m.Zero(block) {
+			continue
+		}
+		data, err := r.block(block)
+		if err != nil {
+			return err
+		}
+		if _, err := out.WriteAt(data, block*m.blockSize); err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
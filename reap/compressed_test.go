@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package reap
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// compressTestMemory writes guest memory with a zero, an incompressible, a
+// compressible, a hot and a short last block, and compresses it.
+func compressTestMemory(t *testing.T) (string, []byte, int) {
+	t.Helper()
+	dir := t.TempDir()
+	blockSize := 2 * os.Getpagesize()
+	pattern := bytes.Repeat([]byte("faasnap "), blockSize/8)
+	random := make([]byte, blockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	mem := make([]byte, blockSize) // zero
+	mem = append(mem, random...)
+	mem = append(mem, pattern...)
+	mem = append(mem, pattern...) // kept raw
+	mem = append(mem, pattern[:os.Getpagesize()+100]...)
+
+	src, dst := filepath.Join(dir, "memfile"), filepath.Join(dir, "memfile.z")
+	if err := ioutil.WriteFile(src, mem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size, err := CompressMemory(src, dst, blockSize, flate.BestSpeed, func(block int64) bool { return block == 3 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dst); err != nil || fi.Size() != size {
+		t.Fatalf("compressed mem file of %d bytes: %v", size, err)
+	}
+	return dst, mem, blockSize
+}
+
+func TestCompressedMemory(t *testing.T) {
+	path, mem, blockSize := compressTestMemory(t)
+	m, err := OpenCompressedMemory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Size() != int64(len(mem)) || m.BlockSize() != int64(blockSize) {
+		t.Fatalf("size %d and block size %d, want %d and %d", m.Size(), m.BlockSize(), len(mem), blockSize)
+	}
+	kinds := []byte{blockZero, blockRaw, blockCompressed, blockRaw, blockCompressed}
+	if len(m.index) != len(kinds) {
+		t.Fatalf("%d blocks, want %d", len(m.index), len(kinds))
+	}
+	for i, kind := range kinds {
+		if m.index[i].kind != kind {
+			t.Errorf("block %d of kind %d, want %d", i, m.index[i].kind, kind)
+		}
+	}
+	if !m.Zero(0) || m.Zero(1) {
+		t.Error("zero blocks misreported")
+	}
+
+	got := make([]byte, len(mem))
+	if n, err := m.ReadAt(got, 0); err != nil || n != len(mem) || !bytes.Equal(got, mem) {
+		t.Fatalf("read %d bytes, %v; contents equal: %v", n, err, bytes.Equal(got, mem))
+	}
+	// reads across blocks, from concurrent readers
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			buf := make([]byte, 100)
+			for off := int64(w); off+int64(len(buf)) <= int64(len(mem)); off += int64(blockSize) / 3 {
+				if _, err := m.ReadAt(buf, off); err != nil || !bytes.Equal(buf, mem[off:off+int64(len(buf))]) {
+					t.Errorf("reading at %d: %v", off, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	tail := make([]byte, 200)
+	if n, err := m.ReadAt(tail, int64(len(mem)-100)); err != io.EOF || n != 100 || !bytes.Equal(tail[:n], mem[len(mem)-100:]) {
+		t.Errorf("read %d bytes at the end, %v", n, err)
+	}
+
+	out := filepath.Join(filepath.Dir(path), "memfile.out")
+	if err := DecompressMemory(path, out); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(out); err != nil || !bytes.Equal(data, mem) {
+		t.Fatalf("decompressed mem file differs: %v", err)
+	}
+}
+
+func TestCompressedMemoryCorrupted(t *testing.T) {
+	path, _, _ := compressTestMemory(t)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bad := range map[string][]byte{
+		"index":     append(append([]byte{}, data[:len(data)-compressedTrailer-1]...), append([]byte{data[len(data)-compressedTrailer-1] ^ 1}, data[len(data)-compressedTrailer:]...)...),
+		"checksum":  append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^1),
+		"truncated": data[:len(data)-1],
+		"header":    append([]byte("NOTCMEM"), data[len(compressedMagic):]...),
+	} {
+		corrupted := filepath.Join(filepath.Dir(path), name)
+		if err := ioutil.WriteFile(corrupted, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := OpenCompressedMemory(corrupted); err == nil {
+			m.Close()
+			t.Errorf("opened a compressed mem file with a bad %v", name)
+		}
+	}
+	if _, err := CompressMemory(path, path+".z", os.Getpagesize()+1, flate.BestSpeed, nil); err == nil {
+		t.Error("compressed with a block size that is not a multiple of the page size")
+	}
+}
@@ -0,0 +1,90 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package reap
+
+import "sync"
+
+// faultQueue hands the page faults read by the poller to the fault workers.
+// Pushing never blocks: the poller must keep reading uffd events, or copies
+// of the workers fail with EAGAIN while an event is pending.
+type faultQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	faults  []uint64
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newFaultQueue() *faultQueue {
+	q := new(faultQueue)
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// start runs n goroutines calling serve with each queued fault address.
+func (q *faultQueue) start(n int, serve func(address uint64)) {
+	for i := 0; i < n; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for {
+				address, ok := q.pop()
+				if !ok {
+					return
+				}
+				serve(address)
+			}
+		}()
+	}
+}
+
+func (q *faultQueue) push(address uint64) {
+	q.Lock()
+	q.faults = append(q.faults, address)
+	q.Unlock()
+	q.cond.Signal()
+}
+
+// pop waits for a fault. It returns false once the queue is closed and empty.
+func (q *faultQueue) pop() (uint64, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.faults) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.faults) == 0 {
+		return 0, false
+	}
+	address := q.faults[0]
+	q.faults = q.faults[1:]
+	return address, true
+}
+
+// stop lets the workers drain the queue and waits for them to return.
+func (q *faultQueue) stop() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.cond.Broadcast()
+	q.workers.Wait()
+}
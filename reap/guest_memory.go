@@ -0,0 +1,120 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package reap
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// GuestMemory tells where the contents of guest memory are read from: a
+// guest memory file, a page store file through a page map, or a compressed
+// mem file.
+type GuestMemory struct {
+	Path string
+	// page of Path holding each guest page, if Path is a page store
+	Pages []uint32
+	// Path is a compressed mem file, see CompressMemory
+	Compressed bool
+}
+
+// memOffset returns the offset in the guest memory file of an offset in guest
+// memory. Not for compressed mem files.
+func (g GuestMemory) memOffset(offset uint64) uint64 {
+	if g.Pages == nil {
+		return offset
+	}
+	pageSize := uint64(os.Getpagesize())
+	return uint64(g.Pages[offset/pageSize])*pageSize + offset%pageSize
+}
+
+// contiguous reports whether n pages of guest memory starting at offset are
+// contiguous in the guest memory file. Not for compressed mem files.
+func (g GuestMemory) contiguous(offset, n uint64) bool {
+	if g.Pages == nil {
+		return true
+	}
+	first := offset / uint64(os.Getpagesize())
+	for i := uint64(1); i < n; i++ {
+		if g.Pages[first+i] != g.Pages[first]+uint32(i) {
+			return false
+		}
+	}
+	return true
+}
+
+type guestMemoryReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// open returns a reader of guest memory.
+func (g GuestMemory) open() (guestMemoryReader, error) {
+	if g.Compressed {
+		m, err := OpenCompressedMemory(g.Path)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	f, err := os.Open(g.Path)
+	if err != nil {
+		return nil, err
+	}
+	if g.Pages == nil {
+		return f, nil
+	}
+	return pagedMemory{f: f, g: g}, nil
+}
+
+// pagedMemory reads guest memory through a page map.
+type pagedMemory struct {
+	f *os.File
+	g GuestMemory
+}
+
+func (m pagedMemory) ReadAt(p []byte, off int64) (int, error) {
+	pageSize := int64(os.Getpagesize())
+	n := 0
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur/pageSize >= int64(len(m.g.Pages)) {
+			return n, io.EOF
+		}
+		length := pageSize - cur%pageSize
+		if length > int64(len(p)-n) {
+			length = int64(len(p) - n)
+		}
+		read, err := m.f.ReadAt(p[n:n+int(length)], int64(m.g.memOffset(uint64(cur))))
+		n += read
+		if err != nil {
+			return n, fmt.Errorf("reading guest page %d: %v", cur/pageSize, err)
+		}
+	}
+	return n, nil
+}
+
+func (m pagedMemory) Close() error {
+	return m.f.Close()
+}
@@ -29,7 +29,9 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -48,7 +50,18 @@ const (
 
 // MemoryManagerCfg Global config of the manager
 type MemoryManagerCfg struct {
-	MetricsModeOn bool
+	MetricsModeOn  bool `json:"metrics"`
+	InstallWorkers int  `json:"install_workers"` // goroutines installing the working set and serving faults, 4 if unset
+	Readahead      int  `json:"readahead"`       // extra pages installed with each fault outside the working set
+	// fail activations when the uffd of the VMM lacks the non-cooperative
+	// events, instead of warning. Firecracker does not send them, see
+	// uffdFeaturesSize
+	RequireEvents bool `json:"require_events"`
+
+	// rebuild the working set when a replay misses at least this many pages,
+	// or this fraction of the working set; 0 disables either
+	RerecordThreshold int     `json:"rerecord_threshold"`
+	RerecordRatio     float64 `json:"rerecord_ratio"`
 }
 
 // MemoryManager Serves page faults coming from VMs
@@ -56,6 +69,9 @@ type MemoryManager struct {
 	sync.Mutex
 	MemoryManagerCfg
 	instances map[string]*SnapshotState // Indexed by vmID
+	// metrics mode of snapshots set through SetMetricsMode, by ssID
+	metricsModes map[string]bool
+	onFailure    func(vmID string, err error)
 }
 
 // NewMemoryManager Initializes a new memory manager
@@ -64,6 +80,7 @@ func NewMemoryManager(cfg MemoryManagerCfg) *MemoryManager {
 
 	m := new(MemoryManager)
 	m.instances = make(map[string]*SnapshotState)
+	m.metricsModes = make(map[string]bool)
 	m.MemoryManagerCfg = cfg
 
 	return m
@@ -79,7 +96,7 @@ func RandStringRunes(n int) string {
 }
 
 // RegisterVM Registers a VM within the memory manager
-func (m *MemoryManager) RegisterVM(ssId, vmmStatePath, guestMemPath, baseDir string, memSize int, wsFileDirectIO bool, wsSingleRead bool) (string, error) {
+func (m *MemoryManager) RegisterVM(ssId, vmmStatePath string, guestMem GuestMemory, baseDir string, memSize int, wsFileDirectIO bool, wsSingleRead bool) (string, error) {
 	m.Lock()
 	defer m.Unlock()
 	logger := log.WithFields(log.Fields{"ssID": ssId})
@@ -88,6 +105,7 @@ func (m *MemoryManager) RegisterVM(ssId, vmmStatePath, guestMemPath, baseDir str
 		logger.Info("Already registered, making a copy")
 		state := NewSnapshotState(existing.SnapshotStateCfg)
 		state.VMID = ssId + "-" + RandStringRunes(4)
+		state.ssID = ssId
 		state.InstanceSockAddr = state.BaseDir + "/uffd-" + state.VMID + ".sock"
 
 		state.trace = existing.trace
@@ -106,7 +124,7 @@ func (m *MemoryManager) RegisterVM(ssId, vmmStatePath, guestMemPath, baseDir str
 	cfg := SnapshotStateCfg{
 		VMID:             ssId,
 		VMMStatePath:     vmmStatePath,
-		GuestMemPath:     guestMemPath,
+		GuestMem:         guestMem,
 		WorkingSetPath:   baseDir + "/working_set",
 		InstanceSockAddr: baseDir + "/uffd-" + ssId + ".sock",
 		BaseDir:          baseDir + "/",        // base directory for the instance
@@ -116,10 +134,30 @@ func (m *MemoryManager) RegisterVM(ssId, vmmStatePath, guestMemPath, baseDir str
 		metricsModeOn:    false,
 		WSFileDirectIO:   wsFileDirectIO,
 		WSSingleRead:     wsSingleRead,
+		InstallWorkers:   m.InstallWorkers,
+		Readahead:        m.Readahead,
 	}
 
 	cfg.metricsModeOn = m.MetricsModeOn
 	state := NewSnapshotState(cfg)
+	state.ssID = ssId
+	state.collectMetrics = m.MetricsModeOn
+	if on, ok := m.metricsModes[ssId]; ok {
+		state.collectMetrics = on
+	}
+
+	// replay straight away if an earlier daemon processed a record
+	if _, err := os.Stat(state.getTraceFile()); err == nil {
+		if _, err := os.Stat(cfg.WorkingSetPath); err != nil {
+			logger.Warn("Ignoring the saved trace, the working set is missing: ", err)
+		} else if err := state.trace.readTrace(); err != nil {
+			logger.Warn("Ignoring the saved trace: ", err)
+			state.trace = initTrace(state.getTraceFile())
+		} else {
+			logger.Info("Loaded the saved trace")
+			state.isRecordReady = true
+		}
+	}
 
 	m.instances[cfg.VMID] = state
 
@@ -151,6 +189,33 @@ func (m *MemoryManager) DeregisterVM(vmID string) error {
 	return nil
 }
 
+// DeregisterSnapshot Deregisters a snapshot and all the instances copied from it
+func (m *MemoryManager) DeregisterSnapshot(ssId string) error {
+	logger := log.WithFields(log.Fields{"ssID": ssId})
+
+	m.Lock()
+	ids := []string{}
+	for id, state := range m.instances {
+		if id != ssId && !strings.HasPrefix(id, ssId+"-") {
+			continue
+		}
+		if state.isActive {
+			m.Unlock()
+			logger.Error("Failed to deregister, instance ", id, " still active")
+			return fmt.Errorf("reap instance %s still active", id)
+		}
+		ids = append(ids, id)
+	}
+	m.Unlock()
+
+	for _, id := range ids {
+		if err := m.DeregisterVM(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *MemoryManager) ClearCache(ssId string) error {
 	if state, ok := m.instances[ssId]; ok {
 		f, err := os.OpenFile(state.SnapshotStateCfg.WorkingSetPath, os.O_RDWR, 0644)
@@ -177,16 +242,18 @@ func (m *MemoryManager) Activate(ctx context.Context, vmID string) error {
 	var (
 		ok      bool
 		state   *SnapshotState
-		readyCh chan int = make(chan int)
+		readyCh chan error = make(chan error)
 	)
 
 	m.Lock()
 
 	state, ok = m.instances[vmID]
 	if !ok {
+		m.Unlock()
 		logger.Error("VM not registered with the memory manager")
 		return errors.New("VM not registered with the memory manager")
 	}
+	state.onFail = m.onFailure
 
 	m.Unlock()
 
@@ -205,11 +272,21 @@ func (m *MemoryManager) Activate(ctx context.Context, vmID string) error {
 		return err
 	}
 
-	state.setupStateOnActivate()
+	if err := state.checkEvents(m.RequireEvents); err != nil {
+		state.userFaultFD.Close()
+		return err
+	}
+
+	if err := state.setupStateOnActivate(); err != nil {
+		return err
+	}
 
 	go state.pollUserPageFaults(readyCh)
 
-	<-readyCh
+	if err := <-readyCh; err != nil {
+		logger.Error("Failed to start polling page faults")
+		return err
+	}
 
 	return nil
 }
@@ -235,17 +312,33 @@ func (m *MemoryManager) FetchState(ctx context.Context, vmID string) error {
 
 	state, ok = m.instances[vmID]
 	if !ok {
+		m.Unlock()
 		logger.Error("VM not registered with the memory manager")
 		return errors.New("VM not registered with the memory manager")
 	}
 
-	m.Unlock()
+	m.refresh(state)
+	if state.metricsModeOn {
+		state.currentMetric = metrics.NewMetric()
+	}
 
+	// opened with the manager locked so that it matches the trace
+	var wsFile *os.File
 	if state.isRecordReady && !state.IsLazyMode {
+		if wsFile, err = state.openWorkingSet(); err != nil {
+			m.Unlock()
+			return err
+		}
+	}
+
+	m.Unlock()
+
+	if wsFile != nil {
+		span.AddAttributes(trace.Int64Attribute("pages", int64(len(state.trace.trace))))
 		if state.metricsModeOn {
 			tStart = time.Now()
 		}
-		err = state.fetchState()
+		err = state.fetchState(wsFile)
 		if state.metricsModeOn {
 			state.currentMetric.MetricMap[fetchStateMetric] = metrics.ToUS(time.Since(tStart))
 			logger.Info("metricmap: ", state.currentMetric.MetricMap)
@@ -268,6 +361,7 @@ func (m *MemoryManager) Deactivate(vmID string) ([]uint64, error) {
 
 	state, ok = m.instances[vmID]
 	if !ok {
+		m.Unlock()
 		logger.Error("VM not registered with the memory manager")
 		return nil, errors.New("VM not registered with the memory manager")
 	}
@@ -283,25 +377,64 @@ func (m *MemoryManager) Deactivate(vmID string) ([]uint64, error) {
 		return nil, errors.New("VM not activated")
 	}
 
-	state.quitCh <- 0
+	state.stopPolling()
+	state.installWg.Wait()
+	if state.metricsModeOn && state.isRecordReady && !state.IsLazyMode {
+		state.currentMetric.MetricMap[installWSMetric] = metrics.ToUS(state.wsInstallTime)
+	}
 	if err := state.unmapGuestMemory(); err != nil {
 		logger.Error("Failed to munmap guest memory")
 		return nil, err
 	}
 
+	if failure := state.Failure(); failure != nil {
+		// the record of a failed instance is incomplete, keep the old one
+		state.userFaultFD.Close()
+		state.isActive = false
+		os.Remove(state.InstanceSockAddr)
+		return nil, failure
+	}
+
 	records := []uint64{}
 	for _, r := range state.trace.trace {
 		records = append(records, r.offset)
 	}
+	m.Lock()
 	state.processMetrics()
+	m.foldMetrics(state)
+	m.Unlock()
 
 	state.userFaultFD.Close()
+	state.isActive = false
 	if !state.isRecordReady && !state.IsLazyMode {
-		state.trace.ProcessRecord(state.GuestMemPath, state.WorkingSetPath)
+		if err := state.trace.ProcessRecord(state.GuestMem, state.WorkingSetPath); err != nil {
+			logger.Error("Failed to process the record")
+			return nil, err
+		}
+		if err := state.trace.WriteTrace(); err != nil {
+			logger.Error("Failed to save the trace")
+			return nil, err
+		}
+	}
+
+	if state.isRecordReady && !state.IsLazyMode {
+		if len(state.missed) > 0 {
+			logger.Infof("%d page faults missed the working set", len(state.missed))
+		}
+		if m.drifted(state) {
+			m.mergeMissed(state)
+		}
 	}
 
+	if !state.isRecordReady {
+		// instances registered later replay this record
+		m.Lock()
+		if base, ok := m.instances[state.ssID]; ok && base.trace == state.trace {
+			base.isRecordReady = true
+		}
+		m.Unlock()
+	}
 	state.isRecordReady = true
-	state.isActive = false
 
 	if err := os.Remove(state.InstanceSockAddr); err != nil {
 		logger.Error("removing file failed: ", err.Error())
@@ -310,6 +443,25 @@ func (m *MemoryManager) Deactivate(vmID string) ([]uint64, error) {
 	return records, nil
 }
 
+// SetFailureHandler sets the function called when an instance fails serving
+// page faults, e.g. to kill its VM.
+func (m *MemoryManager) SetFailureHandler(handler func(vmID string, err error)) {
+	m.Lock()
+	defer m.Unlock()
+	m.onFailure = handler
+}
+
+// Failure returns the error an instance failed with, if any.
+func (m *MemoryManager) Failure(vmID string) error {
+	m.Lock()
+	state, ok := m.instances[vmID]
+	m.Unlock()
+	if !ok {
+		return nil
+	}
+	return state.Failure()
+}
+
 // DumpUPFPageStats Saves the per VM stats
 func (m *MemoryManager) DumpUPFPageStats(vmID, functionName, metricsOutFilePath string) error {
 	var (
@@ -336,7 +488,7 @@ func (m *MemoryManager) DumpUPFPageStats(vmID, functionName, metricsOutFilePath
 		return errors.New("Cannot get stats while VM is active")
 	}
 
-	if !m.MetricsModeOn || !state.metricsModeOn {
+	if !state.metricsModeOn {
 		logger.Error("Metrics mode is not on")
 		return errors.New("Metrics mode is not on")
 	}
@@ -371,7 +523,7 @@ func (m *MemoryManager) DumpUPFLatencyStats(vmID, functionName, latencyOutFilePa
 		return errors.New("Cannot get stats while VM is active")
 	}
 
-	if !m.MetricsModeOn || !state.metricsModeOn {
+	if !state.metricsModeOn {
 		logger.Error("Metrics mode is not on")
 		return errors.New("Metrics mode is not on")
 	}
@@ -401,7 +553,7 @@ func (m *MemoryManager) GetUPFLatencyStats(vmID string) ([]*metrics.Metric, erro
 		return nil, errors.New("Cannot get stats while VM is active")
 	}
 
-	if !m.MetricsModeOn || !state.metricsModeOn {
+	if !state.metricsModeOn {
 		logger.Error("Metrics mode is not on")
 		return nil, errors.New("Metrics mode is not on")
 	}
@@ -492,3 +644,254 @@ func writeUPFPageStats(metricsOutFilePath string, statHeader, stats []string) er
 
 	return nil
 }
+
+// pendingRecord is a record of a snapshot waiting for its first instance to
+// be inactive to replace the current one.
+type pendingRecord struct {
+	trace      *Trace
+	workingSet string // rebuilt working set file, moved to WorkingSetPath when applied
+	ready      bool   // false when the snapshot is to be recorded from scratch
+}
+
+// refresh points an inactive instance at the current record of its snapshot.
+// Called with the manager locked.
+func (m *MemoryManager) refresh(state *SnapshotState) {
+	base, ok := m.instances[state.ssID]
+	if !ok || state.isActive {
+		return
+	}
+	if base.pending != nil && !base.isActive {
+		m.applyRecord(base)
+	}
+	state.metricsModeOn = base.collectMetrics
+	if base == state {
+		return
+	}
+
+	state.trace = base.trace
+	state.isRecordReady = base.isRecordReady
+	if state.WSSingleRead {
+		state.workingSet = base.workingSet
+		state.wsReadOnce = base.wsReadOnce
+		state.wsReadErr = base.wsReadErr
+	}
+}
+
+// applyRecord replaces the record of the first instance of a snapshot with its
+// pending one. Called with the manager locked and the instance inactive.
+func (m *MemoryManager) applyRecord(base *SnapshotState) {
+	logger := log.WithFields(log.Fields{"ssID": base.ssID})
+	p := base.pending
+	base.pending = nil
+
+	if p.ready {
+		if err := os.Rename(p.workingSet, base.WorkingSetPath); err != nil {
+			logger.Error("Failed to replace the working set: ", err)
+			os.Remove(p.workingSet)
+			return
+		}
+		if err := p.trace.WriteTrace(); err != nil {
+			logger.Warn("Failed to save the trace: ", err)
+		}
+		logger.Infof("Replaying the rebuilt working set of %d pages", len(p.trace.trace))
+	} else {
+		// a restarted daemon must not replay the discarded record
+		if err := os.Remove(base.getTraceFile()); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Failed to remove the trace: ", err)
+		}
+		logger.Info("Recording the working set again")
+	}
+
+	base.trace = p.trace
+	base.isRecordReady = p.ready
+	base.workingSet = new([]byte)
+	base.wsReadOnce = new(sync.Once)
+	base.wsReadErr = new(error)
+}
+
+// drifted reports whether an instance missed enough of the working set for it
+// to be rebuilt.
+func (m *MemoryManager) drifted(state *SnapshotState) bool {
+	missed := len(state.missed)
+	if missed == 0 {
+		return false
+	}
+	if m.RerecordThreshold > 0 && missed >= m.RerecordThreshold {
+		return true
+	}
+	return m.RerecordRatio > 0 && float64(missed) >= m.RerecordRatio*float64(len(state.trace.trace))
+}
+
+// mergeMissed rebuilds the working set of the snapshot of an instance in the
+// background, adding the pages the instance missed. Instances activated after
+// the rebuild replay the new working set.
+func (m *MemoryManager) mergeMissed(state *SnapshotState) {
+	logger := log.WithFields(log.Fields{"ssID": state.ssID})
+
+	m.Lock()
+	base, ok := m.instances[state.ssID]
+	// skip if another rebuild is running or the instance replayed an old record
+	if !ok || base.rebuilding || base.pending != nil || base.trace != state.trace {
+		m.Unlock()
+		return
+	}
+	base.rebuilding = true
+	m.Unlock()
+
+	old, missed := state.trace, state.missed
+
+	go func() {
+		t := initTrace(base.getTraceFile())
+		for _, rec := range old.trace {
+			t.AppendRecord(rec)
+		}
+		for _, rec := range missed {
+			if !t.containsRecord(rec) {
+				t.AppendRecord(rec)
+			}
+		}
+
+		tmp := base.WorkingSetPath + ".rebuild"
+		err := t.ProcessRecord(base.GuestMem, tmp)
+
+		m.Lock()
+		defer m.Unlock()
+
+		base.rebuilding = false
+		if err != nil {
+			logger.Error("Failed to rebuild the working set: ", err)
+			os.Remove(tmp)
+			return
+		}
+		if m.instances[base.ssID] != base || base.pending != nil {
+			// deregistered, or a forced re-record came first
+			os.Remove(tmp)
+			return
+		}
+
+		logger.Infof("Rebuilt the working set with %d missed pages", len(t.trace)-len(old.trace))
+		base.pending = &pendingRecord{trace: t, workingSet: tmp, ready: true}
+		if !base.isActive {
+			m.applyRecord(base)
+		}
+	}()
+}
+
+// Rerecord discards the record of a snapshot so that its next activation
+// records the working set from scratch.
+func (m *MemoryManager) Rerecord(ssId, baseDir string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	base, ok := m.instances[ssId]
+	if !ok {
+		// not registered since the daemon started, only the saved trace is left
+		if err := os.Remove(filepath.Join(baseDir, "trace")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if base.pending != nil && base.pending.ready {
+		os.Remove(base.pending.workingSet)
+	}
+	base.pending = &pendingRecord{trace: initTrace(base.getTraceFile())}
+	if !base.isActive {
+		m.applyRecord(base)
+	}
+	return nil
+}
+
+// Stats are the REAP stats of a snapshot, averaged over the replays measured
+// since the last reset.
+type Stats struct {
+	Metrics       bool // whether replays are measured
+	RecordPages   int
+	RecordRegions int
+	Replays       int
+	FetchStateUs  float64
+	InstallWSUs   float64
+	ServeUniqueUs float64
+	UniqueFaults  float64 // faults on pages outside the working set
+}
+
+// SetMetricsMode turns measuring replays of a snapshot on or off, from its
+// next activation on.
+func (m *MemoryManager) SetMetricsMode(ssId string, on bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.metricsModes[ssId] = on
+	if base, ok := m.instances[ssId]; ok {
+		base.collectMetrics = on
+	}
+}
+
+// foldMetrics adds the metrics of a replay on a copy to the first instance of
+// its snapshot, which keeps the stats of the snapshot. Called with the manager
+// locked.
+func (m *MemoryManager) foldMetrics(state *SnapshotState) {
+	if !state.metricsModeOn || !state.isRecordReady {
+		return
+	}
+	base, ok := m.instances[state.ssID]
+	if !ok || base == state {
+		return
+	}
+
+	base.uniquePFServed = append(base.uniquePFServed, float64(state.uniqueNum))
+	if state.IsLazyMode {
+		base.totalPFServed = append(base.totalPFServed, float64(state.replayedNum))
+		base.reusedPFServed = append(base.reusedPFServed, float64(state.replayedNum-state.uniqueNum))
+	}
+	base.latencyMetrics = append(base.latencyMetrics, state.currentMetric)
+}
+
+// Stats returns the stats of a snapshot.
+func (m *MemoryManager) Stats(ssId string) (Stats, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	base, ok := m.instances[ssId]
+	if !ok {
+		return Stats{}, fmt.Errorf("reap snapshot %s does not exist", ssId)
+	}
+
+	st := Stats{
+		Metrics:       base.collectMetrics,
+		RecordPages:   len(base.trace.trace),
+		RecordRegions: len(base.trace.regions),
+		Replays:       len(base.latencyMetrics),
+	}
+	for _, lm := range base.latencyMetrics {
+		st.FetchStateUs += lm.MetricMap[fetchStateMetric]
+		st.InstallWSUs += lm.MetricMap[installWSMetric]
+		st.ServeUniqueUs += lm.MetricMap[serveUniqueMetric]
+	}
+	if st.Replays > 0 {
+		st.FetchStateUs /= float64(st.Replays)
+		st.InstallWSUs /= float64(st.Replays)
+		st.ServeUniqueUs /= float64(st.Replays)
+	}
+	if len(base.uniquePFServed) > 0 {
+		st.UniqueFaults = stat.Mean(base.uniquePFServed, nil)
+	}
+	return st, nil
+}
+
+// ResetStats drops the measured replays of a snapshot.
+func (m *MemoryManager) ResetStats(ssId string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	base, ok := m.instances[ssId]
+	if !ok {
+		return fmt.Errorf("reap snapshot %s does not exist", ssId)
+	}
+
+	base.totalPFServed = nil
+	base.uniquePFServed = nil
+	base.reusedPFServed = nil
+	base.latencyMetrics = nil
+	return nil
+}
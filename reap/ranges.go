@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package reap
+
+import "sort"
+
+// addrRange is the half-open address range [start, end).
+type addrRange struct {
+	start, end uint64
+}
+
+// rangeSet is a set of disjoint, sorted address ranges.
+type rangeSet struct {
+	ranges []addrRange
+}
+
+// add inserts [start, end), merging it with overlapping or adjacent ranges.
+func (rs *rangeSet) add(start, end uint64) {
+	if start >= end {
+		return
+	}
+	merged := make([]addrRange, 0, len(rs.ranges)+1)
+	i := 0
+	for ; i < len(rs.ranges) && rs.ranges[i].end < start; i++ {
+		merged = append(merged, rs.ranges[i])
+	}
+	for ; i < len(rs.ranges) && rs.ranges[i].start <= end; i++ {
+		if rs.ranges[i].start < start {
+			start = rs.ranges[i].start
+		}
+		if rs.ranges[i].end > end {
+			end = rs.ranges[i].end
+		}
+	}
+	merged = append(merged, addrRange{start, end})
+	rs.ranges = append(merged, rs.ranges[i:]...)
+}
+
+// remove deletes [start, end) from the set.
+func (rs *rangeSet) remove(start, end uint64) {
+	if start >= end {
+		return
+	}
+	kept := make([]addrRange, 0, len(rs.ranges)+1)
+	for _, r := range rs.ranges {
+		if r.end <= start || r.start >= end {
+			kept = append(kept, r)
+			continue
+		}
+		if r.start < start {
+			kept = append(kept, addrRange{r.start, start})
+		}
+		if r.end > end {
+			kept = append(kept, addrRange{end, r.end})
+		}
+	}
+	rs.ranges = kept
+}
+
+// overlaps reports whether any address in [start, end) is in the set.
+func (rs *rangeSet) overlaps(start, end uint64) bool {
+	i := sort.Search(len(rs.ranges), func(i int) bool { return rs.ranges[i].end > start })
+	return i < len(rs.ranges) && rs.ranges[i].start < end
+}
+
+func (rs *rangeSet) contains(addr uint64) bool {
+	i := sort.Search(len(rs.ranges), func(i int) bool { return rs.ranges[i].end > addr })
+	return i < len(rs.ranges) && rs.ranges[i].start <= addr
+}
+
+// move relocates the part of the set within [from, from+length) to start at to,
+// following an mremap of that range.
+func (rs *rangeSet) move(from, to, length uint64) {
+	moved := []addrRange{}
+	for _, r := range rs.ranges {
+		if r.end <= from || r.start >= from+length {
+			continue
+		}
+		start, end := r.start, r.end
+		if start < from {
+			start = from
+		}
+		if end > from+length {
+			end = from + length
+		}
+		moved = append(moved, addrRange{start - from + to, end - from + to})
+	}
+	rs.remove(from, from+length)
+	for _, r := range moved {
+		rs.add(r.start, r.end)
+	}
+}
+
+// remap records that the guest memory at [to, to+length) was moved there from
+// from, so faults are served with the snapshot data of the original address.
+type remap struct {
+	from, to, length uint64
+}
+
+// origin returns the address a faulting address had before any remaps.
+func origin(remaps []remap, addr uint64) uint64 {
+	for i := len(remaps) - 1; i >= 0; i-- {
+		r := remaps[i]
+		if addr >= r.to && addr < r.to+r.length {
+			addr = addr - r.to + r.from
+		}
+	}
+	return addr
+}
@@ -26,7 +26,11 @@ import (
 	"context"
 	"net/http"
 	"runtime"
+	"time"
 
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
 	// ctrdlog "github.com/containerd/containerd/log"
 	// fccdcri "github.com/ease-lab/vhive/cri"
@@ -52,13 +56,82 @@ import (
 
 var mmanager *MemoryManager
 
-func Setup() {
+func Setup(mmCfg MemoryManagerCfg) {
 	runtime.GOMAXPROCS(16)
-	mmCfg := MemoryManagerCfg{
-		MetricsModeOn: false,
+	if mmCfg.InstallWorkers <= 0 {
+		mmCfg.InstallWorkers = 4
 	}
 	mmanager = NewMemoryManager(mmCfg)
 
+	if err := view.Register(failureView, faultCountView, faultLatencyView, installLatencyView); err != nil {
+		log.Println("Failed to register REAP views:", err)
+	}
+}
+
+var (
+	failureOp, _ = tag.NewKey("op")
+	failureCount = stats.Int64("reap/failures", "REAP instances that failed serving page faults", stats.UnitDimensionless)
+	failureView  = &view.View{
+		Name:        "reap/failures",
+		Description: "REAP instances that failed serving page faults, by failed operation",
+		Measure:     failureCount,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{failureOp},
+	}
+)
+
+var (
+	faultKind, _     = tag.NewKey("kind")
+	latencyBuckets   = view.Distribution(5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 50000, 100000)
+	faultLatency     = stats.Float64("reap/fault_latency", "Time to serve a page fault", "us")
+	installLatency   = stats.Float64("reap/ws_install_latency", "Time to install the working set", "us")
+	faultLatencyView = &view.View{
+		Name:        "reap/fault_latency",
+		Description: "Time to serve a page fault, by kind of fault",
+		Measure:     faultLatency,
+		Aggregation: latencyBuckets,
+		TagKeys:     []tag.Key{faultKind},
+	}
+	faultCountView = &view.View{
+		Name:        "reap/faults",
+		Description: "Page faults served, by kind of fault",
+		Measure:     faultLatency,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{faultKind},
+	}
+	installLatencyView = &view.View{
+		Name:        "reap/ws_install_latency",
+		Description: "Time to install the working set in the background",
+		Measure:     installLatency,
+		Aggregation: latencyBuckets,
+	}
+)
+
+// fault kinds recorded with the latency
+const (
+	faultDemand    = "demand"    // a single page outside the working set
+	faultReadahead = "readahead" // a page outside the working set and its neighbours
+	faultZero      = "zero"      // a page the guest removed
+	faultInstalled = "installed" // a page the working set install got to first
+)
+
+func recordFaultLatency(kind string, d time.Duration) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(faultKind, kind)}, faultLatency.M(float64(d)/float64(time.Microsecond)))
+}
+
+func recordFailure(op string) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(failureOp, op)}, failureCount.M(1))
+}
+
+// OnFailure sets the function called when an instance fails serving page
+// faults. Other instances keep serving.
+func OnFailure(handler func(id string, err error)) {
+	mmanager.SetFailureHandler(handler)
+}
+
+// Failure returns the error instance id failed with, if any.
+func Failure(id string) error {
+	return mmanager.Failure(id)
 }
 
 func Deactivate(id string) ([]uint64, error) {
@@ -66,11 +139,38 @@ func Deactivate(id string) ([]uint64, error) {
 	// mmanager.DumpUPFPageStats(vmID, "fn1", mmanager.instances[vmID].MetricsPath)
 }
 
-func Register(ctx context.Context, ssId string, baseDir string, vmmStatePath string, guestMemPath string, memSize int, wsFileDirectIO, wsSingleRead bool) (string, error) {
+// Register registers an instance of a snapshot, serving guest memory from
+// guestMem.
+func Register(ctx context.Context, ssId string, baseDir string, vmmStatePath string, guestMem GuestMemory, memSize int, wsFileDirectIO, wsSingleRead bool) (string, error) {
 	_, span := trace.StartSpan(ctx, "reap.Register")
 	defer span.End()
 
-	return mmanager.RegisterVM(ssId, vmmStatePath, guestMemPath, baseDir, memSize, wsFileDirectIO, wsSingleRead)
+	return mmanager.RegisterVM(ssId, vmmStatePath, guestMem, baseDir, memSize, wsFileDirectIO, wsSingleRead)
+}
+
+// Rerecord makes the next activation of a snapshot record its working set
+// from scratch.
+func Rerecord(ssId, baseDir string) error {
+	return mmanager.Rerecord(ssId, baseDir)
+}
+
+// SetMetrics turns measuring replays of a snapshot on or off.
+func SetMetrics(ssId string, on bool) {
+	mmanager.SetMetricsMode(ssId, on)
+}
+
+// GetStats returns the REAP stats of a snapshot.
+func GetStats(ssId string) (Stats, error) {
+	return mmanager.Stats(ssId)
+}
+
+// ResetStats drops the REAP stats of a snapshot.
+func ResetStats(ssId string) error {
+	return mmanager.ResetStats(ssId)
+}
+
+func Deregister(ssId string) error {
+	return mmanager.DeregisterSnapshot(ssId)
 }
 
 func ClearCache(ctx context.Context, ssId string) error {
@@ -41,8 +41,8 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/ftrvxmtrx/fd"
 	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
 	"golang.org/x/sys/unix"
 
 	"github.com/ease-lab/vhive/metrics"
@@ -54,7 +54,8 @@ import (
 type SnapshotStateCfg struct {
 	VMID string
 
-	VMMStatePath, GuestMemPath, WorkingSetPath string
+	VMMStatePath, WorkingSetPath string
+	GuestMem                     GuestMemory
 
 	InstanceSockAddr string
 	BaseDir          string // base directory for the instance
@@ -64,6 +65,8 @@ type SnapshotStateCfg struct {
 	metricsModeOn    bool
 	WSFileDirectIO   bool
 	WSSingleRead     bool
+	InstallWorkers   int // goroutines installing the working set and serving faults
+	Readahead        int // extra pages installed with each fault outside the working set
 }
 
 // SnapshotState Stores the state of the snapshot
@@ -73,9 +76,18 @@ type SnapshotState struct {
 	firstPageFaultOnce *sync.Once // to initialize the start virtual address and replay
 	startAddress       uint64
 	userFaultFD        *os.File
+	uffdFeatures       uint64 // uffd features the VMM reported
+	uffdFeaturesKnown  bool   // whether the VMM reported any
 	trace              *Trace
 	epfd               int
-	quitCh             chan int
+	quitFd             int           // eventfd waking pollUserPageFaults to quit
+	stopping           chan struct{} // closed when pollUserPageFaults stops reading events
+	pollDone           chan struct{} // closed when pollUserPageFaults returns
+
+	// set when serving page faults failed; the instance serves no more faults
+	failLock sync.Mutex
+	failure  error
+	onFail   func(vmID string, err error)
 
 	// to indicate whether the instance has even been activated. this is to
 	// get around cases where offload is called for the first time
@@ -85,7 +97,31 @@ type SnapshotState struct {
 
 	isRecordReady bool
 
+	ssID string // snapshot of the instance, the VMID of its first instance
+	// guards the trace record, missed and the metrics counters, which the
+	// fault workers update concurrently
+	faultLock sync.Mutex
+	// faults outside the working set during this activation
+	missed []Record
+	// on the first instance of a snapshot only
+	pending        *pendingRecord
+	rebuilding     bool
+	collectMetrics bool // metrics mode of instances activated next
+
+	// working set install running in the background of demand faults
+	installWg     sync.WaitGroup
+	wsInstallTime time.Duration
+
+	// guards removed and remaps, which the working set install reads
+	eventLock sync.RWMutex
+	// guest addresses dropped by madvise or munmap; faults there get zero pages.
+	// Only known when the uffd has the non-cooperative events, see checkEvents
+	removed rangeSet
+	// mremaps of guest memory, oldest first
+	remaps []remap
+
 	guestMem   []byte
+	zmem       *CompressedMemory // instead of guestMem for compressed mem files
 	workingSet *[]byte
 	wsReadOnce *sync.Once
 	wsReadErr  *error
@@ -119,17 +155,66 @@ func NewSnapshotState(cfg SnapshotStateCfg) *SnapshotState {
 	return s
 }
 
-func (s *SnapshotState) setupStateOnActivate() {
+func (s *SnapshotState) setupStateOnActivate() error {
+	quitFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		log.Errorf("Failed to create the quit eventfd: %v", err)
+		return err
+	}
+	s.quitFd = quitFd
 	s.isActive = true
 	s.isEverActivated = true
 	s.firstPageFaultOnce = new(sync.Once)
-	s.quitCh = make(chan int)
+	s.stopping = make(chan struct{})
+	s.pollDone = make(chan struct{})
+	s.missed = nil
+	s.failLock.Lock()
+	s.failure = nil
+	s.failLock.Unlock()
 
 	if s.metricsModeOn {
 		s.uniqueNum = 0
 		s.replayedNum = 0
-		s.currentMetric = metrics.NewMetric()
 	}
+	return nil
+}
+
+// stopPolling wakes pollUserPageFaults, waits for it and its fault workers to
+// return, and closes the quit eventfd.
+func (s *SnapshotState) stopPolling() {
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+	if _, err := unix.Write(s.quitFd, one[:]); err != nil {
+		log.WithFields(log.Fields{"vmID": s.VMID}).Warnf("Failed to wake the page fault handler: %v", err)
+	}
+	<-s.pollDone
+	unix.Close(s.quitFd)
+}
+
+// fail marks the instance failed and stops serving page faults. Only the
+// first error is kept and reported.
+func (s *SnapshotState) fail(op string, err error) {
+	s.failLock.Lock()
+	first := s.failure == nil
+	if first {
+		s.failure = err
+	}
+	s.failLock.Unlock()
+	if !first {
+		return
+	}
+	log.WithFields(log.Fields{"vmID": s.VMID, "op": op}).Errorf("Instance failed: %v", err)
+	recordFailure(op)
+	if s.onFail != nil {
+		go s.onFail(s.VMID, err)
+	}
+}
+
+// Failure returns the error the instance failed with, if any.
+func (s *SnapshotState) Failure() error {
+	s.failLock.Lock()
+	defer s.failLock.Unlock()
+	return s.failure
 }
 
 func (s *SnapshotState) getUFFD() error {
@@ -150,18 +235,42 @@ func (s *SnapshotState) getUFFD() error {
 
 		defer c.Close()
 
-		sendfdConn := c.(*net.UnixConn)
-
-		fs, err := fd.Get(sendfdConn, 1, []string{"a file"})
+		uffd, features, known, err := receiveUserfaultfd(c.(*net.UnixConn))
 		if err != nil {
-			log.Error("Failed to receive the uffd")
+			log.Errorf("Failed to receive the uffd: %v", err)
 			return err
 		}
 
-		s.userFaultFD = fs[0]
+		s.userFaultFD = uffd
+		s.uffdFeatures, s.uffdFeaturesKnown = features, known
+
+		return nil
+	}
+}
 
+// checkEvents reports a uffd without the non-cooperative events, as sent by
+// Firecracker. REAP is then not told about pages the guest drops or moves,
+// such as the pages a balloon device reclaims, and serves them stale snapshot
+// contents. It is an error if require is set, and a warning on the first
+// activation otherwise.
+func (s *SnapshotState) checkEvents(require bool) error {
+	missing := eventFeatures() &^ s.uffdFeatures
+	if s.uffdFeaturesKnown && missing == 0 {
 		return nil
 	}
+	err := fmt.Errorf("the uffd lacks the non-cooperative event features %#x", missing)
+	if !s.uffdFeaturesKnown {
+		err = errors.New("the VMM did not report the uffd features, the non-cooperative events may be missing")
+	}
+	logger := log.WithFields(log.Fields{"vmID": s.VMID})
+	if require {
+		logger.Error(err)
+		return err
+	}
+	if !s.isEverActivated {
+		logger.Warnf("%v; remove, unmap, remap and fork events are not handled, pages the guest drops or moves are served from the snapshot", err)
+	}
+	return nil
 }
 
 func (s *SnapshotState) processMetrics() {
@@ -185,13 +294,33 @@ func (s *SnapshotState) getTraceFile() string {
 }
 
 func (s *SnapshotState) mapGuestMemory() error {
-	fd, err := os.OpenFile(s.GuestMemPath, os.O_RDONLY, 0444)
+	if s.GuestMem.Compressed {
+		var err error
+		if s.zmem, err = OpenCompressedMemory(s.GuestMem.Path); err != nil {
+			log.Errorf("Failed to open compressed guest memory: %v", err)
+			return err
+		}
+		return nil
+	}
+
+	fd, err := os.OpenFile(s.GuestMem.Path, os.O_RDONLY, 0444)
 	if err != nil {
 		log.Errorf("Failed to open guest memory file: %v", err)
 		return err
 	}
 
-	s.guestMem, err = unix.Mmap(int(fd.Fd()), 0, s.GuestMemSize, unix.PROT_READ, unix.MAP_PRIVATE)
+	size := s.GuestMemSize
+	if s.GuestMem.Pages != nil {
+		fi, err := fd.Stat()
+		if err != nil {
+			log.Errorf("Failed to stat the page store: %v", err)
+			fd.Close()
+			return err
+		}
+		size = int(fi.Size())
+	}
+
+	s.guestMem, err = unix.Mmap(int(fd.Fd()), 0, size, unix.PROT_READ, unix.MAP_PRIVATE)
 	if err != nil {
 		log.Errorf("Failed to mmap guest memory file: %v", err)
 		return err
@@ -206,6 +335,15 @@ func (s *SnapshotState) mapGuestMemory() error {
 }
 
 func (s *SnapshotState) unmapGuestMemory() error {
+	if s.zmem != nil {
+		err := s.zmem.Close()
+		s.zmem = nil
+		if err != nil {
+			log.Errorf("Failed to close compressed guest memory: %v", err)
+		}
+		return err
+	}
+
 	if err := unix.Munmap(s.guestMem); err != nil {
 		log.Errorf("Failed to munmap guest memory file: %v", err)
 		return err
@@ -224,11 +362,11 @@ func alignment(block []byte, alignSize int) int {
 
 // AlignedBlock returns []byte of size BlockSize aligned to a multiple
 // of alignSize in memory (must be power of two)
-func AlignedBlock(blockSize int) []byte {
+func AlignedBlock(blockSize int) ([]byte, error) {
 	alignSize := os.Getpagesize() // must be multiple of the filesystem block size
 
 	if blockSize == 0 {
-		return nil
+		return nil, nil
 	}
 
 	block := make([]byte, blockSize+alignSize)
@@ -244,21 +382,14 @@ func AlignedBlock(blockSize int) []byte {
 	if blockSize != 0 {
 		a = alignment(block, alignSize)
 		if a != 0 {
-			log.Fatal("Failed to align block")
+			return nil, errors.New("failed to align block")
 		}
 	}
-	return block
+	return block, nil
 }
 
-// fetchState Fetches the working set file (or the whole guest memory) and the VMM state file
-func (s *SnapshotState) fetchState() error {
-	if _, err := ioutil.ReadFile(s.VMMStatePath); err != nil {
-		log.Errorf("Failed to fetch VMM state: %v\n", err)
-		return err
-	}
-
-	size := len(s.trace.trace) * os.Getpagesize()
-
+// openWorkingSet opens the working set file for fetchState
+func (s *SnapshotState) openWorkingSet() (*os.File, error) {
 	var flags int
 	// O_DIRECT allows to fully leverage disk bandwidth by bypassing the OS page cache
 	if s.WSFileDirectIO {
@@ -269,13 +400,31 @@ func (s *SnapshotState) fetchState() error {
 	f, err := os.OpenFile(s.WorkingSetPath, flags, 0600)
 	if err != nil {
 		log.Errorf("Failed to open the working set file for direct-io: %v\n", err)
+		return nil, err
+	}
+	return f, nil
+}
+
+// fetchState Fetches the working set file (or the whole guest memory) and the VMM state file
+func (s *SnapshotState) fetchState(f *os.File) error {
+	if _, err := ioutil.ReadFile(s.VMMStatePath); err != nil {
+		log.Errorf("Failed to fetch VMM state: %v\n", err)
+		f.Close()
 		return err
 	}
 
+	size := len(s.trace.trace) * os.Getpagesize()
+
 	if s.SnapshotStateCfg.WSSingleRead {
 		s.wsReadOnce.Do(func() {
 			log.Info("Fetching the working set with sync.Once")
-			*s.workingSet = AlignedBlock(size) // direct io requires aligned buffer
+			var err error
+			// direct io requires aligned buffer
+			if *s.workingSet, err = AlignedBlock(size); err != nil {
+				log.Errorf("Allocating the working set failed: %v\n", err)
+				*s.wsReadErr = err
+				return
+			}
 			if n, err := f.Read(*s.workingSet); n != size || err != nil {
 				log.Errorf("Reading working set file failed: %v\n", err)
 				*s.wsReadErr = err
@@ -286,7 +435,12 @@ func (s *SnapshotState) fetchState() error {
 		}
 	} else {
 		log.Info("Fetching the working set")
-		*s.workingSet = AlignedBlock(size)
+		var err error
+		if *s.workingSet, err = AlignedBlock(size); err != nil {
+			log.Errorf("Allocating the working set failed: %v\n", err)
+			f.Close()
+			return err
+		}
 		if n, err := f.Read(*s.workingSet); n != size || err != nil {
 			log.Errorf("Reading working set file failed: %v\n", err)
 			return err
@@ -301,67 +455,143 @@ func (s *SnapshotState) fetchState() error {
 	return nil
 }
 
-func (s *SnapshotState) pollUserPageFaults(readyCh chan int) {
+// faultBatch is the most uffd events read at once.
+const faultBatch = 64
+
+// pollUserPageFaults reads uffd events until it is told to quit or fails.
+// Page faults are served by InstallWorkers goroutines, the other events
+// inline. Errors mark the instance failed instead of bringing down the daemon.
+func (s *SnapshotState) pollUserPageFaults(readyCh chan error) {
 	logger := log.WithFields(log.Fields{"vmID": s.VMID})
 
-	var events [1]syscall.EpollEvent
+	var events [faultBatch]syscall.EpollEvent
+
+	defer close(s.pollDone)
 
-	s.registerEpoller()
+	if err := s.registerEpoller(); err != nil {
+		s.fail("epoll", err)
+		readyCh <- err
+		return
+	}
 
 	logger.Debug("Starting polling loop")
 
 	defer syscall.Close(s.epfd)
 
-	readyCh <- 0
+	fd := int(s.userFaultFD.Fd())
+	workers := s.InstallWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	faults := newFaultQueue()
+	faults.start(workers, func(address uint64) {
+		if s.Failure() != nil {
+			return
+		}
+		if err := s.servePageFault(fd, address); err != nil && !errors.Is(err, errStopped) {
+			s.fail("fault", fmt.Errorf("serving page fault at %#x failed: %v", address, err))
+		}
+	})
+	// guest memory stays mapped until the workers are done
+	defer faults.stop()
+	defer close(s.stopping)
+
+	readyCh <- nil
+
+	msgSize := sizeOfUFFDMsg()
+	msgs := make([]byte, faultBatch*msgSize)
 
 	for {
-		select {
-		case <-s.quitCh:
-			logger.Debug("Handler received a signal to quit")
-			return
-		default:
-			nevents, err := syscall.EpollWait(s.epfd, events[:], -1)
-			if err != nil {
-				logger.Fatalf("epoll_wait: %v", err)
-				break
+		nevents, err := syscall.EpollWait(s.epfd, events[:], -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
 			}
+			s.fail("epoll", fmt.Errorf("epoll_wait: %v", err))
+			return
+		}
 
-			if nevents < 1 {
-				panic("Wrong number of events")
+		for i := 0; i < nevents; i++ {
+			switch int(events[i].Fd) {
+			case s.quitFd:
+				logger.Debug("Handler received a signal to quit")
+				return
+			case fd:
+			default:
+				s.fail("epoll", fmt.Errorf("received event from unknown fd %d", events[i].Fd))
+				return
 			}
 
-			for i := 0; i < nevents; i++ {
-				event := events[i]
-
-				fd := int(event.Fd)
-
-				stateFd := int(s.userFaultFD.Fd())
+			nread, err := syscall.Read(fd, msgs)
+			if errors.Is(err, syscall.EAGAIN) {
+				continue
+			}
+			if errors.Is(err, syscall.EBADF) {
+				return
+			}
+			if err != nil || nread%msgSize != 0 {
+				s.fail("read", fmt.Errorf("read uffd_msg failed: %v", err))
+				return
+			}
 
-				if fd != stateFd && stateFd != -1 {
-					logger.Fatalf("Received event from unknown fd")
+			for msg := msgs[:nread]; len(msg) > 0; msg = msg[msgSize:] {
+				if err := s.handleEvent(fd, msg[:msgSize], faults); err != nil {
+					s.fail("event", err)
+					return
 				}
+			}
+		}
 
-				goMsg := make([]byte, sizeOfUFFDMsg())
-
-				if nread, err := syscall.Read(fd, goMsg); err != nil || nread != len(goMsg) {
-					if !errors.Is(err, syscall.EBADF) {
-						log.Fatalf("Read uffd_msg failed: %v", err)
-					}
-					break
-				}
+		if s.Failure() != nil {
+			return
+		}
+	}
+}
 
-				if event := uint8(goMsg[0]); event != uffdPageFault() {
-					log.Fatal("Received wrong event type")
-				}
+// handleEvent dispatches a single uffd_msg read from the userfaultfd. Page
+// faults are queued for the fault workers; the first one also sets the start
+// address of guest memory, so it is known before any fault is served.
+func (s *SnapshotState) handleEvent(fd int, msg []byte, faults *faultQueue) error {
+	arg := msg[8:]
 
-				address := binary.LittleEndian.Uint64(goMsg[16:])
+	switch event := uint8(msg[0]); event {
+	case uffdPageFault():
+		address := binary.LittleEndian.Uint64(arg[8:])
+		s.firstPageFaultOnce.Do(func() {
+			s.startAddress = address
 
-				if err := s.servePageFault(fd, address); err != nil {
-					log.Fatalf("Failed to serve page fault")
-				}
+			if s.isRecordReady && !s.IsLazyMode {
+				s.installWg.Add(1)
+				go s.installWorkingSetPages(fd)
 			}
+		})
+		faults.push(address)
+	case uffdEventRemove(), uffdEventUnmap():
+		start := binary.LittleEndian.Uint64(arg)
+		end := binary.LittleEndian.Uint64(arg[8:])
+		log.WithFields(log.Fields{"vmID": s.VMID}).Debugf("Guest removed %#x-%#x", start, end)
+		s.eventLock.Lock()
+		s.removed.add(start, end)
+		s.eventLock.Unlock()
+	case uffdEventRemap():
+		from := binary.LittleEndian.Uint64(arg)
+		to := binary.LittleEndian.Uint64(arg[8:])
+		length := binary.LittleEndian.Uint64(arg[16:])
+		s.eventLock.Lock()
+		s.removed.move(from, to, length)
+		s.remaps = append(s.remaps, remap{from: from, to: to, length: length})
+		s.eventLock.Unlock()
+	case uffdEventFork():
+		// the child's memory is not served; closing its uffd lets it fault normally
+		ufd := int(binary.LittleEndian.Uint32(arg))
+		if err := syscall.Close(ufd); err != nil {
+			log.WithFields(log.Fields{"vmID": s.VMID}).Warnf("Failed to close forked uffd %d: %v", ufd, err)
 		}
+	default:
+		return fmt.Errorf("received unknown event type %d", event)
 	}
+
+	return nil
 }
 
 func (s *SnapshotState) registerEpoller() error {
@@ -394,50 +624,72 @@ func (s *SnapshotState) registerEpoller() error {
 		return err
 	}
 
+	quit := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(s.quitFd)}
+	if err := syscall.EpollCtl(s.epfd, syscall.EPOLL_CTL_ADD, s.quitFd, &quit); err != nil {
+		logger.Errorf("Failed to subscribe the quit eventfd %v", err)
+		return err
+	}
+
 	return nil
 }
 
+// servePageFault installs the page at address, and the pages read ahead with
+// it. Fault workers call it concurrently.
 func (s *SnapshotState) servePageFault(fd int, address uint64) error {
 	var (
-		tStart              time.Time
-		workingSetInstalled bool
+		tStart   = time.Now()
+		pageSize = uint64(os.Getpagesize())
+		dst      = address &^ (pageSize - 1)
+		pages    = uint64(1)
 	)
 
-	s.firstPageFaultOnce.Do(
-		func() {
-			s.startAddress = address
-
-			if s.isRecordReady && !s.IsLazyMode {
-				if s.metricsModeOn {
-					tStart = time.Now()
-				}
-				s.installWorkingSetPages(fd)
-				if s.metricsModeOn {
-					s.currentMetric.MetricMap[installWSMetric] = metrics.ToUS(time.Since(tStart))
-				}
-
-				workingSetInstalled = true
-			}
-		})
-
-	if workingSetInstalled {
-		return nil // what if the requested page is not in working set?
+	s.eventLock.RLock()
+	removed := s.removed.contains(dst)
+	offset := origin(s.remaps, dst) - s.startAddress
+	// faults are the record, so only read ahead when replaying
+	if s.isRecordReady && len(s.remaps) == 0 {
+		pages = s.readaheadPages(dst, offset)
+	}
+	s.eventLock.RUnlock()
+
+	// the guest dropped this page, so the snapshot contents are stale
+	if removed {
+		s.eventLock.Lock()
+		s.removed.remove(dst, dst+pageSize)
+		s.eventLock.Unlock()
+		err := s.retryBusy(func() error { return zeroRegion(fd, dst, 1) })
+		if errors.Is(err, syscall.EEXIST) {
+			err = wake(fd, dst, int(pageSize))
+		}
+		recordFaultLatency(faultZero, time.Since(tStart))
+		return err
 	}
 
-	offset := address - s.startAddress
-
-	src := uint64(uintptr(unsafe.Pointer(&s.guestMem[offset])))
-	dst := uint64(int64(address) & ^(int64(os.Getpagesize()) - 1))
+	var zr *blockReader
+	if s.zmem != nil {
+		// keep the decompressed block until it is copied
+		zr = s.zmem.reader()
+		defer s.zmem.put(zr)
+	}
+	src, err := s.guestPage(offset, zr)
+	if err != nil {
+		return err
+	}
 	mode := uint64(0)
 
 	rec := Record{
 		offset: offset,
 	}
 
+	s.faultLock.Lock()
 	if !s.isRecordReady {
-		s.trace.AppendRecord(rec)
-	} else {
+		// vCPUs faulting on one page each send a fault
+		if !s.trace.containsRecord(rec) {
+			s.trace.AppendRecord(rec)
+		}
+	} else if !s.IsLazyMode && !s.trace.containsRecord(rec) {
 		log.Debug("Serving a page that is missing from the working set")
+		s.missed = append(s.missed, rec)
 	}
 
 	if s.metricsModeOn {
@@ -452,22 +704,120 @@ func (s *SnapshotState) servePageFault(fd int, address uint64) error {
 			}
 
 		}
+	}
+	s.faultLock.Unlock()
 
-		tStart = time.Now()
+	kind := faultDemand
+	if pages > 1 {
+		kind = faultReadahead
 	}
 
-	err := installRegion(fd, src, dst, mode, 1)
+	err = s.retryBusy(func() error { return installRegion(fd, src, dst, mode, pages) })
+	if errors.Is(err, syscall.EEXIST) && pages > 1 {
+		// a neighbour is already there, serve just the faulting page
+		kind = faultDemand
+		err = s.retryBusy(func() error { return installRegion(fd, src, dst, mode, 1) })
+	}
+	if errors.Is(err, syscall.EEXIST) {
+		// the working set install got to the page after the fault was raised
+		kind = faultInstalled
+		err = wake(fd, dst, int(pageSize))
+	}
 
+	recordFaultLatency(kind, time.Since(tStart))
 	if s.metricsModeOn {
+		s.faultLock.Lock()
 		s.currentMetric.MetricMap[serveUniqueMetric] += metrics.ToUS(time.Since(tStart))
+		s.faultLock.Unlock()
 	}
 
 	return err
 }
 
+// readaheadPages returns how many pages starting at the faulting one to
+// install, stopping at the end of guest memory, at removed pages and where
+// the pages are not contiguous in the guest memory file. Called with eventLock
+// held.
+func (s *SnapshotState) readaheadPages(dst, offset uint64) uint64 {
+	pageSize := uint64(os.Getpagesize())
+	pages := uint64(1)
+	for pages <= uint64(s.Readahead) &&
+		offset+(pages+1)*pageSize <= uint64(s.GuestMemSize) &&
+		!s.removed.contains(dst+pages*pageSize) &&
+		s.contiguous(offset, pages+1) {
+		pages++
+	}
+	return pages
+}
+
+// guestPage returns the address of the contents of the guest page at offset,
+// followed by the pages contiguous with it. Pages of compressed memory are
+// decompressed with zr, and valid until it reads the next page.
+func (s *SnapshotState) guestPage(offset uint64, zr *blockReader) (uint64, error) {
+	if s.zmem != nil {
+		data, err := zr.block(int64(offset) / s.zmem.blockSize)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(uintptr(unsafe.Pointer(&data[int64(offset)%s.zmem.blockSize]))), nil
+	}
+	return uint64(uintptr(unsafe.Pointer(&s.guestMem[s.GuestMem.memOffset(offset)]))), nil
+}
+
+// contiguous reports whether n pages of guest memory starting at offset can
+// be installed from the address guestPage returns.
+func (s *SnapshotState) contiguous(offset, n uint64) bool {
+	if s.zmem != nil {
+		last := offset + (n-1)*uint64(os.Getpagesize())
+		return int64(offset)/s.zmem.blockSize == int64(last)/s.zmem.blockSize
+	}
+	return s.GuestMem.contiguous(offset, n)
+}
+
+// wsChunkPages is the most pages a working set install worker copies at once.
+const wsChunkPages = 256
+
+// wsChunk is a part of a working set region. src is the offset in the working
+// set file, dst the offset in guest memory.
+type wsChunk struct {
+	src, dst, pages uint64
+}
+
+// installWorkingSetPages installs the working set in chunks spread over
+// InstallWorkers goroutines. Demand faults are served meanwhile; whichever
+// installs a page first wins and the other sees EEXIST.
 func (s *SnapshotState) installWorkingSetPages(fd int) {
+	defer s.installWg.Done()
 	log.Debug("Installing the working set pages")
 
+	tStart := time.Now()
+	pageSize := uint64(os.Getpagesize())
+
+	workers := s.InstallWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	chunks := make(chan wsChunk)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				if s.Failure() != nil {
+					continue
+				}
+				// retried whole, so the event lock is not held while
+				// the poller waits for it with the next event unread
+				err := s.retryBusy(func() error { return s.installChunk(fd, c) })
+				if err != nil && !errors.Is(err, errStopped) {
+					s.fail("install", err)
+				}
+			}
+		}()
+	}
+
 	// build a list of sorted regions
 	keys := make([]uint64, 0)
 	for k := range s.trace.regions {
@@ -475,23 +825,99 @@ func (s *SnapshotState) installWorkingSetPages(fd int) {
 	}
 	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
 
-	var (
-		srcOffset uint64
-	)
+	var srcOffset uint64
 
+loop:
 	for _, offset := range keys {
-		regLength := s.trace.regions[offset]
-		regAddress := s.startAddress + offset
-		mode := uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE)
-		src := uint64(uintptr(unsafe.Pointer(&(*s.workingSet)[srcOffset])))
-		dst := regAddress
+		regLength := uint64(s.trace.regions[offset])
+		for done := uint64(0); done < regLength; done += wsChunkPages {
+			pages := regLength - done
+			if pages > wsChunkPages {
+				pages = wsChunkPages
+			}
+			select {
+			case chunks <- wsChunk{src: srcOffset + done*pageSize, dst: offset + done*pageSize, pages: pages}:
+			case <-s.pollDone:
+				break loop
+			}
+		}
+		srcOffset += regLength * pageSize
+	}
+	close(chunks)
+	wg.Wait()
 
-		installRegion(fd, src, dst, mode, uint64(regLength))
+	s.wsInstallTime = time.Since(tStart)
+	stats.Record(context.Background(), installLatency.M(float64(s.wsInstallTime)/float64(time.Microsecond)))
+}
+
+func (s *SnapshotState) installChunk(fd int, c wsChunk) error {
+	pageSize := uint64(os.Getpagesize())
 
-		srcOffset += uint64(regLength) * 4096
+	s.eventLock.RLock()
+	defer s.eventLock.RUnlock()
+
+	// the guest moved its memory, leave the rest to demand faults
+	if len(s.remaps) > 0 {
+		return nil
 	}
 
-	wake(fd, s.startAddress, os.Getpagesize())
+	src := uint64(uintptr(unsafe.Pointer(&(*s.workingSet)[c.src])))
+	dst := s.startAddress + c.dst
+
+	if !s.removed.overlaps(dst, dst+c.pages*pageSize) {
+		err := installRegion(fd, src, dst, 0, c.pages)
+		if !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+
+	// pages the guest already touched or dropped are left alone
+	for i := uint64(0); i < c.pages; i++ {
+		if s.removed.contains(dst + i*pageSize) {
+			continue
+		}
+		err := installRegion(fd, src+i*pageSize, dst+i*pageSize, 0, 1)
+		if errors.Is(err, syscall.EAGAIN) {
+			return err
+		}
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("installing page at %#x failed: %v", dst+i*pageSize, err)
+		}
+	}
+
+	return nil
+}
+
+// uffdBusyTimeout bounds how long a copy is retried while the uffd is busy.
+const uffdBusyTimeout = time.Second
+
+// errStopped is returned for copies abandoned because the handler stopped.
+var errStopped = errors.New("page fault handler stopped")
+
+// retryBusy calls install until it stops failing with EAGAIN, which the
+// kernel returns while the guest changes its memory and the event telling so
+// is unread. The poller reads it meanwhile; retries stop when it stops
+// reading events, or after uffdBusyTimeout.
+func (s *SnapshotState) retryBusy(install func() error) error {
+	wait := 10 * time.Microsecond
+	deadline := time.Now().Add(uffdBusyTimeout)
+	for {
+		err := install()
+		if !errors.Is(err, syscall.EAGAIN) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("uffd busy for %v: %v", uffdBusyTimeout, err)
+		}
+		select {
+		case <-s.stopping:
+			return errStopped
+		case <-time.After(wait):
+		}
+		if wait < time.Millisecond {
+			wait *= 2
+		}
+	}
 }
 
 func installRegion(fd int, src, dst, mode, len uint64) error {
@@ -511,6 +937,18 @@ func installRegion(fd int, src, dst, mode, len uint64) error {
 	return nil
 }
 
+func zeroRegion(fd int, dst, len uint64) error {
+	cUZ := C.struct_uffdio_zeropage{
+		_range: C.struct_uffdio_range{
+			start: C.ulonglong(dst),
+			len:   C.ulonglong(uint64(os.Getpagesize()) * len),
+		},
+		mode: 0,
+	}
+
+	return ioctl(uintptr(fd), int(C.const_UFFDIO_ZEROPAGE), unsafe.Pointer(&cUZ))
+}
+
 func ioctl(fd uintptr, request int, argp unsafe.Pointer) error {
 	_, _, errno := unix.Syscall(
 		unix.SYS_IOCTL,
@@ -522,13 +960,13 @@ func ioctl(fd uintptr, request int, argp unsafe.Pointer) error {
 		uintptr(argp),
 	)
 	if errno != 0 {
-		return os.NewSyscallError("ioctl", fmt.Errorf("%d", int(errno)))
+		return os.NewSyscallError("ioctl", errno)
 	}
 
 	return nil
 }
 
-func wake(fd int, startAddress uint64, len int) {
+func wake(fd int, startAddress uint64, len int) error {
 	cUR := C.struct_uffdio_range{
 		start: C.ulonglong(startAddress),
 		len:   C.ulonglong(len),
@@ -536,12 +974,37 @@ func wake(fd int, startAddress uint64, len int) {
 
 	err := ioctl(uintptr(fd), int(C.const_UFFDIO_WAKE), unsafe.Pointer(&cUR))
 	if err != nil {
-		log.Fatalf("ioctl failed: %v", err)
+		log.Errorf("ioctl failed: %v", err)
+		return err
 	}
+	return nil
 }
 
-func registerForUpf(startAddress []byte, len uint64) int {
-	return int(C.register_for_upf(unsafe.Pointer(&startAddress[0]), C.ulong(len)))
+// createUffd creates a uffd registered for missing pages of mem, enabling
+// those of features the kernel has; it returns them with the uffd.
+func createUffd(mem []byte, features uint64) (int, uint64, error) {
+	cFeatures := C.ulonglong(features)
+	uffd := C.create_uffd(unsafe.Pointer(&mem[0]), C.ulong(len(mem)), &cFeatures)
+	if uffd < 0 {
+		return -1, 0, syscall.Errno(-uffd)
+	}
+	return int(uffd), uint64(cFeatures), nil
+}
+
+// unregisterUffd stops fd from serving mem; threads waiting for a page of mem
+// are woken and fault normally.
+func unregisterUffd(fd int, mem []byte) error {
+	cUR := C.struct_uffdio_range{
+		start: C.ulonglong(uintptr(unsafe.Pointer(&mem[0]))),
+		len:   C.ulonglong(len(mem)),
+	}
+	return ioctl(uintptr(fd), int(C.const_UFFDIO_UNREGISTER), unsafe.Pointer(&cUR))
+}
+
+// eventFeatures returns the uffd features of the non-cooperative events the
+// page fault handler understands.
+func eventFeatures() uint64 {
+	return uint64(C.const_UFFD_FEATURE_EVENTS)
 }
 
 func sizeOfUFFDMsg() int {
@@ -551,3 +1014,19 @@ func sizeOfUFFDMsg() int {
 func uffdPageFault() uint8 {
 	return uint8(C.const_UFFD_EVENT_PAGEFAULT)
 }
+
+func uffdEventRemove() uint8 {
+	return uint8(C.const_UFFD_EVENT_REMOVE)
+}
+
+func uffdEventUnmap() uint8 {
+	return uint8(C.const_UFFD_EVENT_UNMAP)
+}
+
+func uffdEventRemap() uint8 {
+	return uint8(C.const_UFFD_EVENT_REMAP)
+}
+
+func uffdEventFork() uint8 {
+	return uint8(C.const_UFFD_EVENT_FORK)
+}
@@ -23,10 +23,13 @@
 package reap
 
 import (
-	"encoding/csv"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"os"
 	"sort"
-	"strconv"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -67,59 +70,147 @@ func (t *Trace) AppendRecord(r Record) {
 	t.containedOffsets[r.offset] = 0
 }
 
-// WriteTrace Writes all the records to a file
-func (t *Trace) WriteTrace() {
+// The trace file stores a processed record so replay survives daemon
+// restarts. All integers are unsigned varints:
+//
+//	magic "REAPTRC" | version byte | page size | record count |
+//	record offsets, each as the delta from the previous one |
+//	region count | regions as (start delta from the previous region end, pages) |
+//	CRC-32 (IEEE) of everything before it, 4 bytes little endian
+const (
+	traceMagic   = "REAPTRC"
+	traceVersion = 1
+)
+
+// errTraceVersion is returned for trace files written by another version or
+// page size; such traces are re-recorded.
+var errTraceVersion = errors.New("unsupported trace file version")
+
+// WriteTrace Writes the records and the regions to the trace file
+func (t *Trace) WriteTrace() error {
 	t.Lock()
 	defer t.Unlock()
 
-	file, err := os.Create(t.traceFileName)
-	if err != nil {
-		log.Fatalf("Failed to open trace file for writing: %v", err)
+	buf := []byte(traceMagic)
+	buf = append(buf, traceVersion)
+	buf = appendUvarint(buf, uint64(os.Getpagesize()))
+
+	buf = appendUvarint(buf, uint64(len(t.trace)))
+	var last uint64
+	for _, rec := range t.trace {
+		buf = appendUvarint(buf, rec.offset-last)
+		last = rec.offset
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	keys := make([]uint64, 0, len(t.regions))
+	for k := range t.regions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
 
-	for _, rec := range t.trace {
-		err := writer.Write([]string{
-			strconv.FormatUint(rec.offset, 16)})
-		if err != nil {
-			log.Fatalf("Failed to write trace: %v", err)
-		}
+	buf = appendUvarint(buf, uint64(len(keys)))
+	last = 0
+	for _, start := range keys {
+		pages := uint64(t.regions[start])
+		buf = appendUvarint(buf, start-last)
+		buf = appendUvarint(buf, pages)
+		last = start + pages*uint64(os.Getpagesize())
 	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf))
+	buf = append(buf, sum[:]...)
+
+	tmp := t.traceFileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		log.Errorf("Failed to write trace: %v", err)
+		return err
+	}
+	if err := os.Rename(tmp, t.traceFileName); err != nil {
+		log.Errorf("Failed to write trace: %v", err)
+		return err
+	}
+	return nil
 }
 
-// readTrace Reads all the records from a CSV file
-func (t *Trace) readTrace() {
-	f, err := os.Open(t.traceFileName)
+// readTrace Reads the records and the regions from the trace file
+func (t *Trace) readTrace() error {
+	buf, err := ioutil.ReadFile(t.traceFileName)
 	if err != nil {
-		log.Fatalf("Failed to open trace file for reading: %v", err)
+		log.Errorf("Failed to open trace file for reading: %v", err)
+		return err
 	}
-	defer f.Close()
 
-	lines, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		log.Fatalf("Failed to read from the trace file: %v", err)
+	if len(buf) < len(traceMagic)+1+4 || string(buf[:len(traceMagic)]) != traceMagic {
+		return fmt.Errorf("%s is not a trace file", t.traceFileName)
+	}
+	if buf[len(traceMagic)] != traceVersion {
+		return errTraceVersion
+	}
+	body, sum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("trace file %s is corrupt", t.traceFileName)
 	}
 
-	for _, line := range lines {
-		rec := readRecord(line)
-		t.AppendRecord(rec)
+	r := traceReader{buf: body[len(traceMagic)+1:]}
+	pageSize := r.next()
+	if r.err == nil && pageSize != uint64(os.Getpagesize()) {
+		return errTraceVersion
 	}
-}
 
-// readRecord Parses a record from a line
-func readRecord(line []string) Record {
-	offset, err := strconv.ParseUint(line[0], 16, 64)
-	if err != nil {
-		log.Fatalf("Failed to convert string to offset: %v", err)
+	records := make([]Record, r.next())
+	var last uint64
+	for i := range records {
+		last += r.next()
+		records[i] = Record{offset: last}
+	}
+
+	regions := make(map[uint64]int)
+	last = 0
+	for n := r.next(); n > 0 && r.err == nil; n-- {
+		start := last + r.next()
+		pages := r.next()
+		regions[start] = int(pages)
+		last = start + pages*pageSize
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("trace file %s is corrupt: %v", t.traceFileName, r.err)
 	}
 
-	rec := Record{
-		offset: offset,
+	t.Lock()
+	defer t.Unlock()
+	t.trace = records
+	t.regions = regions
+	t.containedOffsets = make(map[uint64]int)
+	for _, rec := range records {
+		t.containedOffsets[rec.offset] = 0
+	}
+	return nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// traceReader decodes varints, keeping the first error.
+type traceReader struct {
+	buf []byte
+	err error
+}
+
+func (r *traceReader) next() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("truncated varint")
+		return 0
 	}
-	return rec
+	r.buf = r.buf[n:]
+	return v
 }
 
 // Search trace for the record with the same offset
@@ -131,7 +222,7 @@ func (t *Trace) containsRecord(rec Record) bool {
 
 // ProcessRecord Prepares the trace, the regions map, and the working set file for replay
 // Must be called when record is done (i.e., it is not concurrency-safe vs. AppendRecord)
-func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) {
+func (t *Trace) ProcessRecord(GuestMem GuestMemory, WorkingSetPath string) error {
 	log.Debug("Preparing replay structures")
 
 	// sort trace records in the ascending order by offset
@@ -152,20 +243,22 @@ func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) {
 		last = rec.offset
 	}
 
-	t.writeWorkingSetPagesToFile(GuestMemPath, WorkingSetPath)
+	return t.writeWorkingSetPagesToFile(GuestMem, WorkingSetPath)
 }
 
-func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath string) {
+func (t *Trace) writeWorkingSetPagesToFile(guestMem GuestMemory, WorkingSetPath string) error {
 	log.Info("Writing the working set pages to a disk", WorkingSetPath)
 
-	fSrc, err := os.Open(guestMemFileName)
+	src, err := guestMem.open()
 	if err != nil {
-		log.Fatalf("Failed to open guest memory file for reading")
+		log.Errorf("Failed to open guest memory file for reading: %v", err)
+		return err
 	}
-	defer fSrc.Close()
+	defer src.Close()
 	fDst, err := os.Create(WorkingSetPath)
 	if err != nil {
-		log.Fatalf("Failed to open ws file for writing")
+		log.Errorf("Failed to open ws file for writing: %v", err)
+		return err
 	}
 	defer fDst.Close()
 
@@ -187,12 +280,14 @@ func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath stri
 
 		buf := make([]byte, copyLen)
 
-		if n, err := fSrc.ReadAt(buf, int64(offset)); n != copyLen || err != nil {
-			log.Fatalf("Read file failed for src")
+		if n, err := src.ReadAt(buf, int64(offset)); n != copyLen || err != nil {
+			log.Errorf("Read file failed for src: %v", err)
+			return fmt.Errorf("reading %d bytes at %#x of %s failed: %v", copyLen, offset, guestMem.Path, err)
 		}
 
 		if n, err := fDst.WriteAt(buf, dstOffset); n != copyLen || err != nil {
-			log.Fatalf("Write file failed for dst")
+			log.Errorf("Write file failed for dst: %v", err)
+			return fmt.Errorf("writing %d bytes to %s failed: %v", copyLen, WorkingSetPath, err)
 		}
 
 		dstOffset += int64(copyLen)
@@ -200,5 +295,5 @@ func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath stri
 		count += regLength
 	}
 
-	fDst.Sync()
+	return fDst.Sync()
 }
@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2022 Lixiang Ao
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package reap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The VMM hands REAP its uffd over InstanceSockAddr, sending with it the uffd
+// features it negotiated as a little-endian uint64. VMMs sending no features
+// are assumed to lack the non-cooperative events. Firecracker sends the uffd
+// alone and creates it without the events, so with it REAP serves page faults
+// only; the remove, unmap, remap and fork events are handled for VMMs that
+// create their uffd like NewUserfaultfd and send it with SendUserfaultfd.
+const uffdFeaturesSize = 8
+
+// NewUserfaultfd creates a userfaultfd serving missing pages of mem, with
+// the non-cooperative events REAP handles that the kernel has. It returns the
+// uffd and the features enabled, to send REAP with SendUserfaultfd.
+func NewUserfaultfd(mem []byte) (*os.File, uint64, error) {
+	if len(mem) == 0 {
+		return nil, 0, errors.New("no memory to register")
+	}
+	uffd, features, err := createUffd(mem, eventFeatures())
+	if err != nil {
+		return nil, 0, os.NewSyscallError("userfaultfd", err)
+	}
+	return os.NewFile(uintptr(uffd), "uffd"), features, nil
+}
+
+// CloseUserfaultfd closes a uffd made by NewUserfaultfd for mem. It wakes
+// the threads waiting for pages of mem first, which REAP may no longer serve,
+// so that mem can be unmapped.
+func CloseUserfaultfd(uffd *os.File, mem []byte) error {
+	err := unregisterUffd(int(uffd.Fd()), mem)
+	if cerr := uffd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SendUserfaultfd sends REAP the uffd and the features it was created with.
+func SendUserfaultfd(conn *net.UnixConn, uffd *os.File, features uint64) error {
+	var payload [uffdFeaturesSize]byte
+	binary.LittleEndian.PutUint64(payload[:], features)
+	_, _, err := conn.WriteMsgUnix(payload[:], syscall.UnixRights(int(uffd.Fd())), nil)
+	return err
+}
+
+// receiveUserfaultfd reads the uffd sent by the VMM, and the features it
+// reported; known is false when it reported none.
+func receiveUserfaultfd(conn *net.UnixConn) (uffd *os.File, features uint64, known bool, err error) {
+	payload := make([]byte, uffdFeaturesSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(payload, oob)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(msgs) != 1 {
+		return nil, 0, false, fmt.Errorf("received %d control messages, want 1", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, 0, false, fmt.Errorf("received %d fds, want 1", len(fds))
+	}
+	if n == uffdFeaturesSize {
+		features, known = binary.LittleEndian.Uint64(payload), true
+	}
+	return os.NewFile(uintptr(fds[0]), "uffd"), features, known, nil
+}
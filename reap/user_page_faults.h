@@ -37,29 +37,59 @@ int const_UFFDIO_WAKE = UFFDIO_WAKE;
 int const_UFFDIO_COPY = UFFDIO_COPY;
 int const_UFFD_EVENT_PAGEFAULT = UFFD_EVENT_PAGEFAULT;
 int const_UFFDIO_COPY_MODE_DONTWAKE = UFFDIO_COPY_MODE_DONTWAKE;
+int const_UFFDIO_ZEROPAGE = UFFDIO_ZEROPAGE;
+int const_UFFDIO_UNREGISTER = UFFDIO_UNREGISTER;
+int const_UFFD_EVENT_FORK = UFFD_EVENT_FORK;
+int const_UFFD_EVENT_REMAP = UFFD_EVENT_REMAP;
+int const_UFFD_EVENT_REMOVE = UFFD_EVENT_REMOVE;
+int const_UFFD_EVENT_UNMAP = UFFD_EVENT_UNMAP;
 
-#define errExit(msg) \
-    do { perror(msg); exit(EXIT_FAILURE); } while (0)
+// non-cooperative events the handler understands; the VMM should request them
+// when it creates the uffd, as create_uffd does
+unsigned long long const_UFFD_FEATURE_EVENTS = UFFD_FEATURE_EVENT_FORK |
+    UFFD_FEATURE_EVENT_REMAP | UFFD_FEATURE_EVENT_REMOVE | UFFD_FEATURE_EVENT_UNMAP;
 
-long register_for_upf(void *start_address, unsigned long len) {
-    struct uffdio_api uffdio_api;
+// create_uffd creates a userfaultfd serving missing pages of the len bytes at
+// start_address. Of the features requested, those the kernel has are enabled
+// and stored back in *features. Returns the uffd, or -errno.
+long create_uffd(void *start_address, unsigned long len, unsigned long long *features) {
+    struct uffdio_api uffdio_api = { .api = UFFD_API, .features = 0 };
     struct uffdio_register uffdio_register;
     long uffd;
+    int err;
 
+    // UFFDIO_API fails on features the kernel lacks, so ask a throwaway
+    // uffd which ones it has first; the API handshake works once per uffd
     uffd = syscall(__NR_userfaultfd, O_CLOEXEC | O_NONBLOCK);
     if (uffd == -1)
-            errExit("userfaultfd");
+        return -errno;
+    if (ioctl(uffd, UFFDIO_API, &uffdio_api) == -1) {
+        err = errno;
+        close(uffd);
+        return -err;
+    }
+    close(uffd);
 
+    // the kernel answers with every feature it has, not the enabled ones
+    *features &= uffdio_api.features;
     uffdio_api.api = UFFD_API;
-    uffdio_api.features = 0;
+    uffdio_api.features = *features;
+    uffd = syscall(__NR_userfaultfd, O_CLOEXEC | O_NONBLOCK);
+    if (uffd == -1)
+        return -errno;
     if (ioctl(uffd, UFFDIO_API, &uffdio_api) == -1)
-        errExit("ioctl-UFFDIO_API");
+        goto fail;
 
     uffdio_register.range.start = (unsigned long) start_address;
     uffdio_register.range.len = len;
     uffdio_register.mode = UFFDIO_REGISTER_MODE_MISSING;
     if (ioctl(uffd, UFFDIO_REGISTER, &uffdio_register) == -1)
-        errExit("ioctl-UFFDIO_REGISTER");
+        goto fail;
 
     return uffd;
+
+fail:
+    err = errno;
+    close(uffd);
+    return -err;
 }
@@ -17,12 +17,8 @@ import (
 	"github.com/ucsdsysnet/faasnap/models"
 	"github.com/ucsdsysnet/faasnap/restapi/operations"
 
-	"contrib.go.opencensus.io/exporter/zipkin"
-	openzipkin "github.com/openzipkin/zipkin-go"
-	zipkinHTTP "github.com/openzipkin/zipkin-go/reporter/http"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/stats/view"
-	"go.opencensus.io/trace"
 )
 
 //go:generate swagger generate server --target ../../faasnap --name faasnap --spec ../swagger.json --principal interface{}
@@ -50,6 +46,10 @@ func configureAPI(api *operations.FaasnapAPI) http.Handler {
 
 	api.JSONProducer = runtime.JSONProducer()
 
+	api.BinConsumer = runtime.ByteStreamConsumer()
+
+	api.BinProducer = runtime.ByteStreamProducer()
+
 	api.DeleteVmsVMIDHandler = operations.DeleteVmsVMIDHandlerFunc(func(params operations.DeleteVmsVMIDParams) middleware.Responder {
 		if err := daemon.StopVM(params.HTTPRequest, params.VMID); err != nil {
 			return operations.NewDeleteVmsVMIDBadRequest().WithPayload(&operations.DeleteVmsVMIDBadRequestBody{Message: err.Error()})
@@ -57,38 +57,49 @@ func configureAPI(api *operations.FaasnapAPI) http.Handler {
 		return operations.NewDeleteVmsVMIDOK()
 	})
 
-	if api.GetFunctionsHandler == nil {
-		api.GetFunctionsHandler = operations.GetFunctionsHandlerFunc(func(params operations.GetFunctionsParams) middleware.Responder {
-			return middleware.NotImplemented("operation operations.GetFunctions has not yet been implemented")
-		})
-	}
-	if api.GetVmsHandler == nil {
-		api.GetVmsHandler = operations.GetVmsHandlerFunc(func(params operations.GetVmsParams) middleware.Responder {
-			return middleware.NotImplemented("operation operations.GetVms has not yet been implemented")
-		})
-	}
-	if api.GetVmsVMIDHandler == nil {
-		api.GetVmsVMIDHandler = operations.GetVmsVMIDHandlerFunc(func(params operations.GetVmsVMIDParams) middleware.Responder {
-			return middleware.NotImplemented("operation operations.GetVmsVMID has not yet been implemented")
-		})
-	}
+	api.GetFunctionsHandler = operations.GetFunctionsHandlerFunc(func(params operations.GetFunctionsParams) middleware.Responder {
+		return operations.NewGetFunctionsOK().WithPayload(daemon.GetFunctions())
+	})
+	api.GetVmsHandler = operations.GetVmsHandlerFunc(func(params operations.GetVmsParams) middleware.Responder {
+		var function, namespace string
+		if params.Function != nil {
+			function = *params.Function
+		}
+		if params.Namespace != nil {
+			namespace = *params.Namespace
+		}
+		return operations.NewGetVmsOK().WithPayload(daemon.GetVMs(function, namespace))
+	})
+	api.GetVmsVMIDHandler = operations.GetVmsVMIDHandlerFunc(func(params operations.GetVmsVMIDParams) middleware.Responder {
+		vm, err := daemon.GetVM(params.VMID)
+		if err != nil {
+			return operations.NewGetVmsVMIDBadRequest().WithPayload(&operations.GetVmsVMIDBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewGetVmsVMIDOK().WithPayload(vm)
+	})
 	api.PostFunctionsHandler = operations.PostFunctionsHandlerFunc(func(params operations.PostFunctionsParams) middleware.Responder {
 		if err := daemon.CreateFunction(params); err != nil {
 			return operations.NewPostFunctionsBadRequest().WithPayload(&operations.PostFunctionsBadRequestBody{Message: err.Error()})
 		}
 		return operations.NewPostFunctionsOK()
 	})
+	api.PutFunctionsFuncNamePolicyHandler = operations.PutFunctionsFuncNamePolicyHandlerFunc(func(params operations.PutFunctionsFuncNamePolicyParams) middleware.Responder {
+		if err := daemon.SetFunctionPolicy(params.FuncName, params.Policy); err != nil {
+			return operations.NewPutFunctionsFuncNamePolicyBadRequest().WithPayload(&operations.PutFunctionsFuncNamePolicyBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewPutFunctionsFuncNamePolicyOK()
+	})
 	api.PostInvocationsHandler = operations.PostInvocationsHandlerFunc(func(params operations.PostInvocationsParams) middleware.Responder {
 		// intLoadMincore := make([]int, len(params.Invocation.LoadMincore))
 		// for i, v := range params.Invocation.LoadMincore {
 		// 	intLoadMincore[i] = int(v)
 		// }
-		result, vmId, traceId, err := daemon.InvokeFunction(params.HTTPRequest, params.Invocation)
+		result, vmId, traceId, timing, err := daemon.InvokeFunction(params.HTTPRequest, params.Invocation)
 		if err != nil {
 			return operations.NewPostInvocationsBadRequest().WithPayload(&operations.PostInvocationsBadRequestBody{Message: err.Error()})
 		}
 		return operations.NewPostInvocationsOK().WithPayload(&operations.PostInvocationsOKBody{
-			Duration: 0, VMID: vmId, Result: result, TraceID: traceId})
+			Duration: timing.TotalMs, VMID: vmId, Result: result, TraceID: traceId, Timing: timing})
 	})
 	api.PostSnapshotsHandler = operations.PostSnapshotsHandlerFunc(func(params operations.PostSnapshotsParams) middleware.Responder {
 		ssId, err := daemon.TakeSnapshot(params.HTTPRequest, *params.Snapshot.VMID, params.Snapshot.SnapshotType, params.Snapshot.SnapshotPath,
@@ -101,6 +112,23 @@ func configureAPI(api *operations.FaasnapAPI) http.Handler {
 		return &operations.PostSnapshotsOK{Payload: &ret}
 	})
 
+	api.GetSnapshotsHandler = operations.GetSnapshotsHandlerFunc(func(params operations.GetSnapshotsParams) middleware.Responder {
+		return operations.NewGetSnapshotsOK().WithPayload(daemon.GetSnapshots())
+	})
+	api.GetSnapshotsSsIDHandler = operations.GetSnapshotsSsIDHandlerFunc(func(params operations.GetSnapshotsSsIDParams) middleware.Responder {
+		snap, err := daemon.GetSnapshot(params.SsID)
+		if err != nil {
+			return operations.NewGetSnapshotsSsIDBadRequest().WithPayload(&operations.GetSnapshotsSsIDBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewGetSnapshotsSsIDOK().WithPayload(snap)
+	})
+	api.DeleteSnapshotsSsIDHandler = operations.DeleteSnapshotsSsIDHandlerFunc(func(params operations.DeleteSnapshotsSsIDParams) middleware.Responder {
+		if err := daemon.DeleteSnapshot(params.SsID); err != nil {
+			return operations.NewDeleteSnapshotsSsIDBadRequest().WithPayload(&operations.DeleteSnapshotsSsIDBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewDeleteSnapshotsSsIDOK()
+	})
+
 	api.PutSnapshotsHandler = operations.PutSnapshotsHandlerFunc(func(params operations.PutSnapshotsParams) middleware.Responder {
 		snap, err := daemon.CopySnapshot(params.HTTPRequest.Context(), params.FromSnapshot, params.MemFilePath)
 		if err != nil {
@@ -109,12 +137,46 @@ func configureAPI(api *operations.FaasnapAPI) http.Handler {
 		return &operations.PutSnapshotsOK{Payload: snap}
 	})
 	api.PatchSnapshotsSsIDHandler = operations.PatchSnapshotsSsIDHandlerFunc(func(params operations.PatchSnapshotsSsIDParams) middleware.Responder {
-		if err := daemon.ChangeSnapshot(params.HTTPRequest, params.SsID, params.State.DigHole, params.State.LoadCache, params.State.DropCache); err != nil {
+		if err := daemon.ChangeSnapshot(params.HTTPRequest, params.SsID, params.State.DigHole, params.State.LoadCache, params.State.DropCache, params.State.Dedup, params.State.Compress); err != nil {
 			return &operations.PatchSnapshotsSsIDBadRequest{Payload: &operations.PatchSnapshotsSsIDBadRequestBody{Message: err.Error()}}
 		}
 		return &operations.PatchSnapshotsSsIDOK{}
 	})
 
+	api.GetSnapshotsSsIDExportHandler = operations.GetSnapshotsSsIDExportHandlerFunc(func(params operations.GetSnapshotsSsIDExportParams) middleware.Responder {
+		write, err := daemon.ExportSnapshot(params.SsID)
+		if err != nil {
+			return operations.NewGetSnapshotsSsIDExportBadRequest().WithPayload(&operations.GetSnapshotsSsIDExportBadRequestBody{Message: err.Error()})
+		}
+		return CustomResponder(func(w http.ResponseWriter, _ runtime.Producer) {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", params.SsID+".tar"))
+			w.WriteHeader(http.StatusOK)
+			if err := write(w); err != nil {
+				log.Println("exporting", params.SsID, "failed:", err)
+			}
+		})
+	})
+	api.PostSnapshotsImportHandler = operations.PostSnapshotsImportHandlerFunc(func(params operations.PostSnapshotsImportParams) middleware.Responder {
+		defer params.Bundle.Close()
+		snap, err := daemon.ImportSnapshot(params.Bundle)
+		if err != nil {
+			return operations.NewPostSnapshotsImportBadRequest().WithPayload(&operations.PostSnapshotsImportBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewPostSnapshotsImportOK().WithPayload(snap)
+	})
+	api.PostSnapshotsSsIDVerifyHandler = operations.PostSnapshotsSsIDVerifyHandlerFunc(func(params operations.PostSnapshotsSsIDVerifyParams) middleware.Responder {
+		var sample float64
+		var record bool
+		if params.Options != nil {
+			sample, record = params.Options.Sample, params.Options.Record
+		}
+		result, err := daemon.VerifySnapshot(params.SsID, sample, record)
+		if err != nil {
+			return operations.NewPostSnapshotsSsIDVerifyBadRequest().WithPayload(&operations.PostSnapshotsSsIDVerifyBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewPostSnapshotsSsIDVerifyOK().WithPayload(result)
+	})
+
 	api.GetSnapshotsSsIDMincoreHandler = operations.GetSnapshotsSsIDMincoreHandlerFunc(func(params operations.GetSnapshotsSsIDMincoreParams) middleware.Responder {
 		state, err := daemon.GetMincore(params.HTTPRequest, params.SsID)
 		if err != nil {
@@ -141,7 +203,8 @@ func configureAPI(api *operations.FaasnapAPI) http.Handler {
 		return &operations.PatchSnapshotsSsIDMincoreOK{}
 	})
 	api.PostVmsHandler = operations.PostVmsHandlerFunc(func(params operations.PostVmsParams) middleware.Responder {
-		vmId, err := daemon.StartVM(params.HTTPRequest, params.VM.FuncName, params.VM.SsID, params.VM.Namespace)
+		vmId, err := daemon.StartVM(params.HTTPRequest, params.VM.FuncName, params.VM.SsID, params.VM.Namespace,
+			params.VM.UseMemFile, params.VM.OverlayRegions, params.VM.UseWsFile, params.VM.EnableReap, params.VM.EnableDiffSnapshots)
 		if err != nil {
 			return operations.NewPostVmsBadRequest().WithPayload(&operations.PostVmsBadRequestBody{Message: err.Error()})
 		}
@@ -156,12 +219,43 @@ func configureAPI(api *operations.FaasnapAPI) http.Handler {
 		return operations.NewPostVmmsOK().WithPayload(&models.VM{VMID: &vmId})
 	})
 
+	api.GetSnapshotsSsIDReapHandler = operations.GetSnapshotsSsIDReapHandlerFunc(func(params operations.GetSnapshotsSsIDReapParams) middleware.Responder {
+		stats, err := daemon.GetReapStats(params.SsID)
+		if err != nil {
+			return operations.NewGetSnapshotsSsIDReapBadRequest().WithPayload(&operations.GetSnapshotsSsIDReapBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewGetSnapshotsSsIDReapOK().WithPayload(stats)
+	})
+	api.PutSnapshotsSsIDReapHandler = operations.PutSnapshotsSsIDReapHandlerFunc(func(params operations.PutSnapshotsSsIDReapParams) middleware.Responder {
+		if err := daemon.SetReapMetrics(params.SsID, params.Options.Metrics); err != nil {
+			return operations.NewPutSnapshotsSsIDReapBadRequest().WithPayload(&operations.PutSnapshotsSsIDReapBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewPutSnapshotsSsIDReapOK()
+	})
+	api.DeleteSnapshotsSsIDReapHandler = operations.DeleteSnapshotsSsIDReapHandlerFunc(func(params operations.DeleteSnapshotsSsIDReapParams) middleware.Responder {
+		if err := daemon.ResetReapStats(params.SsID); err != nil {
+			return operations.NewDeleteSnapshotsSsIDReapBadRequest().WithPayload(&operations.DeleteSnapshotsSsIDReapBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewDeleteSnapshotsSsIDReapOK()
+	})
 	api.PatchSnapshotsSsIDReapHandler = operations.PatchSnapshotsSsIDReapHandlerFunc(func(params operations.PatchSnapshotsSsIDReapParams) middleware.Responder {
 		if err := daemon.ChangeReapCacheState(params.HTTPRequest, params.SsID, params.Cache); err != nil {
 			return operations.NewPatchSnapshotsSsIDReapBadRequest().WithPayload(&operations.PatchSnapshotsSsIDReapBadRequestBody{Message: err.Error()})
 		}
 		return operations.NewPatchSnapshotsSsIDReapOK()
 	})
+	api.PostSnapshotsSsIDReapHandler = operations.PostSnapshotsSsIDReapHandlerFunc(func(params operations.PostSnapshotsSsIDReapParams) middleware.Responder {
+		if err := daemon.RerecordSnapshot(params.SsID); err != nil {
+			return operations.NewPostSnapshotsSsIDReapBadRequest().WithPayload(&operations.PostSnapshotsSsIDReapBadRequestBody{Message: err.Error()})
+		}
+		return operations.NewPostSnapshotsSsIDReapOK()
+	})
+
+	api.GetMetricsHandler = operations.GetMetricsHandlerFunc(func(params operations.GetMetricsParams) middleware.Responder {
+		return CustomResponder(func(w http.ResponseWriter, _ runtime.Producer) {
+			daemon.MetricsHandler().ServeHTTP(w, params.HTTPRequest)
+		})
+	})
 
 	api.PutNetIfacesNamespaceHandler = operations.PutNetIfacesNamespaceHandlerFunc(func(params operations.PutNetIfacesNamespaceParams) middleware.Responder {
 		err := daemon.PutNetwork(params.HTTPRequest, params.Namespace, params.Interface.HostDevName, params.Interface.IfaceID, params.Interface.GuestMac, params.Interface.GuestAddr, params.Interface.UniqueAddr)
@@ -183,9 +277,13 @@ func configureAPI(api *operations.FaasnapAPI) http.Handler {
 		})
 	})
 
-	api.PreServerShutdown = func() {}
+	api.PreServerShutdown = func() {
+		daemon.Drain(daemon.ShutdownTimeout)
+	}
 
-	api.ServerShutdown = func() {}
+	api.ServerShutdown = func() {
+		daemon.Shutdown(daemon.ShutdownTimeout)
+	}
 
 	return setupGlobalMiddleware(api.Serve(setupMiddlewares))
 }
@@ -203,17 +301,6 @@ func configureServer(s *http.Server, scheme, addr string) {
 	state = daemon.Setup(s, scheme, addr)
 }
 
-func registerZipkin(zipkinHost string, port int) {
-	localEndpoint, err := openzipkin.NewEndpoint("daemon", fmt.Sprintf("0.0.0.0:%v", port))
-	if err != nil {
-		log.Fatalf("Failed to create Zipkin exporter: %v", err)
-	}
-	reporter := zipkinHTTP.NewReporter(fmt.Sprintf("%v/api/v2/spans", zipkinHost))
-	exporter := zipkin.NewExporter(reporter, localEndpoint)
-	trace.RegisterExporter(exporter)
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
-}
-
 // The middleware configuration is for the handler executors. These do not apply to the swagger.json document.
 // The middleware executes after routing but before authentication, binding and validation.
 func setupMiddlewares(handler http.Handler) http.Handler {
@@ -223,11 +310,8 @@ func setupMiddlewares(handler http.Handler) http.Handler {
 // The middleware configuration happens before anything, this middleware also applies to serving the swagger.json document.
 // So this is a good place to plug in a panic handling middleware, logging and metrics.
 func setupGlobalMiddleware(handler http.Handler) http.Handler {
-	var port = 8080
-	var zipkinHost = "http://localhost:9411"
-
-	registerZipkin(zipkinHost, port)
-	h := &ochttp.Handler{Handler: handler}
+	// tracing is set up from the config by daemon.Setup
+	h := &ochttp.Handler{Handler: handler, GetStartOptions: daemon.TraceStartOptions}
 	if err := view.Register(ochttp.DefaultServerViews...); err != nil {
 		log.Fatal("Failed to register ochttp.DefaultServerViews")
 	}
@@ -1,4 +1,4 @@
-import time, sys, mmap
+import time, sys, mmap, os
 import subprocess
 
 from flask import Flask, request
@@ -71,17 +71,34 @@ def function(*args):
 def hello_world():
     return 'Hello, World!'
 
+# environment injected by the daemon once after the VM starts or is restored
+ENV = {}
+
+@app.route('/env', methods=['POST'])
+def env():
+    ENV.clear()
+    ENV.update(request.json)
+    os.environ.update(ENV)
+    return 'OK'
+
 @app.route('/invoke', methods=['POST'])
 def invoke():
     funcname = request.args['function']
-    redishost = request.args['redishost']
-    redispasswd = request.args['redispasswd']
+    redishost = ENV.get('REDIS_HOST', request.args.get('redishost'))
+    redispasswd = ENV.get('REDIS_PASSWD', request.args.get('redispasswd'))
 
     starttime = time.time()
     result = function(funcname, redishost, redispasswd, request.json)
     finishtime = time.time()
     return 'read %f\nprocess %f\nwrite %f' % (result[0]-starttime, result[1]-result[0], finishtime-result[1])
 
+@app.route('/drop_caches', methods=['POST'])
+def drop_caches():
+    mode = int(request.args['mode'])
+    with open('/proc/sys/vm/drop_caches', 'w') as f:
+        f.write('%d\n' % mode)
+    return 'OK'
+
 @app.route('/logs')
 def logs():
     ret, output = subprocess.getstatusoutput('journalctl')
@@ -102,3 +119,44 @@ def dmesg():
 def syslog():
     size = 1024 * 1024 * 500
     l = [1]*size
+
+# Proxy vsock connections to the flask server over loopback, so the daemon can
+# reach this agent through the firecracker vsock device without the VM network.
+VSOCK_PORT = 5000
+FLASK_ADDR = ('127.0.0.1', 5000)
+
+def vsock_proxy():
+    import socket, threading
+    def pipe(src, dst):
+        try:
+            while True:
+                data = src.recv(65536)
+                if not data:
+                    break
+                dst.sendall(data)
+        except OSError:
+            pass
+        finally:
+            try:
+                dst.shutdown(socket.SHUT_WR)
+            except OSError:
+                pass
+    def serve(conn):
+        upstream = socket.create_connection(FLASK_ADDR)
+        threading.Thread(target=pipe, args=(conn, upstream), daemon=True).start()
+        pipe(upstream, conn)
+        conn.close()
+        upstream.close()
+    try:
+        listener = socket.socket(socket.AF_VSOCK, socket.SOCK_STREAM)
+        listener.bind((socket.VMADDR_CID_ANY, VSOCK_PORT))
+        listener.listen()
+    except OSError:
+        return # no vsock device
+    while True:
+        conn, _ = listener.accept()
+        threading.Thread(target=serve, args=(conn,), daemon=True).start()
+
+import socket as _socket, threading as _threading
+if hasattr(_socket, 'AF_VSOCK'):
+    _threading.Thread(target=vsock_proxy, daemon=True).start()
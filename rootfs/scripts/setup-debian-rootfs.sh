@@ -55,7 +55,7 @@ Restart=always
 RestartSec=1
 User=root
 Environment="FLASK_APP=/app/daemon.py"
-ExecStart=python3 -m flask run --host=172.16.0.2
+ExecStart=python3 -m flask run --host=0.0.0.0 --port=5000
 [Install]
 WantedBy=multi-user.target
 EOF